@@ -218,6 +218,10 @@ func main() {
 		glog.Infoln(buildInfo.Notice())
 
 		glog.Infoln("Agent.Name=", agent.RegistryContainerEntry.Identity.Name)
+		if agent.PlanOnly {
+			agent.RunPlan()
+			break
+		}
 		glog.Infoln("Starting agent:", *agent, agent.Identity.String(), agent.Initializer.Context)
 
 		agent.Run() // blocks
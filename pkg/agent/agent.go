@@ -1,7 +1,6 @@
 package agent
 
 import (
-	"encoding/json"
 	"fmt"
 	"github.com/golang/glog"
 	. "github.com/infradash/dash/pkg/dash"
@@ -29,6 +28,26 @@ type Agent struct {
 
 	RegistryContainerEntry
 
+	// Attributes of this host for placement, published with the host's registration
+	Attributes HostAttributes `json:"attributes,omitempty"`
+
+	// Containers are not started when the docker data root has less free space
+	MinFreeDiskMB uint64 `json:"min_free_disk_mb,omitempty"`
+
+	// Interval between reconciliations of docker, the tracker and the registry.  0 disables.
+	ReconcileInterval time.Duration `json:"reconcile_interval,omitempty"`
+
+	// Saves the container states of each domain so their histories survive restarts.  Empty disables.
+	StateDir          string        `json:"state_dir,omitempty"`
+	StateSaveInterval time.Duration `json:"state_save_interval,omitempty"`
+
+	// Pulls the image of each release in the background as soon as it's released
+	PrePull bool `json:"prepull,omitempty"`
+
+	// Removes unused images and containers when the docker data root is running out of space
+	DiskVacuum DiskVacuumConfig `json:"disk_vacuum,omitempty"`
+	diskVacuum *DiskVacuum
+
 	ListenPort   int `json:"listen_port"`
 	DockerUIPort int `json:"dockerui_port"`
 
@@ -37,8 +56,15 @@ type Agent struct {
 
 	Initializer *ConfigLoader `json:"config_loader"`
 
+	ConfigReload       bool          `json:"config_reload,omitempty"`
+	ConfigPollInterval time.Duration `json:"config_poll_interval,omitempty"`
+	configWatch        chan<- bool
+
 	selfRegister bool `json:"-"`
 
+	// Plans the config and exits, without running anything
+	PlanOnly bool `json:"-"`
+
 	// json skips these fields
 	endpoint       http.Handler      `json:"-"`
 	zk             zk.ZK             `json:"-"`
@@ -53,6 +79,11 @@ type Agent struct {
 
 	StatusPubsubTopic string `json:"status_topic,omitempty"`
 	statusTopic       pubsub.Topic
+	status            func(Event)
+	statusLock        sync.Mutex
+
+	// Subscribers to the events of the agent
+	events event_bus
 }
 
 // Checks that all the information required for agent start up is met.
@@ -69,34 +100,33 @@ func (this *Agent) is_running_dockerui() bool {
 	return this.EnableUI && this.UiDocRoot != ""
 }
 
+// Stops the domains outside the lock, since their goroutines publish through the agent while stopping
 func (this *Agent) clear_state() error {
-	defer this.lock.Unlock()
 	this.lock.Lock()
+	domains := this.domains
 	this.domains = make(map[string]*Domain)
 	this.domainConfigs = make(map[string]DomainConfig)
-	return nil
-}
+	this.lock.Unlock()
 
-func (this *Agent) LoadConfig(config *ConfigLoader) error {
-	defer this.configLock.Unlock()
-	this.configLock.Lock()
-
-	if config == nil {
-		return nil
+	for _, domain := range domains {
+		domain.Stop()
 	}
+	return nil
+}
 
+// Fetches the domain configs from the config source and applies the domain-level variables.
+func (this *Agent) fetch_config(config *ConfigLoader) ([]DomainConfig, error) {
 	glog.Infoln("Loading configuration from", config.ConfigUrl)
 
 	var list []DomainConfig
 	_, err := config.Load(&list, this.AuthToken, this.zk)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	glog.Infoln("Loaded and applied configuration. Processing.")
 
-	this.clear_state()
-
+	result := []DomainConfig{}
 	for _, per_domain := range list {
 		applied := new(DomainConfig)
 		err := ApplyVarSubs(per_domain, applied,
@@ -104,18 +134,50 @@ func (this *Agent) LoadConfig(config *ConfigLoader) error {
 				"Domain": per_domain.Domain,
 			}, EscapeVars(ConfigVariables[1:]...)))
 		if err != nil {
-			return err
+			return nil, err
 		}
-		per_domain = *applied
+		result = append(result, *applied)
+	}
+	return result, nil
+}
 
-		if _, config_err := this.ConfigureDomain(&per_domain); config_err != nil {
-			return err
+func (this *Agent) LoadConfig(config *ConfigLoader) error {
+	defer this.configLock.Unlock()
+	this.configLock.Lock()
+
+	if config == nil {
+		return nil
+	}
+
+	list, err := this.fetch_config(config)
+	if err != nil {
+		return err
+	}
+
+	this.clear_state()
+
+	domains := []*Domain{}
+	for i := range list {
+		domain, config_err := this.ConfigureDomain(&list[i])
+		if config_err != nil {
+			return config_err
 		}
+		domains = append(domains, domain)
 	}
+	return this.start_domains(domains)
+}
 
+// Starts container monitors, discovery and the services of newly configured domains.
+func (this *Agent) start_domains(domains []*Domain) error {
 	glog.Infoln("Start running discovery / container monitors")
 	matcher := new(DiscoveryContainerMatcher).Init()
-	for _, domain := range this.domains {
+	for _, domain := range domains {
+		if err := domain.StartEventSinks(); err != nil {
+			return err
+		}
+		if err := domain.restore_tracker(); err != nil {
+			glog.Warningln("Cannot restore container states: Domain=", domain.Domain, "Err=", err)
+		}
 		watches, err := domain.GetContainerWatcherSpecs()
 		if err != nil {
 			return err
@@ -130,7 +192,7 @@ func (this *Agent) LoadConfig(config *ConfigLoader) error {
 		}
 	}
 
-	err = this.DiscoverRunningContainers(matcher.Match, this.onMatchContainer)
+	err := this.DiscoverRunningContainers(matcher.Match, this.onMatchContainer)
 	if err != nil {
 		glog.Infoln("Error discovering containers:", err)
 		return err
@@ -138,7 +200,7 @@ func (this *Agent) LoadConfig(config *ConfigLoader) error {
 
 	// Configure and start up services
 	glog.Infoln("Configure domains")
-	for _, domain := range this.domains {
+	for _, domain := range domains {
 		glog.Infoln("Starting services: Domain=", domain.Domain)
 		_, config_err := domain.StartServices(this.QualifyByTags)
 		if config_err != nil {
@@ -147,7 +209,7 @@ func (this *Agent) LoadConfig(config *ConfigLoader) error {
 	}
 
 	glog.Infoln("Synchronize local states with scheduler")
-	for _, domain := range this.domains {
+	for _, domain := range domains {
 		err := domain.SynchronizeSchedule()
 		if err != nil {
 			glog.Warningln("Failed to synchronize scheduling for Domain=", domain.Identity, "Err=", err)
@@ -155,6 +217,94 @@ func (this *Agent) LoadConfig(config *ConfigLoader) error {
 		}
 	}
 
+	for _, domain := range domains {
+		domain.StartReconcile(this.ReconcileInterval)
+		domain.StartTrackerSnapshots(this.StateSaveInterval)
+	}
+	return nil
+}
+
+// Reloads the configuration and applies the difference to the running domains without restarting
+// the agent.  Domains no longer in the config are stopped, new domains are started, and existing
+// domains have their added, removed and changed services started, stopped or restarted.
+func (this *Agent) ReloadConfig(config *ConfigLoader) error {
+	defer this.configLock.Unlock()
+	this.configLock.Lock()
+
+	if config == nil {
+		return nil
+	}
+
+	list, err := this.fetch_config(config)
+	if err != nil {
+		return err
+	}
+
+	next := map[string]*DomainConfig{}
+	for i := range list {
+		next[list[i].Domain] = &list[i]
+	}
+
+	this.lock.Lock()
+	current := map[string]*Domain{}
+	for name, domain := range this.domains {
+		current[name] = domain
+	}
+	this.lock.Unlock()
+
+	for name, domain := range current {
+		if _, has := next[name]; has {
+			continue
+		}
+		glog.Infoln("Config reload: removing Domain=", name)
+		domain.Stop()
+		this.lock.Lock()
+		delete(this.domains, name)
+		delete(this.domainConfigs, name)
+		this.lock.Unlock()
+	}
+
+	added := []*Domain{}
+	for name, domainConfig := range next {
+		if domain, has := current[name]; has {
+			glog.Infoln("Config reload: updating Domain=", name)
+			err := domain.ApplyConfig(domainConfig, this.QualifyByTags)
+			if err != nil {
+				return err
+			}
+			this.lock.Lock()
+			this.domainConfigs[name] = *domainConfig
+			this.lock.Unlock()
+			continue
+		}
+		glog.Infoln("Config reload: adding Domain=", name)
+		domain, err := this.ConfigureDomain(domainConfig)
+		if err != nil {
+			return err
+		}
+		added = append(added, domain)
+	}
+	if len(added) > 0 {
+		return this.start_domains(added)
+	}
+	return nil
+}
+
+// Watches the config source and reloads the configuration on change.
+func (this *Agent) WatchConfig(config *ConfigLoader) error {
+	if config == nil || config.ConfigUrl == "" {
+		return nil
+	}
+	stop, err := config.Watch(this.AuthToken, this.zk, this.ConfigPollInterval, func() {
+		glog.Infoln("Config changed at", config.ConfigUrl, "Reloading.")
+		if err := this.ReloadConfig(config); err != nil {
+			ExceptionEvent(err, config.ConfigUrl, "Error reloading config")
+		}
+	})
+	if err != nil {
+		return err
+	}
+	this.configWatch = stop
 	return nil
 }
 
@@ -226,11 +376,29 @@ func (this *Agent) Run() {
 		panic(err)
 	}
 
+	if this.ConfigReload {
+		err = this.WatchConfig(this.Initializer)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	err = this.StartDiskVacuum()
+	if err != nil {
+		panic(err)
+	}
+
 	runtime.MinimalContainer(this.ListenPort,
 		func() http.Handler {
 			return endpoint
 		},
 		func() error {
+			if this.configWatch != nil {
+				this.configWatch <- true
+			}
+			this.StopDiskVacuum()
+			this.clear_state()
+			glog.Infoln("Stopped domains")
 			err := endpoint.Stop()
 			glog.Infoln("Stopped endpoint", err)
 			err = this.zk.Close()
@@ -250,6 +418,7 @@ func (this *Agent) ConnectServices() error {
 		return err
 	}
 	this.zk = zc
+	metric_zk_connected.Set(1)
 	glog.Infoln("Connected to zookeeper:", this.Hosts)
 
 	glog.Infoln("Connecting to docker:", this.DockerSettings)
@@ -281,9 +450,6 @@ func (this *Agent) ConnectServices() error {
 	glog.Infoln("Start Zookeeper events channel")
 	go func() {
 
-		status := func(map[string]interface{}) {
-			// no-op
-		}
 		if this.StatusPubsubTopic != "" {
 
 			root, err := template.ApplyTemplate(this.StatusPubsubTopic, this, map[string]interface{}{
@@ -304,56 +470,47 @@ func (this *Agent) ConnectServices() error {
 			glog.Infoln("STATUS-TOPIC: Status topic=", topic)
 
 			if topic.Valid() {
-				if pb, err := topic.Broker().PubSub(id); err == nil {
-					status = func(evt map[string]interface{}) {
-						msg, err := json.Marshal(evt)
-						if err == nil {
-							pb.Publish(topic, msg)
-						}
-					}
+				if sink, err := new_pubsub_sink(topic, id); err == nil {
 					this.statusTopic = topic
+					this.statusLock.Lock()
+					this.status = func(evt Event) { sink.Send(evt) }
+					this.statusLock.Unlock()
 					glog.Infoln("STATUS-TOPIC: Status topic=", topic, "ready.")
 				}
 			} else {
 				panic(topic)
 			}
 		}
+		publish_exceptions(this.Publish)
 
 		events := this.zk.Events()
 		for {
 			evt := <-events
 			glog.Infoln("ZKEvent:", evt.JSON())
 
-			// send as pubsub
-			// TODO - Redpill compatible:
-			/*
-				type Event struct {
-					Status      string `json:"status"`
-					Title       string `json:"title,omitempty"`
-					Description string `json:"description,omitempty"`
-					Note        string `json:"note,omitempty"`
-					User        string `json:"user,omitempty"`
-					Type        string `json:"type,omitempty"`
-					Url         string `json:"url,omitempty"`
-					Timestamp   int64  `json:"timestamp,omitempty"`
-					ObjectId    string `json:"object_id"`
-					ObjectType  string `json:"object_type"`
-				}
-			*/
 			m := evt.AsMap()
-			m["object_id"] = path.Join(this.Domain, this.Name, this.Host)
-			m["object_type"] = "agent"
-			m["timestamp"] = time.Now().Unix()
-			m["description"] = fmt.Sprint(m["type"], ":", m["state"], "@", "server=", m["server"])
-			m["title"] = "zookeeper event from agent " + path.Join(this.Domain, this.Name, this.Host)
-			m["user"] = "dash"
+			event := Event{
+				Type:        EventZk,
+				Status:      StatusWarning,
+				Title:       "zookeeper event from agent " + path.Join(this.Domain, this.Name, this.Host),
+				Description: fmt.Sprint(m["type"], ":", m["state"], "@", "server=", m["server"]),
+				Data:        m,
+			}
 			switch m["state"] {
 			case "state-disconnected", "state-auth-failed", "state-expired":
-				m["status"] = "fatal"
+				event.Status = StatusFatal
+				metric_zk_connected.Set(0)
 			case "state-connected", "state-has-session":
-				m["status"] = "ok"
+				event.Status = StatusOk
+				metric_zk_connected.Set(1)
 			}
-			status(m)
+			if state, ok := m["state"].(string); ok && evt.Action == "" {
+				metric_zk_events.Inc(state)
+			}
+			if note, ok := m["note"].(string); ok {
+				event.Note = note
+			}
+			this.Publish(event)
 		}
 	}()
 
@@ -401,6 +558,64 @@ func (this *Agent) Register() error {
 	}
 }
 
+func (this *Agent) getDomain(domain string) (*Domain, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	d, has := this.domains[domain]
+	if !has {
+		return nil, ErrNoDomain
+	}
+	return d, nil
+}
+
+// Domains managed by this agent
+func (this *Agent) GetDomains() []DomainSummary {
+	this.lock.Lock()
+	list := []*Domain{}
+	for _, d := range this.domains {
+		list = append(list, d)
+	}
+	this.lock.Unlock()
+
+	summaries := []DomainSummary{}
+	for _, d := range list {
+		summaries = append(summaries, DomainSummary{
+			Domain:   d.Domain,
+			Identity: d.Identity,
+			Services: d.Services(),
+			Drift:    d.Drift(),
+		})
+	}
+	return summaries
+}
+
+// Services of a domain, with counts of tracked containers by state
+func (this *Agent) GetServices(domain string) ([]ServiceSummary, error) {
+	d, err := this.getDomain(domain)
+	if err != nil {
+		return nil, err
+	}
+	summaries := []ServiceSummary{}
+	for _, service := range d.Services() {
+		summaries = append(summaries, d.GetServiceSummary(service))
+	}
+	return summaries, nil
+}
+
+// Tracked containers of a service, with their current states and state histories
+func (this *Agent) GetContainers(domain, service string) ([]ContainerSummary, error) {
+	d, err := this.getDomain(domain)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range d.Services() {
+		if s == ServiceKey(service) {
+			return d.tracker.Containers(s), nil
+		}
+	}
+	return nil, ErrUnknownService
+}
+
 // Containers in this domain
 func (this *Agent) ListContainers(domain, service string) ([]*docker.Container, error) {
 	d, has := this.domains[domain]
@@ -432,17 +647,7 @@ func (this *Agent) ConfigureDomain(config *DomainConfig) (*Domain, error) {
 	domain, has := this.domains[config.Domain]
 	if !has {
 
-		domain = &Domain{
-			Domain:                 config.Domain,
-			RegistryContainerEntry: config.RegistryContainerEntry,
-			zk:                 this.zk,
-			docker:             this.docker,
-			container_watchers: make(map[string]chan<- bool, 0),
-			triggers:           NewZkWatcher(this.zk),
-			agent:              this,
-			tracker:            NewContainerTracker(config.Domain),
-			schedulers:         make(map[ServiceKey]*Scheduler),
-		}
+		domain = NewDomain(config, this.zk, this.docker, this)
 
 		_, err := domain.StartScheduleExecutor()
 		if err != nil {
@@ -460,7 +665,6 @@ func (this *Agent) ConfigureDomain(config *DomainConfig) (*Domain, error) {
 
 		this.domains[config.Domain] = domain
 		this.domainConfigs[config.Domain] = *config
-		domain.Config = config
 	}
 	return this.domains[config.Domain], nil
 }
@@ -475,34 +679,36 @@ func (this *Agent) onMatchContainer(c *docker.Container, match_rule *ContainerMa
 		glog.V(100).Infoln("Service=", match_rule.Service, "Id=", c.Id[0:12],
 			"FinishedAt=", c.DockerData.State.FinishedAt)
 
-		// Match the name but we need to take into account if it's running or not.
-		switch {
-
-		case c.DockerData.State.Restarting:
-			d.tracker.Starting(match_rule.Service, c)
-
-		case c.DockerData.State.Running, c.DockerData.State.Restarting:
-			d.tracker.Running(match_rule.Service, c)
-			glog.Infoln("Registering container Id=", c.Id, "Image=", c.Image, "Rule=", match_rule)
-			if entry, err := BuildRegistryEntry(c, match_rule.GetMatchContainerPort()); entry != nil {
-				entry.Domain = match_rule.Domain
-				entry.Service = string(match_rule.Service)
-				entry.Host = this.Host
-
-				err = entry.Register(this.zk)
-
-				if err != nil {
-					glog.Warningln("Error during registration:", err)
-				}
-				k, v, _ := entry.KeyValue()
-				glog.Infoln("Registered", k, v)
-			} else {
-				glog.Warning("Error building registry", err, "for", *c)
-			}
+		if !track_discovered(d.tracker, match_rule.Service, c) {
+			return
+		}
+		// Registered once ready, and probed for liveness, like the containers started since
+		glog.Infoln("Probing discovered container Id=", c.Id, "Image=", c.Image, "Rule=", match_rule)
+		d.ProbeContainer(match_rule.Service, &match_rule.MatchContainerRule, c)
+	}
+}
 
-		case c.DockerData.State.FinishedAt.Before(time.Now()):
-			glog.V(100).Infoln("Container", "Id=", c.Id[0:12], "Name=", c.Name, "stopped.")
-			d.tracker.Stopped(match_rule.Service, c)
+// Tracks the state of a discovered container.  Returns true if the container is running and should be registered.
+func track_discovered(tracker *ContainerTracker, service ServiceKey, c *docker.Container) bool {
+	// Match the name but we need to take into account if it's running or not.
+	switch {
+
+	case c.DockerData.State.Restarting:
+		tracker.Starting(service, c)
+
+	case c.DockerData.State.Running:
+		tracker.Running(service, c)
+		return true
+
+	case c.DockerData.State.FinishedAt.Before(time.Now()):
+		glog.V(100).Infoln("Container", "Id=", c.Id[0:12], "Name=", c.Name, "stopped.")
+		// A container restored as running that exited with an error died while the agent was down
+		if state, has := tracker.State(service, c); has && (state == Starting || state == Running) &&
+			c.DockerData.State.ExitCode != 0 {
+			tracker.Died(service, c)
+			break
 		}
+		tracker.Stopped(service, c)
 	}
+	return false
 }
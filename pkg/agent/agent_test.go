@@ -5,6 +5,7 @@ import (
 	"github.com/qorio/maestro/pkg/docker"
 	. "gopkg.in/check.v1"
 	"testing"
+	"time"
 )
 
 func TestAgent(t *testing.T) { TestingT(t) }
@@ -93,3 +94,27 @@ func (suite *TestSuiteAgent) TestParseTaskStartContainers(c *C) {
 	c.Assert(ra.Actions[0].HostConfig.PublishAllPorts, Equals, true)
 	c.Assert(ra.Actions[0].HostConfig.PortBindings["3000/tcp"][0].HostPort, Equals, "41566")
 }
+
+func (suite *TestSuiteAgent) TestClearStateWhilePublishing(c *C) {
+	agent := &Agent{}
+	domain := NewDomain(&DomainConfig{}, &test_zk{}, nil, agent)
+	agent.domains = map[string]*Domain{"test.com": domain}
+
+	// A goroutine of the domain that publishes as the domain stops
+	domain.running.Add(1)
+	go func() {
+		defer domain.running.Done()
+		<-domain.stopping
+		agent.Publish(Event{Type: EventZk, Status: StatusOk})
+	}()
+
+	cleared := make(chan error)
+	go func() { cleared <- agent.clear_state() }()
+	select {
+	case err := <-cleared:
+		c.Assert(err, Equals, nil)
+	case <-time.After(5 * time.Second):
+		c.Fatal("deadlocked")
+	}
+	c.Assert(len(agent.domains), Equals, 0)
+}
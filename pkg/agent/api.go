@@ -8,6 +8,13 @@ import (
 const (
 	GetInfo api.ServiceMethod = iota
 	HealthCheck
+	ListDomains
+	ListServices
+	ListContainers
+	PlanConfig
+	PlanDomains
+	GetMetrics
+	StreamEvents
 )
 
 var Methods = api.ServiceMethods{
@@ -31,12 +38,97 @@ Health check
 		ContentTypes: []string{"application/json"},
 		ResponseBody: Types.Health,
 	},
+
+	ListDomains: api.MethodSpec{
+		Doc: `
+Lists the domains managed by the agent and their services.
+`,
+		UrlRoute:     "/v1/domains",
+		HttpMethod:   "GET",
+		ContentTypes: []string{"application/json"},
+		ResponseBody: Types.DomainList,
+	},
+
+	ListServices: api.MethodSpec{
+		Doc: `
+Lists the services of a domain, with counts of tracked containers by state.
+`,
+		UrlRoute:     "/v1/domains/{domain}/services",
+		HttpMethod:   "GET",
+		ContentTypes: []string{"application/json"},
+		ResponseBody: Types.ServiceList,
+	},
+
+	ListContainers: api.MethodSpec{
+		Doc: `
+Lists the tracked containers of a service, with the current state, image, version group
+and state transition history of each container.
+`,
+		UrlRoute:     "/v1/domains/{domain}/services/{service}/containers",
+		HttpMethod:   "GET",
+		ContentTypes: []string{"application/json"},
+		ResponseBody: Types.ContainerList,
+	},
+
+	PlanConfig: api.MethodSpec{
+		Doc: `
+Plans the config at the agent's config url against the current containers and registry, without
+starting, stopping or registering anything.  Returns per service the containers that would be
+registered, started, stopped and vacuumed.
+`,
+		UrlRoute:     "/v1/plan",
+		HttpMethod:   "GET",
+		ContentTypes: []string{"application/json"},
+		ResponseBody: Types.Plan,
+	},
+
+	PlanDomains: api.MethodSpec{
+		Doc: `
+Plans the posted domain configs, like GET /v1/plan.
+`,
+		UrlRoute:     "/v1/plan",
+		HttpMethod:   "POST",
+		ContentTypes: []string{"application/json"},
+		RequestBody:  Types.DomainConfigs,
+		ResponseBody: Types.Plan,
+	},
+
+	GetMetrics: api.MethodSpec{
+		Doc: `
+Metrics in the Prometheus text format: containers by state, synchronizations, image pulls, the zk
+session, vacuums, registration failures and drift.
+`,
+		UrlRoute:     "/metrics",
+		HttpMethod:   "GET",
+		ContentTypes: []string{"text/plain"},
+	},
+
+	StreamEvents: api.MethodSpec{
+		Doc: `
+Streams the events of the agent as server-sent events, one JSON event per message, until the client
+disconnects.  The query parameters type and status, comma separated, and domain and service filter
+the events.
+`,
+		UrlRoute:     "/v1/events",
+		HttpMethod:   "GET",
+		ContentTypes: []string{"application/json"},
+	},
 }
 
 var Types = struct {
-	Info   func(*http.Request) interface{}
-	Health func(*http.Request) interface{}
+	Info          func(*http.Request) interface{}
+	Health        func(*http.Request) interface{}
+	DomainList    func(*http.Request) interface{}
+	ServiceList   func(*http.Request) interface{}
+	ContainerList func(*http.Request) interface{}
+	DomainConfigs func(*http.Request) interface{}
+	Plan          func(*http.Request) interface{}
 }{
-	Info:   func(*http.Request) interface{} { return &Info{} },
-	Health: func(*http.Request) interface{} { return &Health{} },
+	Info:          func(*http.Request) interface{} { return &Info{} },
+	Health:        func(*http.Request) interface{} { return &Health{} },
+	DomainList:    func(*http.Request) interface{} { return &[]DomainSummary{} },
+	ServiceList:   func(*http.Request) interface{} { return &[]ServiceSummary{} },
+	ContainerList: func(*http.Request) interface{} { return &[]ContainerSummary{} },
+	DomainConfigs: func(*http.Request) interface{} { return &[]DomainConfig{} },
+	Plan:          func(*http.Request) interface{} { return &[]DomainPlan{} },
 }
@@ -36,11 +36,14 @@ func (this *Constraint) check() (int, int, int, int, error) {
 		return 0, 0, 0, 0, ErrBadSchedulerConfig
 	case localMax > globalMax:
 		return 0, 0, 0, 0, ErrBadSchedulerConfig
+	case globalMin > globalMax:
+		return 0, 0, 0, 0, ErrBadSchedulerConfig
 	}
 
 	return globalMax, globalMin, localMax, localMin, nil
 }
 
+// Returns the number of containers to start on this host, or if negative, the number to stop.
 func (this *Constraint) Schedule(localRunning, globalRunning int) (int, error) {
 	count, err := this.schedule(localRunning, globalRunning)
 	glog.Infoln("Current: Global=", globalRunning, "Local=", localRunning, "Scheduled=", count, "Err=", err)
@@ -54,17 +57,33 @@ func (this *Constraint) schedule(localRunning, globalRunning int) (int, error) {
 		return 0, err
 	}
 
-	if globalRunning >= globalMax {
+	switch {
+	case localRunning > localMax:
+		// stop the surplus
+		return localMax - localRunning, nil
+
+	case globalRunning >= globalMax:
 		return 0, nil
-	}
 
-	if globalRunning < globalMax {
-		// we should start... check local limit
-		if localRunning < localMax {
-			// ok to start...  start one
-			return 1, nil
-		}
+	case localRunning < localMin:
+		// start as many as needed for the local min, within the global max
+		return min(localMin-localRunning, globalMax-globalRunning), nil
+
+	case globalRunning < globalMin:
+		// help reach the global min, within the local max
+		return min(globalMin-globalRunning, localMax-localRunning), nil
+
+	case localRunning < localMax:
+		// ok to start...  start one
+		return 1, nil
 	}
 
 	return 0, nil
 }
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
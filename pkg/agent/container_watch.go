@@ -0,0 +1,144 @@
+package agent
+
+import (
+	_docker "github.com/fsouza/go-dockerclient"
+	"github.com/golang/glog"
+	. "github.com/infradash/dash/pkg/dash"
+	"github.com/qorio/maestro/pkg/docker"
+	"strings"
+)
+
+// Container watch -- follows the docker event stream for the containers of a service.  The watch of the docker
+// client library never removes its listener, and the client blocks delivering to a listener nobody reads, which
+// stops the events of all the other listeners.  A watch here has a client of its own and removes its listener
+// when stopped, so the client disconnects from the event stream and a new watch connects again.
+
+type container_watch struct {
+	client *_docker.Client
+	events chan *_docker.APIEvents
+	stop   chan bool
+	done   chan bool // closed when the watch has stopped
+}
+
+var docker_actions = map[string]docker.Action{
+	"create":  docker.Create,
+	"start":   docker.Start,
+	"stop":    docker.Stop,
+	"destroy": docker.Remove,
+	"die":     docker.Die,
+}
+
+func new_docker_client(settings DockerSettings) (*_docker.Client, error) {
+	if settings.Cert != "" {
+		return _docker.NewTLSClient(settings.DockerPort, settings.Cert, settings.Key, settings.Ca)
+	}
+	return _docker.NewClient(settings.DockerPort)
+}
+
+// Calls notify with the containers of the events that are accepted until stopped
+func watch_containers(settings DockerSettings, accept func(docker.Action, *docker.Container) bool,
+	notify func(docker.Action, *docker.Container)) (*container_watch, error) {
+
+	client, err := new_docker_client(settings)
+	if err != nil {
+		return nil, err
+	}
+	watch := &container_watch{
+		client: client,
+		events: make(chan *_docker.APIEvents),
+		stop:   make(chan bool),
+		done:   make(chan bool),
+	}
+	if err := client.AddEventListener(watch.events); err != nil {
+		return nil, err
+	}
+	go watch.run(accept, notify)
+	return watch, nil
+}
+
+func (this *container_watch) run(accept func(docker.Action, *docker.Container) bool,
+	notify func(docker.Action, *docker.Container)) {
+
+	defer close(this.done)
+	for {
+		select {
+		case event, open := <-this.events:
+			if !open {
+				glog.Warningln("Docker event stream closed.")
+				<-this.stop
+				return
+			}
+			action, has := docker_actions[event.Status]
+			if !has {
+				continue
+			}
+			container, err := this.container(action, event)
+			if err != nil {
+				glog.Warningln("Error inspecting container", event.ID, "Err=", err)
+				continue
+			}
+			if accept(action, container) {
+				notify(action, container)
+			}
+
+		case <-this.stop:
+			this.remove_listener()
+			glog.Infoln("Watch terminated.")
+			return
+		}
+	}
+}
+
+// Removes the listener while still reading events, since the client holds its lock while delivering one
+func (this *container_watch) remove_listener() {
+	removed := make(chan bool)
+	go func() {
+		this.client.RemoveEventListener(this.events)
+		close(removed)
+	}()
+	for {
+		select {
+		case _, open := <-this.events:
+			if !open {
+				<-removed
+				return
+			}
+		case <-removed:
+			return
+		}
+	}
+}
+
+func (this *container_watch) container(action docker.Action, event *_docker.APIEvents) (*docker.Container, error) {
+	c := &docker.Container{Id: event.ID, Image: event.From}
+	if action == docker.Remove {
+		return c, nil
+	}
+	cc, err := this.client.InspectContainer(event.ID)
+	if err != nil {
+		return nil, err
+	}
+	c.Name = strings.TrimPrefix(cc.Name, "/")
+	c.ImageId = cc.Image
+	c.Command = cc.Path + " " + strings.Join(cc.Args, " ")
+	if cc.NetworkSettings != nil {
+		c.Ip = cc.NetworkSettings.IPAddress
+		c.Network = *cc.NetworkSettings
+		for _, p := range cc.NetworkSettings.PortMappingAPI() {
+			c.Ports = append(c.Ports, docker.Port{
+				ContainerPort: p.PrivatePort,
+				HostPort:      p.PublicPort,
+				Type:          p.Type,
+				AcceptIP:      p.IP,
+			})
+		}
+	}
+	c.DockerData = cc
+	return c, nil
+}
+
+// Stops the watch and removes its listener.  Blocks until the watch has stopped.
+func (this *container_watch) Stop() {
+	close(this.stop)
+	<-this.done
+}
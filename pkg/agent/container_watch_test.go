@@ -0,0 +1,172 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	_docker "github.com/fsouza/go-dockerclient"
+	. "github.com/infradash/dash/pkg/dash"
+	"github.com/qorio/maestro/pkg/docker"
+	. "gopkg.in/check.v1"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestContainerWatch(t *testing.T) { TestingT(t) }
+
+type TestSuiteContainerWatch struct {
+}
+
+var _ = Suite(&TestSuiteContainerWatch{})
+
+// A docker daemon that streams the events sent to it to every client of /events
+type test_docker_events struct {
+	events  chan _docker.APIEvents
+	clients chan chan _docker.APIEvents
+	done    chan bool
+}
+
+func new_test_docker_events() *test_docker_events {
+	this := &test_docker_events{
+		events:  make(chan _docker.APIEvents),
+		clients: make(chan chan _docker.APIEvents),
+		done:    make(chan bool),
+	}
+	go func() {
+		clients := []chan _docker.APIEvents{}
+		for {
+			select {
+			case client := <-this.clients:
+				clients = append(clients, client)
+			case event := <-this.events:
+				for _, client := range clients {
+					client <- event
+				}
+			case <-this.done:
+				return
+			}
+		}
+	}()
+	return this
+}
+
+func (this *test_docker_events) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	switch {
+	case strings.HasSuffix(req.URL.Path, "/events"):
+		events := make(chan _docker.APIEvents, 10)
+		this.clients <- events
+		resp.WriteHeader(http.StatusOK)
+		resp.(http.Flusher).Flush()
+		for {
+			select {
+			case event := <-events:
+				json.NewEncoder(resp).Encode(event)
+				resp.(http.Flusher).Flush()
+			case <-this.done:
+				return
+			}
+		}
+	case strings.HasSuffix(req.URL.Path, "/json"):
+		id := strings.Split(req.URL.Path, "/")[len(strings.Split(req.URL.Path, "/"))-2]
+		fmt.Fprintf(resp, `{"Id":"%s","Name":"/%s","Image":"sha256:aaaa"}`, id, id)
+	default:
+		http.NotFound(resp, req)
+	}
+}
+
+func (suite *TestSuiteContainerWatch) TestContainerWatchStop(c *C) {
+	daemon := new_test_docker_events()
+	server := httptest.NewServer(daemon)
+	defer server.Close()
+	defer close(daemon.done)
+
+	watch := func() (*container_watch, chan string) {
+		seen := make(chan string, 10)
+		w, err := watch_containers(DockerSettings{DockerPort: server.URL},
+			func(docker.Action, *docker.Container) bool { return true },
+			func(action docker.Action, container *docker.Container) {
+				seen <- fmt.Sprint(action, ":", container.Name)
+			})
+		c.Assert(err, Equals, nil)
+		return w, seen
+	}
+	next := func(seen chan string) string {
+		select {
+		case s := <-seen:
+			return s
+		case <-time.After(5 * time.Second):
+			return "timeout"
+		}
+	}
+
+	a, seen_a := watch()
+	b, seen_b := watch()
+	time.Sleep(100 * time.Millisecond) // connected
+
+	daemon.events <- _docker.APIEvents{Status: "start", ID: "web1", From: "infradash/web:1", Time: 1}
+	c.Assert(next(seen_a), Equals, fmt.Sprint(docker.Start, ":web1"))
+	c.Assert(next(seen_b), Equals, fmt.Sprint(docker.Start, ":web1"))
+
+	// Events keep flowing to the other watch once one is stopped, and not to the stopped one
+	a.Stop()
+	for i := 2; i < 5; i++ {
+		daemon.events <- _docker.APIEvents{Status: "die", ID: fmt.Sprint("web", i), From: "infradash/web:1",
+			Time: int64(i)}
+		c.Assert(next(seen_b), Equals, fmt.Sprint(docker.Die, ":web", i))
+	}
+	c.Assert(len(seen_a), Equals, 0)
+	_, running := <-a.done
+	c.Assert(running, Equals, false)
+	b.Stop()
+
+	// Stopping a domain stops and waits for its watches
+	agent := &Agent{}
+	agent.DockerPort = server.URL
+	domain := NewDomain(&DomainConfig{
+		RegistryContainerEntry: RegistryContainerEntry{
+			RegistryReleaseEntry: RegistryReleaseEntry{
+				RegistryEntryBase: RegistryEntryBase{Domain: "test.com"},
+			},
+		},
+	}, &test_zk{}, nil, agent)
+	c.Assert(domain.WatchContainer("infradash", &MatchContainerRule{}), Equals, nil)
+	watching := domain.container_watchers["infradash"]
+	domain.Stop()
+	_, running = <-watching.done
+	c.Assert(running, Equals, false)
+	c.Assert(len(domain.container_watchers), Equals, 0)
+}
+
+func (suite *TestSuiteContainerWatch) TestRestartContainerWatches(c *C) {
+	daemon := new_test_docker_events()
+	server := httptest.NewServer(daemon)
+	defer server.Close()
+	defer close(daemon.done)
+
+	tags := QualifyByTags{Tags: []string{"web"}}
+	agent := &Agent{QualifyByTags: tags}
+	agent.DockerPort = server.URL
+	config := &DomainConfig{Services: map[ServiceKey]*Scheduler{"infradash": &Scheduler{QualifyByTags: tags}}}
+	config.Domain = "test.com"
+	domain := NewDomain(config, &test_zk{}, nil, agent)
+	domain.schedulers["infradash"] = config.Services["infradash"]
+	defer domain.Stop()
+
+	// The old watch stops and removes its listener
+	c.Assert(domain.WatchContainer("infradash", &MatchContainerRule{}), Equals, nil)
+	old := domain.container_watchers["infradash"]
+	c.Assert(domain.restart_container_watches(), Equals, nil)
+	_, running := <-old.done
+	c.Assert(running, Equals, false)
+	c.Assert(domain.container_watchers["infradash"], Not(Equals), old)
+
+	// A watch that fails to restart is restarted the next time
+	agent.Cert = "/no/such/cert.pem"
+	c.Assert(domain.restart_container_watches(), Not(Equals), nil)
+	c.Assert(len(domain.container_watchers), Equals, 0)
+	agent.Cert = ""
+	c.Assert(domain.restart_container_watches(), Equals, nil)
+	c.Assert(len(domain.container_watchers), Equals, 1)
+}
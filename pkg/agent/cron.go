@@ -0,0 +1,330 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	. "github.com/infradash/dash/pkg/dash"
+	"github.com/qorio/maestro/pkg/zk"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Cron -- containers started on a schedule given as a standard cron expression, e.g. report generators.  Each
+// run is recorded in the registry under /{domain}/{service}/cron with the same outcome as a run once job.  With
+// single host, the agents race to create the node of the run and only the one that succeeds starts the container.
+
+type ConcurrencyPolicy string
+
+const (
+	ConcurrencyAllow   ConcurrencyPolicy = "allow"
+	ConcurrencyForbid  ConcurrencyPolicy = "forbid"
+	ConcurrencyReplace ConcurrencyPolicy = "replace"
+
+	JobSkipped JobState = "skipped"
+
+	default_cron_history = 10
+)
+
+type CronSchedule struct {
+	// Minute, hour, day of month, month and day of week, or one of @yearly, @monthly, @weekly, @daily, @hourly
+	Spec string `json:"spec"`
+
+	// What to do when the previous run is still running on this host.  With single host, forbid also skips
+	// the run while the previous run is running on another host; each agent replaces the runs on its host.
+	// Defaults to allow.
+	ConcurrencyPolicy ConcurrencyPolicy `json:"concurrency_policy,omitempty"`
+
+	// Run on only one host of the domain
+	SingleHost bool `json:"single_host,omitempty"`
+
+	// Runs kept in the registry
+	HistoryLimit int `json:"history_limit,omitempty"`
+}
+
+func (this *CronSchedule) IsValid() bool {
+	if _, err := parse_cron(this.Spec); err != nil {
+		return false
+	}
+	switch this.ConcurrencyPolicy {
+	case "", ConcurrencyAllow, ConcurrencyForbid, ConcurrencyReplace:
+	default:
+		return false
+	}
+	return this.HistoryLimit >= 0
+}
+
+func (this *CronSchedule) history_limit() int {
+	if this.HistoryLimit == 0 {
+		return default_cron_history
+	}
+	return this.HistoryLimit
+}
+
+// Parsed cron expression.  Each field is a bit set of the values allowed.
+type cron_expression struct {
+	minute, hour, dom, month, dow uint64
+
+	// When both days of month and of week are restricted, either matches
+	domStar, dowStar bool
+}
+
+type cron_field struct {
+	min, max int
+	names    map[string]int
+}
+
+var (
+	cron_macros = map[string]string{
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+		"@monthly":  "0 0 1 * *",
+		"@weekly":   "0 0 * * 0",
+		"@daily":    "0 0 * * *",
+		"@midnight": "0 0 * * *",
+		"@hourly":   "0 * * * *",
+	}
+	cron_minute = cron_field{0, 59, nil}
+	cron_hour   = cron_field{0, 23, nil}
+	cron_dom    = cron_field{1, 31, nil}
+	cron_month  = cron_field{1, 12, map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	cron_dow = cron_field{0, 7, map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+func parse_cron(spec string) (*cron_expression, error) {
+	if macro, has := cron_macros[strings.TrimSpace(spec)]; has {
+		spec = macro
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, ErrBadCronSpec
+	}
+	expr := &cron_expression{domStar: fields[2] == "*", dowStar: fields[4] == "*"}
+	for i, f := range []struct {
+		bits  *uint64
+		field cron_field
+	}{
+		{&expr.minute, cron_minute},
+		{&expr.hour, cron_hour},
+		{&expr.dom, cron_dom},
+		{&expr.month, cron_month},
+		{&expr.dow, cron_dow},
+	} {
+		bits, err := f.field.parse(fields[i])
+		if err != nil {
+			return nil, err
+		}
+		*f.bits = bits
+	}
+	// Sunday is either 0 or 7
+	if expr.dow&(1<<7) != 0 {
+		expr.dow |= 1
+	}
+	return expr, nil
+}
+
+// Parses a list of values, ranges and steps, e.g. 1,5-10,*/15
+func (this cron_field) parse(s string) (uint64, error) {
+	bits := uint64(0)
+	for _, part := range strings.Split(s, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return 0, ErrBadCronSpec
+			}
+			step, part = n, part[:i]
+		}
+		low, high := this.min, this.max
+		switch {
+		case part == "*":
+		case strings.Contains(part, "-"):
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if low, err = this.value(bounds[0]); err != nil {
+				return 0, err
+			}
+			if high, err = this.value(bounds[1]); err != nil {
+				return 0, err
+			}
+		default:
+			v, err := this.value(part)
+			if err != nil {
+				return 0, err
+			}
+			low, high = v, v
+			if step > 1 {
+				high = this.max
+			}
+		}
+		if low > high {
+			return 0, ErrBadCronSpec
+		}
+		for v := low; v <= high; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+func (this cron_field) value(s string) (int, error) {
+	if v, has := this.names[strings.ToLower(s)]; has {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < this.min || v > this.max {
+		return 0, ErrBadCronSpec
+	}
+	return v, nil
+}
+
+func (this *cron_expression) day_matches(t time.Time) bool {
+	dom := this.dom&(1<<uint(t.Day())) != 0
+	dow := this.dow&(1<<uint(t.Weekday())) != 0
+	if this.domStar || this.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Returns the first time after t that matches the expression, or zero time if there is none within 5 years.
+func (this *cron_expression) Next(t time.Time) time.Time {
+	// Truncate works on absolute time, which is off by the offset of zones like +05:30; steps are in local time
+	t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, t.Location())
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case this.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !this.day_matches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case this.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case this.minute&(1<<uint(t.Minute())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, 0, t.Location())
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func cron_run_name(scheduled time.Time, host string, singleHost bool) string {
+	name := scheduled.UTC().Format("20060102T150405Z")
+	if !singleHost {
+		name += "_" + host
+	}
+	return name
+}
+
+// Starts a run of the service scheduled at the given time, according to the concurrency policy.
+func (this *Scheduler) run_cron(domain string, service ServiceKey, scheduled time.Time,
+	local HostContainerStates, global GlobalServiceState, control SchedulerExecutor) error {
+
+	path, _, err := RegistryKeyValue(KCron, map[string]interface{}{
+		"Domain":  domain,
+		"Service": service,
+		"Run":     cron_run_name(scheduled, this.Task.host, this.Cron.SingleHost),
+	})
+	if err != nil {
+		return err
+	}
+
+	active := []*Fsm{}
+	if local != nil {
+		local.VisitVersions(func(s ServiceKey, cg *ContainerGroup) {
+			if s != service {
+				return
+			}
+			for _, instance := range cg.Instances() {
+				switch instance.Current().State {
+				case Running, Starting:
+					active = append(active, instance)
+				}
+			}
+		})
+	}
+
+	actions := []Task{}
+	if len(active) > 0 || this.previous_cron_running() {
+		switch this.Cron.ConcurrencyPolicy {
+		case ConcurrencyForbid:
+			glog.Infoln("Domain=", domain, "Service=", service, "Skipping run at", scheduled, "Active=", len(active))
+			skipped := &JobOutcome{Trigger: scheduled.Format(time.RFC3339), Host: this.Task.host,
+				State: JobSkipped, Started: time.Now()}
+			if value, err := json.Marshal(skipped); err == nil && this.Task.zk != nil {
+				this.Task.zk.Create(path, value)
+			}
+			return this.prune_cron_history(domain, service)
+		case ConcurrencyReplace:
+			for _, instance := range active {
+				actions = append(actions, this.RemoveOne(domain, service, instance.CustomData.(string)))
+			}
+		}
+	}
+
+	this.cron_last = path
+	task := this.StartOne(domain, service, global, local)
+	task.run, task.runPath = scheduled.Format(time.RFC3339), path
+	actions = append(actions, task)
+	glog.Infoln("Domain=", domain, "Service=", service, "Cron run at", scheduled, "Path=", path)
+	this.decided(domain, service, actions)
+	if control != nil {
+		control <- actions
+	}
+	return this.prune_cron_history(domain, service)
+}
+
+// Returns true if the last run not skipped of a single host job is still running, on any host.  An agent
+// that restarted knows only the runs on its host until it runs the job again.
+func (this *Scheduler) previous_cron_running() bool {
+	if !this.Cron.SingleHost || this.cron_last == "" || this.Task.zk == nil {
+		return false
+	}
+	n, err := this.Task.zk.Get(this.cron_last)
+	if err != nil {
+		return false
+	}
+	outcome := JobOutcome{}
+	if err := json.Unmarshal(n.Value, &outcome); err != nil {
+		return false
+	}
+	return outcome.State == JobRunning
+}
+
+// Removes the oldest runs beyond the history limit
+func (this *Scheduler) prune_cron_history(domain string, service ServiceKey) error {
+	if this.Task.zk == nil {
+		return nil
+	}
+	parent, err := this.Task.zk.Get(fmt.Sprintf("/%s/%s/cron", domain, service))
+	switch {
+	case err == zk.ErrNotExist:
+		return nil
+	case err != nil:
+		return err
+	}
+	runs, err := parent.Children()
+	if err != nil {
+		return err
+	}
+	names := []string{}
+	for _, run := range runs {
+		names = append(names, run.GetPath())
+	}
+	sort.Strings(names) // by scheduled time
+	for i := 0; i < len(names)-this.Cron.history_limit(); i++ {
+		if err := this.Task.zk.Delete(names[i]); err != nil && err != zk.ErrNotExist {
+			glog.Warningln("Cannot remove cron run", names[i], "Err=", err)
+		}
+		release_run(this.Task.zk, names[i])
+	}
+	return nil
+}
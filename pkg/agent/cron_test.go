@@ -0,0 +1,86 @@
+package agent
+
+import (
+	"encoding/json"
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+func (suite *TestSuiteScheduler) TestCron(c *C) {
+	at := func(s string) time.Time {
+		t, err := time.Parse("2006-01-02 15:04", s)
+		c.Assert(err, Equals, nil)
+		return t
+	}
+	next := func(spec, from string) time.Time {
+		expr, err := parse_cron(spec)
+		c.Assert(err, Equals, nil)
+		return expr.Next(at(from))
+	}
+
+	c.Assert(next("*/15 * * * *", "2015-06-01 10:07"), Equals, at("2015-06-01 10:15"))
+	c.Assert(next("*/15 * * * *", "2015-06-01 10:45"), Equals, at("2015-06-01 11:00"))
+	c.Assert(next("30 2 * * *", "2015-06-01 10:07"), Equals, at("2015-06-02 02:30"))
+	c.Assert(next("@hourly", "2015-06-01 10:07"), Equals, at("2015-06-01 11:00"))
+	c.Assert(next("@monthly", "2015-12-31 10:07"), Equals, at("2016-01-01 00:00"))
+	c.Assert(next("0 9 * * mon-fri", "2015-06-05 10:00"), Equals, at("2015-06-08 09:00")) // friday to monday
+	c.Assert(next("0 0 * * 7", "2015-06-01 10:00"), Equals, at("2015-06-07 00:00"))       // sunday as 7
+	c.Assert(next("0 0 29 feb *", "2015-03-01 00:00"), Equals, at("2016-02-29 00:00"))
+	c.Assert(next("0 0 1,15 * *", "2015-06-02 00:00"), Equals, at("2015-06-15 00:00"))
+	// Either the day of month or the day of week when both are given
+	c.Assert(next("0 0 13 * fri", "2015-06-01 00:00"), Equals, at("2015-06-05 00:00"))
+	c.Assert(next("0 0 31 2 *", "2015-06-01 00:00").IsZero(), Equals, true)
+
+	// Hours start on the hour of zones with offsets in half hours, like Asia/Kolkata
+	kolkata := time.FixedZone("IST", 5*3600+30*60)
+	in := func(s string) time.Time {
+		t, err := time.ParseInLocation("2006-01-02 15:04", s, kolkata)
+		c.Assert(err, Equals, nil)
+		return t
+	}
+	expr, err := parse_cron("0 9 * * *")
+	c.Assert(err, Equals, nil)
+	c.Assert(expr.Next(in("2015-06-01 07:45")).Equal(in("2015-06-01 09:00")), Equals, true)
+	expr, err = parse_cron("@hourly")
+	c.Assert(err, Equals, nil)
+	c.Assert(expr.Next(in("2015-06-01 10:07")).Equal(in("2015-06-01 11:00")), Equals, true)
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * * * 8", "*/0 * * * *", "5-1 * * * *", "@never"} {
+		_, err := parse_cron(spec)
+		c.Assert(err, Equals, ErrBadCronSpec, Commentf("spec=%s", spec))
+	}
+
+	c.Assert((&Scheduler{Cron: &CronSchedule{Spec: "@daily"}}).IsValid(), Equals, true)
+	c.Assert((&Scheduler{Cron: &CronSchedule{Spec: "@daily", ConcurrencyPolicy: "queue"}}).IsValid(), Equals, false)
+	c.Assert((&Scheduler{Cron: &CronSchedule{Spec: "@daily"}, Constraint: &Constraint{}}).IsValid(), Equals, false)
+
+	scheduled := at("2015-06-01 10:15")
+	c.Assert(cron_run_name(scheduled, "host1", true), Equals, "20150601T101500Z")
+	c.Assert(cron_run_name(scheduled, "host1", false), Equals, "20150601T101500Z_host1")
+
+	// With single host, a run is skipped while the previous one runs on another host
+	zkc := &test_runs_zk{nodes: map[string][]byte{}}
+	host := func(name string) (*Scheduler, chan []Task) {
+		return &Scheduler{Cron: &CronSchedule{Spec: "*/15 * * * *", SingleHost: true,
+			ConcurrencyPolicy: ConcurrencyForbid}, Task: Task{host: name, zk: zkc}}, make(chan []Task, 1)
+	}
+	host1, control1 := host("host1")
+	host2, control2 := host("host2")
+	c.Assert(host1.run_cron("test.com", "report", scheduled, nil, nil, control1), Equals, nil)
+	c.Assert(host2.run_cron("test.com", "report", scheduled, nil, nil, control2), Equals, nil)
+	run := (<-control1)[0]
+	<-control2
+	_, err = run.claim_run(zkc)
+	c.Assert(err, Equals, nil)
+
+	c.Assert(host2.run_cron("test.com", "report", at("2015-06-01 10:30"), nil, nil, control2), Equals, nil)
+	c.Assert(len(control2), Equals, 0)
+	skipped := JobOutcome{}
+	c.Assert(json.Unmarshal(zkc.nodes["/test.com/report/cron/20150601T103000Z"], &skipped), Equals, nil)
+	c.Assert(skipped.State, Equals, JobSkipped)
+
+	// and runs once the previous one is done
+	delete(zkc.nodes, run.runPath)
+	c.Assert(host2.run_cron("test.com", "report", at("2015-06-01 10:45"), nil, nil, control2), Equals, nil)
+	c.Assert(len(control2), Equals, 1)
+}
@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"github.com/golang/glog"
+	. "github.com/infradash/dash/pkg/dash"
+	"github.com/qorio/maestro/pkg/docker"
+	"time"
+)
+
+// Deadlines -- a container whose readiness never passes stays starting, and counts as running for the scheduler
+// for good; a container that doesn't stop stays stopping.  When a state of a service has a deadline, a container
+// still in the state at its deadline is marked failed, which the scheduler reacts to, and is killed.
+
+type StateDeadlines struct {
+	StartingSeconds uint32 `json:"starting_seconds,omitempty"`
+	StoppingSeconds uint32 `json:"stopping_seconds,omitempty"`
+}
+
+func (this *StateDeadlines) starting() time.Duration {
+	if this.StartingSeconds == 0 {
+		return 2 * time.Minute
+	}
+	return time.Duration(this.StartingSeconds) * time.Second
+}
+
+func (this *StateDeadlines) stopping() time.Duration {
+	if this.StoppingSeconds == 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(this.StoppingSeconds) * time.Second
+}
+
+func (this *StateDeadlines) states() map[ContainerState]time.Duration {
+	return map[ContainerState]time.Duration{
+		Starting: this.starting(),
+		Stopping: this.stopping(),
+	}
+}
+
+// Sets the deadlines of the states of the service's containers.  Nil clears them.
+func (this *ContainerTracker) SetDeadlines(service ServiceKey, deadlines map[ContainerState]time.Duration) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if deadlines == nil {
+		delete(this.deadlines, service)
+		return
+	}
+	this.deadlines[service] = deadlines
+}
+
+// Called after a container stuck in a state past its deadline is marked failed
+func (this *ContainerTracker) OnExpired(expired func(ServiceKey, *docker.Container, ContainerState)) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.expired = expired
+}
+
+func (this *ContainerTracker) watch_deadline(service ServiceKey, c *docker.Container, fsm *Fsm, state *FsmState,
+	deadline time.Duration) {
+
+	if err := state.SetDeadline(deadline); err != nil {
+		return
+	}
+	go func() {
+		select {
+		case expired := <-fsm.Expiration:
+			// Maybe of a later state, if its deadline is shorter
+			this.expire(service, c, expired)
+		case <-time.After(deadline + time.Second):
+		}
+	}()
+}
+
+func (this *ContainerTracker) expire(service ServiceKey, c *docker.Container, expired *FsmState) {
+	state := expired.State.(ContainerState)
+	failed := this.process(&container_event{
+		service:   service,
+		state:     Failed,
+		container: c,
+		err:       ErrStateDeadlineExceeded,
+		from:      expired,
+	})
+	if !failed {
+		return
+	}
+	glog.Warningln("Service=", service, "Id=", c.Id, "Stuck in", state, "since", expired.Started)
+
+	this.lock.Lock()
+	callback := this.expired
+	this.lock.Unlock()
+	if callback != nil {
+		callback(service, c, state)
+	}
+}
+
+// Kills a container stuck in a state.  The tracker has marked it failed already.
+func (this *Domain) on_state_expired(service ServiceKey, c *docker.Container, state ContainerState) {
+	ExceptionEvent(ErrStateDeadlineExceeded, c.Id, "Container stuck: Service=", service, "Id=", c.Id, "State=", state)
+	metric_deadlines.Inc(this.Domain, string(service), state_label(state.String()))
+	this.StopProbe(c)
+	if this.docker == nil {
+		return
+	}
+	this.running.Add(1)
+	go func() {
+		defer this.running.Done()
+		err := this.docker.StopContainer(nil, c.Id, 0)
+		glog.Infoln("Killed stuck container: Service=", service, "Id=", c.Id, "Err=", err)
+	}()
+}
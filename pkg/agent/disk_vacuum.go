@@ -0,0 +1,537 @@
+package agent
+
+import (
+	"github.com/golang/glog"
+	. "github.com/infradash/dash/pkg/dash"
+	"github.com/qorio/maestro/pkg/zk"
+	"net/url"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Disk vacuum -- host wide garbage collection when the docker data root runs low on space.  Unlike the vacuum
+// of a service, it collects what no scheduler tracks: exited containers, dangling images and images that no
+// container uses, least recently used first.  Images of the current release of any service are never removed.
+
+type DiskVacuumConfig struct {
+	// Collection starts when the used space of the docker data root reaches the high watermark, in percent,
+	// and stops once it is down to the low watermark.  A zero high watermark disables the vacuum.
+	HighWatermark int `json:"high_watermark,omitempty"`
+	LowWatermark  int `json:"low_watermark,omitempty"`
+
+	CheckIntervalSeconds int `json:"check_interval_seconds,omitempty"`
+
+	// Exited containers younger than this are kept for inspection
+	MinExitedAgeSeconds int `json:"min_exited_age_seconds,omitempty"`
+}
+
+func (this *DiskVacuumConfig) check_interval() time.Duration {
+	if this.CheckIntervalSeconds <= 0 {
+		return time.Minute
+	}
+	return time.Duration(this.CheckIntervalSeconds) * time.Second
+}
+
+func (this *DiskVacuumConfig) min_exited_age() time.Duration {
+	return time.Duration(this.MinExitedAgeSeconds) * time.Second
+}
+
+type DiskVacuum struct {
+	Config DiskVacuumConfig
+	Stop   chan<- bool
+	Done   <-chan bool // closed when the vacuum has stopped
+
+	stop   chan bool
+	done   chan bool
+	engine *docker_engine
+
+	// Images of current releases, by reference, and the ids of containers tracked by schedulers
+	pinned  func() (map[string]bool, error)
+	tracked func() map[string]bool
+
+	// Last time each image was seen in use by a container, by image id
+	last_used map[string]time.Time
+
+	publish func(Event)
+}
+
+type engine_image struct {
+	Id          string
+	RepoTags    []string
+	RepoDigests []string
+	Created     int64
+}
+
+type engine_container struct {
+	Id      string
+	Image   string // id of the image
+	Running bool
+	Started time.Time
+	Exited  time.Time
+}
+
+// The images and containers to remove, in order
+type disk_vacuum_plan struct {
+	containers []string
+	dangling   []string
+	images     []engine_image
+}
+
+func (this *DiskVacuumConfig) IsValid() bool {
+	return this.HighWatermark >= 0 && this.HighWatermark <= 100 &&
+		this.LowWatermark >= 0 && this.LowWatermark <= this.HighWatermark
+}
+
+func NewDiskVacuum(config DiskVacuumConfig, engine *docker_engine,
+	pinned func() (map[string]bool, error), tracked func() map[string]bool) *DiskVacuum {
+
+	stop, done := make(chan bool, 1), make(chan bool)
+	return &DiskVacuum{
+		Config:    config,
+		Stop:      stop,
+		Done:      done,
+		stop:      stop,
+		done:      done,
+		engine:    engine,
+		pinned:    pinned,
+		tracked:   tracked,
+		last_used: make(map[string]time.Time),
+	}
+}
+
+func (this *DiskVacuum) Run() {
+	go func() {
+		defer close(this.done)
+
+		ticker := time.NewTicker(this.Config.check_interval())
+		defer ticker.Stop()
+		for {
+			select {
+			case stop := <-this.stop:
+				if stop {
+					glog.Infoln("Stopping disk vacuum")
+					return
+				}
+			case <-ticker.C:
+				if err := this.do_vacuum(); err != nil {
+					ExceptionEvent(err, this.Config, "Disk vacuum failed")
+				}
+			}
+		}
+	}()
+}
+
+func (this *DiskVacuum) do_vacuum() error {
+	used, err := this.engine.DiskUsage()
+	if err != nil {
+		return err
+	}
+	containers, err := this.engine.AllContainers()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	this.observe(containers, now)
+
+	if used < float64(this.Config.HighWatermark) {
+		return nil
+	}
+	glog.Warningln("Disk pressure: Used=", used, "HighWatermark=", this.Config.HighWatermark)
+
+	images, err := this.engine.Images()
+	if err != nil {
+		return err
+	}
+	pinned, err := this.pinned()
+	if err != nil {
+		glog.Warningln("Cannot determine the images of releases. Keeping all tagged images. Err=", err)
+		pinned = nil
+	}
+
+	plan := plan_disk_vacuum(containers, images, this.tracked(), pinned, this.last_used,
+		this.Config.min_exited_age(), now)
+
+	for _, id := range plan.containers {
+		err := this.engine.RemoveContainer(id)
+		glog.Infoln("Disk vacuum: Removed exited container", id, "Err=", err)
+		this.removed("container", id, err)
+		if err == nil {
+			metric_disk_vacuum_removed.Inc("container")
+		}
+	}
+	for _, id := range plan.dangling {
+		err := this.engine.RemoveImage(id)
+		glog.Infoln("Disk vacuum: Removed dangling image", id, "Err=", err)
+		this.removed("image", id, err)
+		if err == nil {
+			metric_disk_vacuum_removed.Inc("image")
+		}
+	}
+	for _, image := range plan.images {
+		if used, err := this.engine.DiskUsage(); err == nil && used <= float64(this.Config.LowWatermark) {
+			break
+		}
+		for _, tag := range image.RepoTags {
+			err := this.engine.RemoveImage(tag)
+			glog.Infoln("Disk vacuum: Removed image", tag, "LastUsed=", this.last_used[image.Id], "Err=", err)
+			this.removed("image", tag, err)
+			if err == nil {
+				metric_disk_vacuum_removed.Inc("image")
+			}
+		}
+		delete(this.last_used, image.Id)
+	}
+	return nil
+}
+
+// Records the images in use by the containers
+func (this *DiskVacuum) observe(containers []engine_container, now time.Time) {
+	for _, c := range containers {
+		used := c.Exited
+		if c.Running {
+			used = now
+		}
+		if used.After(this.last_used[c.Image]) {
+			this.last_used[c.Image] = used
+		}
+	}
+}
+
+// Plans the removal of exited containers not tracked by any scheduler, dangling images and images that
+// no remaining container uses.  With nil pinned images, no tagged image is planned for removal.
+func plan_disk_vacuum(containers []engine_container, images []engine_image, tracked, pinned map[string]bool,
+	last_used map[string]time.Time, minExitedAge time.Duration, now time.Time) disk_vacuum_plan {
+
+	plan := disk_vacuum_plan{containers: []string{}, dangling: []string{}, images: []engine_image{}}
+
+	referenced := map[string]bool{}
+	for _, c := range containers {
+		exited := !c.Running && !c.Exited.IsZero()
+		if exited && !tracked[c.Id] && now.Sub(c.Exited) >= minExitedAge {
+			plan.containers = append(plan.containers, c.Id)
+			continue
+		}
+		referenced[c.Image] = true
+	}
+
+	for _, image := range images {
+		if referenced[image.Id] {
+			continue
+		}
+		tags := image_tags(image)
+		if len(tags) == 0 {
+			plan.dangling = append(plan.dangling, image.Id)
+			continue
+		}
+		if pinned == nil {
+			continue
+		}
+		keep := false
+		for _, tag := range tags {
+			keep = keep || pinned[image_reference(tag)]
+		}
+		if !keep {
+			plan.images = append(plan.images, engine_image{Id: image.Id, RepoTags: tags, Created: image.Created})
+		}
+	}
+
+	sort.Sort(least_recently_used{plan.images, last_used})
+	return plan
+}
+
+type least_recently_used struct {
+	images    []engine_image
+	last_used map[string]time.Time
+}
+
+func (s least_recently_used) used(i int) time.Time {
+	if t, has := s.last_used[s.images[i].Id]; has {
+		return t
+	}
+	return time.Unix(s.images[i].Created, 0)
+}
+
+func (s least_recently_used) Len() int           { return len(s.images) }
+func (s least_recently_used) Less(i, j int) bool { return s.used(i).Before(s.used(j)) }
+func (s least_recently_used) Swap(i, j int)      { s.images[i], s.images[j] = s.images[j], s.images[i] }
+
+func image_tags(image engine_image) []string {
+	tags := []string{}
+	for _, tag := range image.RepoTags {
+		if tag != "" && tag != "<none>:<none>" {
+			tags = append(tags, tag)
+		}
+	}
+	// Images pulled by digest may have no tag
+	for _, digest := range image.RepoDigests {
+		if digest != "" && digest != "<none>@<none>" {
+			tags = append(tags, digest)
+		}
+	}
+	return tags
+}
+
+// Returns the image with its digest, or its tag defaulting to latest
+func image_reference(image string) string {
+	ref, err := ParseImageReference(image)
+	switch {
+	case err != nil:
+		return image
+	case ref.Digest != "":
+		return ref.Name() + "@" + ref.Digest
+	case ref.Tag == "":
+		return ref.Name() + ":latest"
+	}
+	return ref.String()
+}
+
+// Returns the percentage of space used by docker: from the storage driver if it reports its space, like
+// devicemapper, otherwise from the filesystem of the docker data root, when the daemon is on this host.
+func (this *docker_engine) DiskUsage() (float64, error) {
+	info := struct {
+		DockerRootDir string
+		DriverStatus  [][2]string
+	}{}
+	if err := this.call("GET", "/info", nil, &info); err != nil {
+		return 0, err
+	}
+	if used, has := driver_disk_usage(info.DriverStatus); has {
+		return used, nil
+	}
+	if !this.local {
+		return 0, ErrDockerRootNotLocal
+	}
+	if info.DockerRootDir == "" {
+		return 0, ErrNoDockerRootDir
+	}
+	stat := syscall.Statfs_t{}
+	if err := syscall.Statfs(info.DockerRootDir, &stat); err != nil {
+		return 0, err
+	}
+	if stat.Blocks == 0 {
+		return 0, nil
+	}
+	return 100 * float64(stat.Blocks-stat.Bavail) / float64(stat.Blocks), nil
+}
+
+// Returns the percentage of the data space used, if the storage driver reports it
+func driver_disk_usage(status [][2]string) (float64, bool) {
+	var used, total uint64
+	for _, kv := range status {
+		switch kv[0] {
+		case "Data Space Used":
+			used, _ = parse_size(kv[1])
+		case "Data Space Total":
+			total, _ = parse_size(kv[1])
+		}
+	}
+	if total == 0 {
+		return 0, false
+	}
+	return 100 * float64(used) / float64(total), true
+}
+
+// Returns all the images of the host, including the dangling ones
+func (this *docker_engine) Images() ([]engine_image, error) {
+	images := []engine_image{}
+	if err := this.call("GET", "/images/json", nil, &images); err != nil {
+		return nil, err
+	}
+	dangling := []engine_image{}
+	filter := "/images/json?filters=" + url.QueryEscape(`{"dangling":["true"]}`)
+	if err := this.call("GET", filter, nil, &dangling); err != nil {
+		return nil, err
+	}
+	listed := map[string]bool{}
+	for _, image := range images {
+		listed[image.Id] = true
+	}
+	for _, image := range dangling {
+		if !listed[image.Id] {
+			images = append(images, image)
+		}
+	}
+	return images, nil
+}
+
+// Returns all the containers of the host, running or not
+func (this *docker_engine) AllContainers() ([]engine_container, error) {
+	list := []struct{ Id string }{}
+	if err := this.call("GET", "/containers/json?all=1", nil, &list); err != nil {
+		return nil, err
+	}
+	containers := []engine_container{}
+	for _, c := range list {
+		inspect := struct {
+			Image string
+			State struct {
+				Running    bool
+				StartedAt  time.Time
+				FinishedAt time.Time
+			}
+		}{}
+		if err := this.call("GET", "/containers/"+c.Id+"/json", nil, &inspect); err != nil {
+			continue // may have just been removed
+		}
+		containers = append(containers, engine_container{
+			Id:      c.Id,
+			Image:   inspect.Image,
+			Running: inspect.State.Running,
+			Started: inspect.State.StartedAt,
+			Exited:  inspect.State.FinishedAt,
+		})
+	}
+	return containers, nil
+}
+
+func (this *docker_engine) RemoveContainer(id string) error {
+	return this.call("DELETE", "/containers/"+id+"?v=1", nil, nil)
+}
+
+// Removes the image by id or untags it by reference.  Images in use are not removed.
+func (this *docker_engine) RemoveImage(image string) error {
+	return this.call("DELETE", "/images/"+image, nil, nil)
+}
+
+// Returns the images of the current releases of all services in the domain, including the ones not
+// scheduled on this host.
+func (this *Domain) ReleaseImages() (map[string]bool, error) {
+	images := map[string]bool{}
+
+	this.lock.Lock()
+	schedulers := []*Scheduler{}
+	for _, scheduler := range this.schedulers {
+		schedulers = append(schedulers, scheduler)
+	}
+	registries := this.Config.Registries
+	this.lock.Unlock()
+
+	for _, scheduler := range schedulers {
+		_, _, image, err := scheduler.Task.Image()
+		switch {
+		case err == zk.ErrNotExist:
+			continue // not released yet
+		case err != nil:
+			return nil, err
+		}
+		images[pulled_image_name(registries, image)] = true
+	}
+
+	root, err := this.zk.Get("/" + this.Domain)
+	switch {
+	case err == zk.ErrNotExist:
+		return images, nil
+	case err != nil:
+		return nil, err
+	}
+	services, err := root.Children()
+	if err != nil {
+		return nil, err
+	}
+	for _, service := range services {
+		release := service.GetValueString()
+		if !strings.HasPrefix(release, service.GetPath()+"/") {
+			continue // not a release watch node
+		}
+		n, err := this.zk.Get(release)
+		switch {
+		case err == zk.ErrNotExist:
+			continue
+		case err != nil:
+			return nil, err
+		}
+		if image := n.GetValueString(); image != "" {
+			images[pulled_image_name(registries, image)] = true
+		}
+	}
+	return images, nil
+}
+
+// Returns the name the image is tagged with when pulled, in the default registry of the domain unless it names one
+func pulled_image_name(registries *ImageRegistries, image string) string {
+	ref, err := registries.resolve(image)
+	if err != nil {
+		return image
+	}
+	return image_name(image_to_pull(ref))
+}
+
+// Returns the ids of the containers tracked by the schedulers of the domain
+func (this *Domain) TrackedContainers() map[string]bool {
+	tracked := map[string]bool{}
+	for _, service := range this.tracker.Services() {
+		for _, c := range this.tracker.Containers(service) {
+			tracked[c.Id] = true
+		}
+	}
+	return tracked
+}
+
+// Starts the disk vacuum of the host, if enabled
+func (this *Agent) StartDiskVacuum() error {
+	if this.DiskVacuum.HighWatermark == 0 {
+		return nil
+	}
+	if !this.DiskVacuum.IsValid() {
+		return ErrBadVacuumConfig
+	}
+	engine, err := new_docker_engine(this.DockerSettings)
+	if err != nil {
+		return err
+	}
+	// Other errors may pass, but usage can't be known of a remote daemon without the driver's status
+	if _, err := engine.DiskUsage(); err == ErrDockerRootNotLocal {
+		glog.Warningln("Not starting disk vacuum: docker data root not on this host. Docker=", this.DockerPort)
+		return nil
+	}
+	this.diskVacuum = NewDiskVacuum(this.DiskVacuum, engine, this.release_images, this.tracked_containers)
+	this.diskVacuum.publish = this.Publish
+	this.diskVacuum.Run()
+	glog.Infoln("Started disk vacuum:", this.DiskVacuum)
+	return nil
+}
+
+func (this *Agent) StopDiskVacuum() {
+	if this.diskVacuum == nil {
+		return
+	}
+	this.diskVacuum.Stop <- true
+	<-this.diskVacuum.Done
+	this.diskVacuum = nil
+}
+
+func (this *Agent) release_images() (map[string]bool, error) {
+	this.lock.Lock()
+	domains := []*Domain{}
+	for _, domain := range this.domains {
+		domains = append(domains, domain)
+	}
+	this.lock.Unlock()
+
+	images := map[string]bool{}
+	for _, domain := range domains {
+		pinned, err := domain.ReleaseImages()
+		if err != nil {
+			return nil, err
+		}
+		for image := range pinned {
+			images[image] = true
+		}
+	}
+	return images, nil
+}
+
+func (this *Agent) tracked_containers() map[string]bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	tracked := map[string]bool{}
+	for _, domain := range this.domains {
+		for id := range domain.TrackedContainers() {
+			tracked[id] = true
+		}
+	}
+	return tracked
+}
@@ -0,0 +1,136 @@
+package agent
+
+import (
+	"encoding/json"
+	. "github.com/infradash/dash/pkg/dash"
+	. "gopkg.in/check.v1"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDiskVacuum(t *testing.T) { TestingT(t) }
+
+type TestSuiteDiskVacuum struct {
+}
+
+var _ = Suite(&TestSuiteDiskVacuum{})
+
+func (suite *TestSuiteDiskVacuum) TestDiskVacuumPlan(c *C) {
+	now := time.Now()
+	containers := []engine_container{
+		{Id: "running", Image: "sha256:web", Running: true},
+		{Id: "tracked", Image: "sha256:api", Exited: now.Add(-2 * time.Hour)},
+		{Id: "exited", Image: "sha256:batch", Exited: now.Add(-2 * time.Hour)},
+		{Id: "just-exited", Image: "sha256:cron", Exited: now.Add(-time.Minute)},
+		{Id: "created", Image: "sha256:tool"},
+	}
+	images := []engine_image{
+		{Id: "sha256:web", RepoTags: []string{"infradash/web:1"}},
+		{Id: "sha256:api", RepoTags: []string{"infradash/api:1"}},
+		{Id: "sha256:batch", RepoTags: []string{"infradash/batch:1"}, Created: now.Add(-time.Hour).Unix()},
+		{Id: "sha256:cron", RepoTags: []string{"infradash/cron:1"}},
+		{Id: "sha256:tool", RepoTags: []string{"infradash/tool:1"}},
+		{Id: "sha256:old", RepoTags: []string{"infradash/old:1"}, Created: now.Add(-48 * time.Hour).Unix()},
+		{Id: "sha256:live", RepoTags: []string{"infradash/live"}},
+		{Id: "sha256:dangling", RepoTags: []string{"<none>:<none>"}},
+	}
+	tracked := map[string]bool{"tracked": true}
+	pinned := map[string]bool{"infradash/live:latest": true}
+	last_used := map[string]time.Time{"sha256:batch": now.Add(-72 * time.Hour)}
+
+	plan := plan_disk_vacuum(containers, images, tracked, pinned, last_used, time.Hour, now)
+	c.Assert(plan.containers, DeepEquals, []string{"exited"})
+	c.Assert(plan.dangling, DeepEquals, []string{"sha256:dangling"})
+	c.Assert(len(plan.images), Equals, 2)
+	c.Assert(plan.images[0].Id, Equals, "sha256:batch") // last used before old was created
+	c.Assert(plan.images[1].Id, Equals, "sha256:old")
+
+	// Without knowing the releases, no tagged image is removed
+	plan = plan_disk_vacuum(containers, images, tracked, nil, last_used, time.Hour, now)
+	c.Assert(plan.containers, DeepEquals, []string{"exited"})
+	c.Assert(plan.dangling, DeepEquals, []string{"sha256:dangling"})
+	c.Assert(len(plan.images), Equals, 0)
+
+	// Releases name images as pulled: in the default registry, with the latest tag or digest
+	registries := &ImageRegistries{Default: "registry.example.com:5000"}
+	c.Assert(pulled_image_name(registries, "infradash/live"), Equals, "registry.example.com:5000/infradash/live:latest")
+	c.Assert(pulled_image_name(registries, "quay.io/infradash/live:2"), Equals, "quay.io/infradash/live:2")
+	c.Assert(pulled_image_name(nil, "infradash/live@sha256:abc"), Equals, "infradash/live@sha256:abc")
+	images = []engine_image{{Id: "sha256:live", RepoTags: []string{"registry.example.com:5000/infradash/live:latest"}}}
+	pinned = map[string]bool{pulled_image_name(registries, "infradash/live"): true}
+	plan = plan_disk_vacuum(nil, images, tracked, pinned, last_used, time.Hour, now)
+	c.Assert(len(plan.images), Equals, 0)
+}
+
+func (suite *TestSuiteDiskVacuum) TestDiskVacuumEngine(c *C) {
+	var lock sync.Mutex
+	removed := []string{}
+	status := [][2]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch {
+		case req.Method == "DELETE":
+			removed = append(removed, req.URL.Path)
+		case req.URL.Path == "/info":
+			json.NewEncoder(resp).Encode(map[string]interface{}{"DockerRootDir": c.MkDir(), "DriverStatus": status})
+		case req.URL.Path == "/images/json" && req.URL.Query().Get("filters") != "":
+			json.NewEncoder(resp).Encode([]map[string]interface{}{
+				{"Id": "sha256:a", "RepoTags": []string{"infradash/a:1"}},
+				{"Id": "sha256:b", "RepoTags": []string{"<none>:<none>"}},
+			})
+		case req.URL.Path == "/images/json":
+			json.NewEncoder(resp).Encode([]map[string]interface{}{{"Id": "sha256:a", "RepoTags": []string{"infradash/a:1"}}})
+		case req.URL.Path == "/containers/json":
+			c.Assert(req.URL.Query().Get("all"), Equals, "1")
+			json.NewEncoder(resp).Encode([]map[string]interface{}{{"Id": "120aaaaaaaaaaaaa"}})
+		case req.URL.Path == "/containers/120aaaaaaaaaaaaa/json":
+			json.NewEncoder(resp).Encode(map[string]interface{}{
+				"Image": "sha256:a",
+				"State": map[string]interface{}{"Running": false, "FinishedAt": "2015-06-01T10:00:00Z"},
+			})
+		default:
+			resp.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	engine, err := new_docker_engine(DockerSettings{DockerPort: server.URL})
+	c.Assert(err, Equals, nil)
+
+	// The data root of a remote daemon can't be measured here
+	_, err = engine.DiskUsage()
+	c.Assert(err, Equals, ErrDockerRootNotLocal)
+	engine.local = true
+	used, err := engine.DiskUsage()
+	c.Assert(err, Equals, nil)
+	c.Assert(used >= 0 && used <= 100, Equals, true)
+
+	engine.local = false
+	lock.Lock()
+	status = [][2]string{{"Data Space Used", "1.5 GB"}, {"Data Space Total", "6 GB"}}
+	lock.Unlock()
+	used, err = engine.DiskUsage()
+	c.Assert(err, Equals, nil)
+	c.Assert(used, Equals, float64(25))
+
+	images, err := engine.Images()
+	c.Assert(err, Equals, nil)
+	c.Assert(len(images), Equals, 2)
+
+	containers, err := engine.AllContainers()
+	c.Assert(err, Equals, nil)
+	c.Assert(len(containers), Equals, 1)
+	c.Assert(containers[0].Image, Equals, "sha256:a")
+	c.Assert(containers[0].Running, Equals, false)
+	c.Assert(containers[0].Exited.IsZero(), Equals, false)
+
+	c.Assert(engine.RemoveContainer("120aaaaaaaaaaaaa"), Equals, nil)
+	c.Assert(engine.RemoveImage("infradash/a:1"), Equals, nil)
+	lock.Lock()
+	defer lock.Unlock()
+	c.Assert(removed, DeepEquals, []string{"/containers/120aaaaaaaaaaaaa", "/images/infradash/a:1"})
+}
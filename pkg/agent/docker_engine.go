@@ -0,0 +1,185 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	_docker "github.com/fsouza/go-dockerclient"
+	. "github.com/infradash/dash/pkg/dash"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Minimal client of the Docker remote api for the calls not covered by the docker client library,
+// namely the health status of containers.  A daemon that doesn't answer fails the calls after a timeout.
+type docker_engine struct {
+	client *http.Client
+	base   string
+	local  bool // the daemon is on this host
+
+	// For exec
+	docker *_docker.Client
+}
+
+const (
+	docker_api_dial_timeout     = 10 * time.Second
+	docker_api_response_timeout = 30 * time.Second
+)
+
+func new_docker_engine(settings DockerSettings) (*docker_engine, error) {
+	engine, err := new_docker_api(settings)
+	if err != nil {
+		return nil, err
+	}
+	engine.docker, err = new_docker_client(settings)
+	if err != nil {
+		return nil, err
+	}
+	engine.docker.Dialer = &net.Dialer{Timeout: docker_api_dial_timeout}
+	engine.docker.HTTPClient.Timeout = docker_api_response_timeout
+	return engine, nil
+}
+
+// The transport times out waiting for the daemon to answer, not reading the answer, which may be a stream
+func new_docker_api(settings DockerSettings) (*docker_engine, error) {
+	transport := &http.Transport{
+		Dial:                  (&net.Dialer{Timeout: docker_api_dial_timeout}).Dial,
+		ResponseHeaderTimeout: docker_api_response_timeout,
+	}
+	endpoint := settings.DockerPort
+	switch {
+	case strings.HasPrefix(endpoint, "unix://"):
+		path := strings.Split(endpoint, "unix://")[1]
+		transport.Dial = func(network, addr string) (net.Conn, error) {
+			return net.DialTimeout("unix", path, docker_api_dial_timeout)
+		}
+		return &docker_engine{client: &http.Client{Transport: transport}, base: "http://docker", local: true}, nil
+
+	case strings.HasPrefix(endpoint, "tcp://") && settings.Cert != "":
+		tlsCert, err := tls.LoadX509KeyPair(settings.Cert, settings.Key)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig := &tls.Config{Certificates: []tls.Certificate{tlsCert}}
+		if settings.Ca == "" {
+			tlsConfig.InsecureSkipVerify = true
+		} else {
+			cert, err := ioutil.ReadFile(settings.Ca)
+			if err != nil {
+				return nil, err
+			}
+			caPool := x509.NewCertPool()
+			if !caPool.AppendCertsFromPEM(cert) {
+				return nil, ErrBadDockerTlsCert
+			}
+			tlsConfig.RootCAs = caPool
+		}
+		transport.TLSClientConfig = tlsConfig
+		return &docker_engine{
+			client: &http.Client{Transport: transport},
+			base:   "https://" + strings.Split(endpoint, "tcp://")[1],
+		}, nil
+
+	case strings.HasPrefix(endpoint, "tcp://"):
+		return &docker_engine{
+			client: &http.Client{Transport: transport},
+			base:   "http://" + strings.Split(endpoint, "tcp://")[1],
+		}, nil
+
+	case strings.HasPrefix(endpoint, "http"):
+		return &docker_engine{client: &http.Client{Transport: transport}, base: strings.TrimRight(endpoint, "/")}, nil
+	}
+	return nil, ErrNoDockerEngine
+}
+
+func (this *docker_engine) call(method, path string, body, result interface{}) error {
+	var buff bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buff).Encode(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, this.base+path, &buff)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := this.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("docker-api-status-%d", resp.StatusCode)
+	}
+	if result != nil {
+		return json.NewDecoder(resp.Body).Decode(result)
+	}
+	return nil
+}
+
+// Returns the status of the container's HEALTHCHECK, or empty if it has none
+func (this *docker_engine) Health(id string) (string, error) {
+	inspect := struct {
+		State struct {
+			Health *struct {
+				Status string
+			}
+		}
+	}{}
+	if err := this.call("GET", "/containers/"+id+"/json", nil, &inspect); err != nil {
+		return "", err
+	}
+	if inspect.State.Health == nil {
+		return "", nil
+	}
+	return inspect.State.Health.Status, nil
+}
+
+// Runs the command in the container and returns its exit code.  Gives up after the timeout.
+func (this *docker_engine) Exec(id string, command []string, timeout time.Duration) (int, error) {
+	type exec_result struct {
+		code int
+		err  error
+	}
+	result := make(chan exec_result, 1)
+	go func() {
+		code, err := this.exec(id, command, timeout)
+		result <- exec_result{code, err}
+	}()
+	select {
+	case r := <-result:
+		return r.code, r.err
+	case <-time.After(timeout):
+		return -1, ErrProbeTimeout
+	}
+}
+
+func (this *docker_engine) exec(id string, command []string, timeout time.Duration) (int, error) {
+	exec, err := this.docker.CreateExec(_docker.CreateExecOptions{Container: id, Cmd: command})
+	if err != nil {
+		return -1, err
+	}
+	if err := this.docker.StartExec(exec.ID, _docker.StartExecOptions{Detach: true}); err != nil {
+		return -1, err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		inspect, err := this.docker.InspectExec(exec.ID)
+		if err != nil {
+			return -1, err
+		}
+		if !inspect.Running {
+			return inspect.ExitCode, nil
+		}
+		if time.Now().After(deadline) {
+			return -1, ErrProbeTimeout
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
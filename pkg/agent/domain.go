@@ -8,6 +8,7 @@ import (
 	"github.com/qorio/maestro/pkg/docker"
 	"github.com/qorio/maestro/pkg/registry"
 	"github.com/qorio/maestro/pkg/zk"
+	"sort"
 	"sync"
 	"time"
 )
@@ -27,13 +28,81 @@ type Domain struct {
 	triggers *ZkWatcher
 
 	lock               sync.Mutex
-	container_watchers map[string]chan<- bool
+	container_watchers map[ServiceKey]*container_watch
 
 	agent   *Agent
 	tracker *ContainerTracker
 
+	// For probes: raw access to the docker api and the probing of each container by id
+	engine  *docker_engine
+	probes  map[string]chan bool
+	unready map[string]bool // waiting for readiness, by container id
+
 	schedulers       map[ServiceKey]*Scheduler
+	scheduler_stops  map[ServiceKey]chan<- bool
+	scheduler_dones  map[ServiceKey]<-chan bool
 	scheduleExecutor *ScheduleExecutor
+
+	vacuums map[ServiceKey]*Vacuum
+
+	// Pulls of images by schedulers, shared with the pre-pulls of releases
+	puller *image_puller
+
+	// Release watched for the pre-pulls of each service, when it's not the trigger of the service
+	releases map[ServiceKey]string
+
+	// Where the events of the domain are sent
+	sinks *event_sinks
+
+	// Drift fixed by reconciliations
+	drift Drift
+
+	// Specifications of running services and vacuums as loaded from config
+	specs        map[ServiceKey]string
+	vacuum_specs map[ServiceKey]string
+
+	// Closed when the domain is stopping; background work of the domain is tracked by running.
+	stopping chan bool
+	stopped  bool
+	running  sync.WaitGroup
+}
+
+func NewDomain(config *DomainConfig, zk zk.ZK, docker *docker.Docker, agent *Agent) *Domain {
+	var engine *docker_engine
+	if agent != nil && agent.DockerPort != "" {
+		e, err := new_docker_engine(agent.DockerSettings)
+		if err != nil {
+			glog.Warningln("Cannot access docker api for probes. Docker=", agent.DockerPort, "Err=", err)
+		}
+		engine = e
+	}
+	domain := &Domain{
+		Domain:                 config.Domain,
+		RegistryContainerEntry: config.RegistryContainerEntry,
+		Config:                 config,
+		zk:                     zk,
+		docker:                 docker,
+		container_watchers:     make(map[ServiceKey]*container_watch),
+		triggers:               NewZkWatcher(zk),
+		agent:                  agent,
+		tracker:                NewContainerTracker(config.Domain),
+		schedulers:             make(map[ServiceKey]*Scheduler),
+		scheduler_stops:        make(map[ServiceKey]chan<- bool),
+		scheduler_dones:        make(map[ServiceKey]<-chan bool),
+		vacuums:                make(map[ServiceKey]*Vacuum),
+		specs:                  make(map[ServiceKey]string),
+		vacuum_specs:           make(map[ServiceKey]string),
+		stopping:               make(chan bool),
+		engine:                 engine,
+		probes:                 make(map[string]chan bool),
+		unready:                make(map[string]bool),
+		puller:                 new_image_puller(docker, engine, config.Registries),
+		releases:               make(map[ServiceKey]string),
+	}
+	domain.tracker.OnExpired(domain.on_state_expired)
+	domain.tracker.OnTransition(domain.on_transition)
+	domain.puller.publish = domain.publish
+	return domain
 }
 
 func (this *Domain) Register() error {
@@ -71,60 +140,304 @@ func (this *Domain) do_register() error {
 func (this *Domain) StartServices(tags QualifyByTags) (*Domain, error) {
 	// Schedulers
 	for service, scheduler := range this.Config.Services {
-		if scheduler.QualifyByTags.Matches(tags.Tags) {
+		if !scheduler.QualifyByTags.Matches(tags.Tags) {
+			continue
+		}
+		err := this.StartService(service, scheduler)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Vacuums
+	for service, vacuumConfig := range this.Config.Vacuums {
+		if !vacuumConfig.QualifyByTags.Matches(tags.Tags) {
+			continue
+		}
+		err := this.StartVacuum(service, vacuumConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return this, nil
+}
 
-			applied := new(Scheduler)
-			err := ApplyVarSubs(scheduler, applied, MergeMaps(map[string]interface{}{
-				"Domain":  this.Domain,
-				"Service": service,
-			}, EscapeVars(ConfigVariables[2:]...)))
+func (this *Domain) StartService(service ServiceKey, scheduler *Scheduler) error {
+	// Snapshot the spec before variables are applied, so that config reloads can be diff'd
+	spec := config_spec(scheduler)
 
-			if err != nil {
-				glog.Warningln("Bad spec:", *scheduler)
-				return nil, ErrBadSchedulerSpec
-			}
+	applied := new(Scheduler)
+	err := ApplyVarSubs(scheduler, applied, MergeMaps(map[string]interface{}{
+		"Domain":  this.Domain,
+		"Service": service,
+	}, EscapeVars(ConfigVariables[2:]...)))
 
-			*scheduler = *applied
+	if err != nil {
+		glog.Warningln("Bad spec:", *scheduler)
+		return ErrBadSchedulerSpec
+	}
 
-			if scheduler.RegisterOnly() {
-				scheduler.Register.registerOnly = true
-			}
+	*scheduler = *applied
 
-			if !scheduler.IsValid() {
-				glog.Warningln("Bad scheduler specification:", *scheduler)
-				ExceptionEvent(ErrBadSchedulerSpec, *scheduler, "Bad scheduler spec")
-				return nil, ErrBadSchedulerSpec
-			}
+	if scheduler.RegisterOnly() {
+		scheduler.Register.registerOnly = true
+	}
 
-			glog.Infoln("Scheduler", "Domain=", this.Domain, "Service=", service, "Scheduler=", *scheduler)
-			stop, err := this.AddScheduler(service, scheduler)
-			if err != nil {
-				ExceptionEvent(err, *scheduler, "Error starting scheduler")
-				return nil, err
-			} else {
-				// TODO
-				glog.Infoln("TODO - wire up the stop channel for scheduler:", stop)
-			}
+	if !scheduler.IsValid() {
+		glog.Warningln("Bad scheduler specification:", *scheduler)
+		ExceptionEvent(ErrBadSchedulerSpec, *scheduler, "Bad scheduler spec")
+		return ErrBadSchedulerSpec
+	}
+	if this.engine == nil && scheduler.probes_need_engine() {
+		glog.Warningln("Probes need the docker api:", *scheduler)
+		ExceptionEvent(ErrNoDockerEngine, *scheduler, "Probes need the docker api")
+		return ErrNoDockerEngine
+	}
+
+	glog.Infoln("Scheduler", "Domain=", this.Domain, "Service=", service, "Scheduler=", *scheduler)
+	stop, done, err := this.AddScheduler(service, scheduler)
+	if err != nil {
+		ExceptionEvent(err, *scheduler, "Error starting scheduler")
+		return err
+	}
+
+	this.lock.Lock()
+	this.scheduler_stops[service] = stop
+	this.scheduler_dones[service] = done
+	this.specs[service] = spec
+	this.lock.Unlock()
+	return nil
+}
+
+// Stops the scheduler, trigger watch and container monitor of a service.  Blocks until the scheduler has stopped.
+func (this *Domain) StopService(service ServiceKey) {
+	this.lock.Lock()
+	scheduler, has := this.schedulers[service]
+	stop, done := this.scheduler_stops[service], this.scheduler_dones[service]
+	release, watched := this.releases[service]
+	delete(this.releases, service)
+	delete(this.schedulers, service)
+	delete(this.scheduler_stops, service)
+	delete(this.scheduler_dones, service)
+	delete(this.specs, service)
+	this.lock.Unlock()
+
+	if has {
+		glog.Infoln("Stopping scheduler", "Domain=", this.Domain, "Service=", service)
+		if stop != nil {
+			stop <- true
+		}
+		if scheduler.TriggerPath != nil {
+			this.triggers.StopWatch(string(*scheduler.TriggerPath))
+		}
+		if watched {
+			this.triggers.StopWatch(release)
+		}
+		this.tracker.RemoveStatesListeners(service)
+		this.tracker.SetDeadlines(service, nil)
+		if done != nil {
+			<-done
+		}
+		glog.Infoln("Stopped scheduler", "Domain=", this.Domain, "Service=", service)
+	}
+	this.StopContainerWatch(service)
+}
+
+func (this *Domain) StartVacuum(service ServiceKey, vacuumConfig *VacuumConfig) error {
+	spec := config_spec(vacuumConfig)
+
+	vacuum := NewVacuum(this.Domain, ServiceKey(service), *vacuumConfig, this.tracker, this.docker)
+	vacuum.engine = this.engine
+	vacuum.publish = this.publish
+	if scheduler, has := this.Config.Services[service]; has && scheduler.UpdateStrategy != nil {
+		vacuum.keepRunning = true
+	}
+	err := vacuum.Validate()
+	if err != nil {
+		return err
+	}
+	err = vacuum.Run()
+	if err != nil {
+		return err
+	}
+
+	this.lock.Lock()
+	this.vacuums[service] = vacuum
+	this.vacuum_specs[service] = spec
+	this.lock.Unlock()
+	return nil
+}
+
+func (this *Domain) StopVacuum(service ServiceKey) {
+	this.lock.Lock()
+	vacuum, has := this.vacuums[service]
+	delete(this.vacuums, service)
+	delete(this.vacuum_specs, service)
+	this.lock.Unlock()
+
+	if has {
+		glog.Infoln("Stopping vacuum", "Domain=", this.Domain, "Service=", service)
+		vacuum.Stop <- true
+		<-vacuum.Done
+	}
+}
+
+// Applies a new configuration to a running domain.  Services and vacuums that were removed are stopped,
+// those that were added are started, and those whose specification changed are restarted.
+func (this *Domain) ApplyConfig(config *DomainConfig, tags QualifyByTags) error {
+	this.lock.Lock()
+	registries := config_spec(config.Registries) != config_spec(this.Config.Registries)
+	this.Config = config
+	running, vacuums := map[ServiceKey]string{}, map[ServiceKey]string{}
+	for service, spec := range this.specs {
+		running[service] = spec
+	}
+	for service, spec := range this.vacuum_specs {
+		vacuums[service] = spec
+	}
+	this.lock.Unlock()
+
+	// Services keep running on the new config even if its sinks can't be started
+	if err := this.apply_event_sinks(config); err != nil {
+		glog.Warningln("Config reload: cannot start event sinks", "Domain=", this.Domain, "Err=", err)
+	}
+	// The tasks of the services pull from the registries they were started with
+	if registries {
+		glog.Infoln("Config reload: registries changed", "Domain=", this.Domain)
+		this.puller.set_registries(config.Registries)
+	}
+
+	started := []ServiceKey{}
+	for service := range running {
+		if scheduler, has := config.Services[service]; has && scheduler.QualifyByTags.Matches(tags.Tags) {
+			continue
 		}
+		glog.Infoln("Config reload: removed", "Domain=", this.Domain, "Service=", service)
+		this.StopService(service)
+	}
+	for service, scheduler := range config.Services {
+		if !scheduler.QualifyByTags.Matches(tags.Tags) {
+			continue
+		}
+		spec, has := running[service]
+		switch {
+		case !has:
+			glog.Infoln("Config reload: added", "Domain=", this.Domain, "Service=", service)
+		case spec != config_spec(scheduler) || registries:
+			glog.Infoln("Config reload: changed", "Domain=", this.Domain, "Service=", service)
+			this.StopService(service)
+		default:
+			continue
+		}
+		err := this.StartService(service, scheduler)
+		if err != nil {
+			return err
+		}
+		started = append(started, service)
 	}
 
-	// Vacuums
-	for service, vacuumConfig := range this.Config.Vacuums {
+	for service := range vacuums {
+		if vacuumConfig, has := config.Vacuums[service]; has && vacuumConfig.QualifyByTags.Matches(tags.Tags) {
+			continue
+		}
+		this.StopVacuum(service)
+	}
+	for service, vacuumConfig := range config.Vacuums {
 		if !vacuumConfig.QualifyByTags.Matches(tags.Tags) {
 			continue
 		}
-
-		vacuum := NewVacuum(this.Domain, ServiceKey(service), *vacuumConfig, this.tracker, this.docker)
-		err := vacuum.Validate()
-		if err != nil {
-			return nil, err
+		spec, has := vacuums[service]
+		switch {
+		case !has:
+		case spec != config_spec(vacuumConfig):
+			this.StopVacuum(service)
+		default:
+			continue
 		}
-		err = vacuum.Run()
+		err := this.StartVacuum(service, vacuumConfig)
 		if err != nil {
-			return nil, err
+			return err
 		}
 	}
-	return this, nil
+
+	if len(started) == 0 {
+		return nil
+	}
+
+	// Monitor and discover the containers of the services (re)started.
+	watches, err := this.GetContainerWatcherSpecs()
+	if err != nil {
+		return err
+	}
+	matcher := new(DiscoveryContainerMatcher).Init()
+	for _, service := range started {
+		if watch, has := watches[service]; has {
+			matcher.C(this.Domain, service, watch)
+			this.WatchContainer(service, watch)
+		}
+	}
+	err = this.agent.DiscoverRunningContainers(matcher.Match, this.agent.onMatchContainer)
+	if err != nil {
+		return err
+	}
+	return this.SynchronizeSchedule()
+}
+
+// Stops all services, vacuums, watches and the schedule executor of the domain and removes its registration.
+// Blocks until all the goroutines of the domain have exited.
+func (this *Domain) Stop() {
+	this.lock.Lock()
+	if this.stopped {
+		this.lock.Unlock()
+		return
+	}
+	this.stopped = true
+	if this.stopping != nil {
+		close(this.stopping)
+	}
+	this.lock.Unlock()
+
+	glog.Infoln("Stopping Domain=", this.Domain)
+
+	for _, service := range this.Services() {
+		this.StopService(service)
+	}
+	this.lock.Lock()
+	vacuums := []ServiceKey{}
+	for service := range this.vacuums {
+		vacuums = append(vacuums, service)
+	}
+	watched := []ServiceKey{}
+	for service := range this.container_watchers {
+		watched = append(watched, service)
+	}
+	this.lock.Unlock()
+	for _, service := range vacuums {
+		this.StopVacuum(service)
+	}
+	for _, service := range watched {
+		this.StopContainerWatch(service)
+	}
+
+	if this.scheduleExecutor != nil {
+		this.scheduleExecutor.Stop <- true
+		<-this.scheduleExecutor.Done
+	}
+
+	this.StopEventSinks()
+	this.triggers.StopAll()
+	this.running.Wait()
+
+	if this.Identity != "" && this.zk != nil {
+		err := this.zk.Delete(this.Identity)
+		glog.Infoln("Deregister self, key=", this.Identity, "err=", err)
+	}
+	glog.Infoln("Stopped Domain=", this.Domain)
+}
+
+func config_spec(v interface{}) string {
+	buff, _ := json.Marshal(v)
+	return string(buff)
 }
 
 func (this *Domain) StartScheduleExecutor() (*ScheduleExecutor, error) {
@@ -160,17 +473,44 @@ func (this *Domain) SynchronizeSchedule() error {
 	return nil
 }
 
-func (this *Domain) AddScheduler(service ServiceKey, scheduler *Scheduler) (chan bool, error) {
+// Starts the scheduler of a service.  Returns the channel to stop it and the channel closed when it has stopped.
+func (this *Domain) AddScheduler(service ServiceKey, scheduler *Scheduler) (chan<- bool, <-chan bool, error) {
+	this.lock.Lock()
 	this.schedulers[service] = scheduler
+	this.lock.Unlock()
+
 	channel := this.tracker.AddStatesListener(service)
-	stopper := make(chan bool)
+	stopper, done := make(chan bool, 1), make(chan bool)
 
 	scheduler.Task.zk = this.zk
+	scheduler.Task.domain = this.Domain
+	scheduler.Task.service = service
 	global := &scheduler.Task
+	scheduler.Task.host = this.Host
+	scheduler.local = this.tracker
+	scheduler.Task.admit = this.AdmitContainer
+	scheduler.Task.pull = this.puller.Pull
+	scheduler.Task.registries = this.Config.Registries
+	scheduler.Task.stopping = func(id string) {
+		this.tracker.StoppingById(service, id)
+	}
+	if scheduler.Deadlines != nil {
+		this.tracker.SetDeadlines(service, scheduler.Deadlines.states())
+	}
+	if this.agent != nil {
+		scheduler.status = this.agent.Publish
+		scheduler.Task.attributes = this.agent.Attributes
+	}
+	if scheduler.WaitForJob != "" {
+		job := scheduler.WaitForJob
+		scheduler.job = func() (*JobOutcome, error) {
+			return this.JobOutcome(job)
+		}
+	}
 
-	err := scheduler.Run(this.Domain, service, global, channel, stopper, this.scheduleExecutor.Inbox)
+	err := scheduler.Run(this.Domain, service, global, channel, stopper, done, this.scheduleExecutor.Inbox)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if scheduler.TriggerPath == nil {
@@ -181,12 +521,15 @@ func (this *Domain) AddScheduler(service ServiceKey, scheduler *Scheduler) (chan
 		})
 		if err != nil {
 			glog.Warningln("No trigger path - not watching for releases")
-			return stopper, nil
+			return stopper, done, nil
 		}
 		trigger := Trigger(defaultWatchPath)
 		scheduler.TriggerPath = &trigger
 	}
 
+	this.prepull(service, scheduler)
+	prepull := !this.watch_release(service, scheduler)
+
 	watch := string(*scheduler.TriggerPath)
 	context := &scheduler.Task
 	err = this.triggers.AddWatcher(watch, context, func(e zk.Event) bool {
@@ -197,6 +540,9 @@ func (this *Domain) AddScheduler(service ServiceKey, scheduler *Scheduler) (chan
 			return true
 		}
 
+		if prepull {
+			this.prepull(service, scheduler)
+		}
 		syncError := scheduler.Synchronize(this.Domain, service, this.tracker, global, this.scheduleExecutor.Inbox)
 		switch syncError {
 		case nil:
@@ -212,8 +558,10 @@ func (this *Domain) AddScheduler(service ServiceKey, scheduler *Scheduler) (chan
 			return true
 		}
 	})
-
-	return stopper, nil
+	if err != nil {
+		glog.Warningln("Cannot watch trigger", watch, "Err=", err)
+	}
+	return stopper, done, nil
 }
 
 func label(this *docker.Container) string {
@@ -233,14 +581,17 @@ func (this *Domain) GetContainerWatcherSpecs() (map[ServiceKey]*MatchContainerRu
 }
 
 func (this *Domain) WatchContainer(service ServiceKey, spec *MatchContainerRule) error {
-	key := fmt.Sprintf("%s-%s", service, spec.Image)
+	this.lock.Lock()
+	defer this.lock.Unlock()
 
 	if this.container_watchers == nil {
-		this.container_watchers = make(map[string]chan<- bool)
+		this.container_watchers = make(map[ServiceKey]*container_watch)
+	}
+	if this.agent == nil {
+		return ErrNoDockerEngine
 	}
 
-	this.lock.Lock()
-	if _, has := this.container_watchers[key]; !has {
+	if _, has := this.container_watchers[service]; !has {
 
 		containerMatcher := new(DiscoveryContainerMatcher).Init()
 		specs, err := this.GetContainerWatcherSpecs()
@@ -252,99 +603,162 @@ func (this *Domain) WatchContainer(service ServiceKey, spec *MatchContainerRule)
 			containerMatcher.C(this.Domain, svc, spec)
 		}
 
-		stop, err := this.docker.WatchContainerMatching(
+		watch, err := watch_containers(this.agent.DockerSettings,
 
 			containerMatcher.MatcherForDomain(this.Domain, service),
 
 			func(action docker.Action, container *docker.Container) {
-
-				switch action {
-				case docker.Create:
-
-					glog.Infoln("#### Container CREATE ####", label(container))
-					this.tracker.Starting(service, container)
-
-				case docker.Start:
-
-					glog.Infoln("#### Container START ####", label(container))
-
-					entry, err := BuildRegistryEntry(container, spec.GetMatchContainerPort())
-
-					if err != nil {
-						glog.Warningln("Uable to generate registry entries for", *container)
-					}
-
-					if entry == nil {
-						glog.Warningln("Cannot build registry entry. Not registering:", *container)
-					}
-
-					entry.Host = this.Host
-					entry.Domain = this.Domain
-					entry.Service = string(service)
-
-					err = entry.Register(this.zk)
-					k, v, _ := entry.KeyValue()
-					if err != nil {
-						glog.Warningln("Error registering", k, err)
-						return
-					} else {
-						glog.Infoln("Registered", k, v)
-					}
-
-					this.tracker.Running(service, container)
-
-				case docker.Die, docker.Stop, docker.Remove:
-
-					glog.Infoln("#### Container DIE / STOP / REMOVE ####", label(container))
-
-					entry, err := BuildRegistryEntry(container, 0)
-
-					// Update zk
-					if err == nil && entry != nil {
-
-						entry.Host = this.Host
-						entry.Domain = this.Domain
-						entry.Service = string(service)
-
-						err = entry.Remove(this.zk) // blocks
-						if err != nil {
-							glog.Warningln("Error trying to remove zk entry. Cannot sync state. Entry=", entry)
-							// Go into retry...
-							maxAttempts := 10
-							retryDelay := 2 * time.Second
-							go func() {
-								for i := 0; i < maxAttempts; i++ {
-									glog.Infoln("Trying to remove entry=", entry)
-									err = entry.Remove(this.zk) // blocks
-									if err != nil {
-										glog.Warningln("Error trying to remove zk entry=", entry)
-										time.Sleep(retryDelay)
-									} else {
-										break
-									}
-								}
-							}()
-						}
-					}
-					// Update the tracker
-					switch action {
-					case docker.Die:
-						this.tracker.Died(service, container)
-					case docker.Stop:
-						this.tracker.Stopped(service, container)
-					case docker.Remove:
-						this.tracker.Removed(service, container)
-					}
-				}
+				this.on_container_event(service, spec, action, container)
 			})
-		if err == nil {
-			this.container_watchers[key] = stop
+		if err != nil {
+			return err
 		}
+		this.container_watchers[service] = watch
 	}
-	this.lock.Unlock()
 	return nil
 }
 
+// Handles an event of a container of the service, from docker or found by reconciliation
+func (this *Domain) on_container_event(service ServiceKey, spec *MatchContainerRule,
+	action docker.Action, container *docker.Container) {
+
+	switch action {
+	case docker.Create:
+
+		glog.Infoln("#### Container CREATE ####", label(container))
+		this.tracker.Starting(service, container)
+
+	case docker.Start:
+
+		glog.Infoln("#### Container START ####", label(container))
+		this.ProbeContainer(service, spec, container)
+
+	case docker.Die, docker.Stop, docker.Remove:
+
+		glog.Infoln("#### Container DIE / STOP / REMOVE ####", label(container))
+		this.StopProbe(container)
+		this.deregister_container(service, container)
+		this.release_slot(service, container)
+		if action == docker.Die {
+			this.complete_job(service, container)
+		}
+
+		// Update the tracker
+		switch action {
+		case docker.Die:
+			this.tracker.Died(service, container)
+		case docker.Stop:
+			this.tracker.Stopped(service, container)
+		case docker.Remove:
+			this.tracker.Removed(service, container)
+		}
+	}
+}
+
+// Registers the container under KContainer and marks it as running.
+func (this *Domain) register_container(service ServiceKey, spec *MatchContainerRule, container *docker.Container) error {
+	entry, err := BuildRegistryEntry(container, spec.GetMatchContainerPort())
+
+	if err != nil {
+		glog.Warningln("Uable to generate registry entries for", *container)
+	}
+
+	if entry == nil {
+		glog.Warningln("Cannot build registry entry. Not registering:", *container)
+		metric_registration_failures.Inc(this.Domain, string(service))
+		this.on_registration(service, container, "register", ErrNoContainerInformation)
+		return ErrNoContainerInformation
+	}
+
+	entry.Host = this.Host
+	entry.Domain = this.Domain
+	entry.Service = string(service)
+
+	err = entry.Register(this.zk)
+	k, v, _ := entry.KeyValue()
+	if err != nil {
+		glog.Warningln("Error registering", k, err)
+		metric_registration_failures.Inc(this.Domain, string(service))
+		this.on_registration(service, container, "register", err)
+		return err
+	} else {
+		glog.Infoln("Registered", k, v)
+	}
+	this.on_registration(service, container, "register", nil)
+
+	this.tracker.Running(service, container)
+	return nil
+}
+
+// Removes the container from the registry, retrying in the background on errors.
+func (this *Domain) deregister_container(service ServiceKey, container *docker.Container) {
+	entry, err := BuildRegistryEntry(container, 0)
+	if err != nil || entry == nil {
+		return
+	}
+
+	entry.Host = this.Host
+	entry.Domain = this.Domain
+	entry.Service = string(service)
+
+	err = entry.Remove(this.zk) // blocks
+	this.on_registration(service, container, "deregister", err)
+	if err != nil {
+		glog.Warningln("Error trying to remove zk entry. Cannot sync state. Entry=", entry)
+		// Go into retry...
+		maxAttempts := 10
+		retryDelay := 2 * time.Second
+		this.running.Add(1)
+		go func() {
+			defer this.running.Done()
+			for i := 0; i < maxAttempts; i++ {
+				glog.Infoln("Trying to remove entry=", entry)
+				err := entry.Remove(this.zk) // blocks
+				if err == nil {
+					return
+				}
+				glog.Warningln("Error trying to remove zk entry=", entry)
+				select {
+				case <-time.After(retryDelay):
+				case <-this.stopping:
+					glog.Warningln("Domain stopping. Giving up removing zk entry=", entry)
+					return
+				}
+			}
+		}()
+	}
+}
+
+// Releases the slot of the global semaphore held by the container, if the service has a global max.
+func (this *Domain) release_slot(service ServiceKey, container *docker.Container) {
+	this.lock.Lock()
+	scheduler, has := this.schedulers[service]
+	this.lock.Unlock()
+
+	if !has || scheduler.Constraint == nil || scheduler.Constraint.MaxInstancesGlobal == nil {
+		return
+	}
+	semaphore, err := GlobalSemaphore(this.Domain, service, *scheduler.Constraint.MaxInstancesGlobal)
+	if err == nil {
+		err = semaphore.ReleaseContainer(this.zk, container.Id)
+	}
+	if err != nil {
+		glog.Warningln("Error releasing slot of container", container.Id, "Err=", err)
+	}
+}
+
+func (this *Domain) StopContainerWatch(service ServiceKey) {
+	this.lock.Lock()
+	watch, has := this.container_watchers[service]
+	delete(this.container_watchers, service)
+	this.lock.Unlock()
+
+	if has {
+		glog.Infoln("Stopping container monitor", "Domain=", this.Domain, "Service=", service)
+		watch.Stop()
+	}
+}
+
 // Containers in this domain
 func (this *Domain) ListContainers(service ServiceKey) ([]*docker.Container, error) {
 	// TODO finish this
@@ -361,3 +775,52 @@ func (this *Domain) fetchAuthIdentity(path string) (*docker.AuthIdentity, error)
 	err = json.Unmarshal(n.Value, parse)
 	return parse, err
 }
+
+// Returns the services of this domain -- both scheduled and those with tracked containers.
+func (this *Domain) Services() []ServiceKey {
+	seen := map[ServiceKey]bool{}
+	services := []ServiceKey{}
+	this.lock.Lock()
+	for service := range this.schedulers {
+		seen[service] = true
+		services = append(services, service)
+	}
+	this.lock.Unlock()
+	for _, service := range this.tracker.Services() {
+		if !seen[service] {
+			seen[service] = true
+			services = append(services, service)
+		}
+	}
+	sort.Sort(serviceKeys(services))
+	return services
+}
+
+func (this *Domain) GetServiceSummary(service ServiceKey) ServiceSummary {
+	this.lock.Lock()
+	scheduler, scheduled := this.schedulers[service]
+	this.lock.Unlock()
+
+	summary := ServiceSummary{
+		Service:    service,
+		Scheduled:  scheduled,
+		Versions:   0,
+		Containers: map[string]int{},
+	}
+	versions := map[int]bool{}
+	for _, c := range this.tracker.Containers(service) {
+		versions[c.VersionGroup] = true
+		summary.Containers[c.State] += 1
+	}
+	summary.Versions = len(versions)
+	if scheduled && scheduler.RestartPolicy != nil {
+		summary.State = string(scheduler.RestartState())
+	}
+	return summary
+}
+
+type serviceKeys []ServiceKey
+
+func (s serviceKeys) Len() int           { return len(s) }
+func (s serviceKeys) Less(i, j int) bool { return s[i] < s[j] }
+func (s serviceKeys) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,86 @@
+package agent
+
+import (
+	. "github.com/infradash/dash/pkg/dash"
+	"github.com/qorio/maestro/pkg/zk"
+	. "gopkg.in/check.v1"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestDomain(t *testing.T) { TestingT(t) }
+
+type TestSuiteDomain struct {
+}
+
+var _ = Suite(&TestSuiteDomain{})
+
+func (suite *TestSuiteDomain) SetUpSuite(c *C) {
+}
+
+func (suite *TestSuiteDomain) TearDownSuite(c *C) {
+}
+
+// Only supports keeping watches, which is what the domain needs for triggers.
+type test_zk struct {
+	zk.ZK
+}
+
+func (this *test_zk) KeepWatch(path string, f func(zk.Event) bool, alerts ...func(error)) (chan<- bool, error) {
+	stop := make(chan bool)
+	go func() {
+		<-stop
+	}()
+	return stop, nil
+}
+
+func wait_for_goroutines(max int) int {
+	for i := 0; i < 100; i++ {
+		if n := runtime.NumGoroutine(); n <= max {
+			return n
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return runtime.NumGoroutine()
+}
+
+func (suite *TestSuiteDomain) TestDomainStop(c *C) {
+	baseline := runtime.NumGoroutine()
+	tags := QualifyByTags{Tags: []string{"web"}}
+
+	domain := NewDomain(&DomainConfig{
+		RegistryContainerEntry: RegistryContainerEntry{
+			RegistryReleaseEntry: RegistryReleaseEntry{
+				RegistryEntryBase: RegistryEntryBase{Domain: "test.com"},
+			},
+		},
+		Services: map[ServiceKey]*Scheduler{
+			"infradash": &Scheduler{QualifyByTags: tags, Register: &MatchContainerRule{}},
+			"sidekiq":   &Scheduler{QualifyByTags: tags, Register: &MatchContainerRule{}},
+		},
+		Vacuums: map[ServiceKey]*VacuumConfig{
+			"infradash": &VacuumConfig{QualifyByTags: tags, RunIntervalSeconds: 1},
+		},
+	}, &test_zk{}, nil, nil)
+
+	_, err := domain.StartScheduleExecutor()
+	c.Assert(err, Equals, nil)
+
+	_, err = domain.StartServices(tags)
+	c.Assert(err, Equals, nil)
+	c.Assert(domain.Services(), DeepEquals, []ServiceKey{"infradash", "sidekiq"})
+	c.Assert(runtime.NumGoroutine() > baseline, Equals, true)
+
+	// Stopping one service leaves the others running
+	domain.StopService("sidekiq")
+	c.Assert(domain.Services(), DeepEquals, []ServiceKey{"infradash"})
+	c.Assert(runtime.NumGoroutine() > baseline, Equals, true)
+
+	domain.Stop()
+	c.Assert(len(domain.Services()), Equals, 0)
+	c.Assert(wait_for_goroutines(baseline), Equals, baseline)
+
+	// Stopping again is a no-op
+	domain.Stop()
+}
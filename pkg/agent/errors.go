@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/golang/glog"
 	"runtime"
+	"sync"
 )
 
 var (
@@ -30,9 +31,47 @@ var (
 	ErrMaxAttemptsExceeded            = errors.New("max-attempts-exceeded")
 	ErrBadSchedulerSpec               = errors.New("bad-scheduler-spec")
 	ErrBadVacuumConfig                = errors.New("bad-vacuum-config")
+	ErrNoDockerEngine                 = errors.New("no-docker-engine")
+	ErrProbeTimeout                   = errors.New("probe-timeout")
+	ErrProbeHealthStarting            = errors.New("probe-health-starting")
+	ErrProbeUnhealthy                 = errors.New("probe-unhealthy")
+	ErrGlobalMaxInstances             = errors.New("global-max-instances")
+	ErrBadHostAttributes              = errors.New("bad-host-attributes")
+	ErrInsufficientMemory             = errors.New("insufficient-memory")
+	ErrInsufficientCpu                = errors.New("insufficient-cpu")
+	ErrInsufficientDisk               = errors.New("insufficient-disk")
+	ErrBadSize                        = errors.New("bad-size")
+	ErrNoDockerRootDir                = errors.New("no-docker-root-dir")
+	ErrDockerRootNotLocal             = errors.New("docker-root-not-local")
+	ErrBadExportDestination           = errors.New("bad-export-destination")
+	ErrExportRetryLater               = errors.New("export-retry-later")
+	ErrNoJob                          = errors.New("no-run-once-job")
+	ErrNoJobTrigger                   = errors.New("no-job-trigger-value")
+	ErrJobClaimed                     = errors.New("job-run-claimed")
+	ErrJobFailed                      = errors.New("job-failed")
+	ErrJobOwnerLost                   = errors.New("job-owner-lost")
+	ErrBadCronSpec                    = errors.New("bad-cron-spec")
+	ErrBadContainerActionType         = errors.New("bad-container-action-type")
+	ErrNoContainerToMatch             = errors.New("no-container-name-or-image-to-match")
+	ErrBadMatchTemplate               = errors.New("bad-container-name-template-to-match")
+	ErrCrashLoop                      = errors.New("crashloop")
+	ErrStateDeadlineExceeded          = errors.New("state-deadline-exceeded")
+	ErrBadEventSinkConfig             = errors.New("bad-event-sink-config")
 	ErrDebug                          = errors.New("REMOVE_ME")
 )
 
+var (
+	exceptions_lock sync.Mutex
+	exceptions      func(Event)
+)
+
+// Publishes the exceptions as events, from then on
+func publish_exceptions(publish func(Event)) {
+	exceptions_lock.Lock()
+	defer exceptions_lock.Unlock()
+	exceptions = publish
+}
+
 func ExceptionEvent(err error, context interface{}, a ...interface{}) {
 	source := ""
 	_, file, line, ok := runtime.Caller(1)
@@ -41,4 +80,18 @@ func ExceptionEvent(err error, context interface{}, a ...interface{}) {
 	}
 
 	glog.Warningln("!!!! Err=", err, "Source=", source, "Context=", context, fmt.Sprintln(a...))
+
+	exceptions_lock.Lock()
+	publish := exceptions
+	exceptions_lock.Unlock()
+	if publish != nil {
+		publish(Event{
+			Type:        EventException,
+			Status:      StatusFatal,
+			Title:       fmt.Sprint(err),
+			Description: fmt.Sprintln(a...),
+			Note:        source,
+			Data:        map[string]interface{}{"context": fmt.Sprint(context)},
+		})
+	}
 }
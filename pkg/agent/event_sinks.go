@@ -0,0 +1,409 @@
+package agent
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	"github.com/qorio/maestro/pkg/pubsub"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Event sinks -- where the events of a domain are sent besides the agent's status topic: a webhook, a file of
+// JSON lines or a pubsub topic.  Each sink of a domain gets the events of the domain and of the agent, such as
+// changes of the zk session and exceptions, that pass its filter.  A sink that falls behind misses events.
+// The sinks are restarted when the config of the domain changes them.
+
+const (
+	default_webhook_attempts    = 3
+	default_webhook_retry_delay = time.Second
+	default_webhook_timeout     = 10 * time.Second
+	default_event_file_bytes    = 10 * 1024 * 1024
+	default_event_file_keep     = 5
+	default_event_sink_buffer   = 1000
+)
+
+type EventSink interface {
+	Send(event Event) error
+	Close() error
+}
+
+type EventSinkConfig struct {
+	// Event types and statuses sent to the sink; all when empty
+	Types  []EventType `json:"types,omitempty"`
+	Status []string    `json:"status,omitempty"`
+
+	// Exactly one of
+	Webhook *WebhookSinkConfig `json:"webhook,omitempty"`
+	File    *FileSinkConfig    `json:"file,omitempty"`
+	Pubsub  *PubsubSinkConfig  `json:"pubsub,omitempty"`
+}
+
+type WebhookSinkConfig struct {
+	Url string `json:"url"`
+
+	// Key of the HMAC-SHA256 of the body, sent as X-Dash-Signature: sha256={hex}
+	Secret  string            `json:"secret,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+
+	MaxAttempts       int `json:"max_attempts,omitempty"`
+	RetryDelaySeconds int `json:"retry_delay_seconds,omitempty"`
+	TimeoutSeconds    int `json:"timeout_seconds,omitempty"`
+}
+
+type FileSinkConfig struct {
+	Path string `json:"path"`
+
+	// The file is rotated to {path}.1 when it would grow past MaxBytes.  MaxFiles rotated files are kept.
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+	MaxFiles int   `json:"max_files,omitempty"`
+}
+
+type PubsubSinkConfig struct {
+	Topic pubsub.Topic `json:"topic"`
+}
+
+func (this *EventSinkConfig) Kind() string {
+	switch {
+	case this.Webhook != nil:
+		return "webhook"
+	case this.File != nil:
+		return "file"
+	case this.Pubsub != nil:
+		return "pubsub"
+	}
+	return ""
+}
+
+func (this *EventSinkConfig) IsValid() bool {
+	count := 0
+	for _, set := range []bool{this.Webhook != nil, this.File != nil, this.Pubsub != nil} {
+		if set {
+			count += 1
+		}
+	}
+	if count != 1 {
+		return false
+	}
+	switch {
+	case this.Webhook != nil:
+		u, err := url.Parse(this.Webhook.Url)
+		return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" &&
+			this.Webhook.MaxAttempts >= 0 && this.Webhook.RetryDelaySeconds >= 0 && this.Webhook.TimeoutSeconds >= 0
+	case this.File != nil:
+		return this.File.Path != "" && this.File.MaxBytes >= 0 && this.File.MaxFiles >= 0
+	case this.Pubsub != nil:
+		return this.Pubsub.Topic.Valid()
+	}
+	return false
+}
+
+func (this *EventSinkConfig) filter() EventFilter {
+	return EventFilter{Types: this.Types, Status: this.Status}
+}
+
+// Returns the sink of the config.  Retries of the sink give up when stop is closed.
+func (this *EventSinkConfig) sink(id string, stop <-chan bool) (EventSink, error) {
+	if !this.IsValid() {
+		return nil, ErrBadEventSinkConfig
+	}
+	switch {
+	case this.Webhook != nil:
+		return new_webhook_sink(*this.Webhook, stop), nil
+	case this.File != nil:
+		return new_file_sink(*this.File)
+	default:
+		return new_pubsub_sink(this.Pubsub.Topic, id)
+	}
+}
+
+type webhook_sink struct {
+	config WebhookSinkConfig
+	client *http.Client
+	stop   <-chan bool
+}
+
+func new_webhook_sink(config WebhookSinkConfig, stop <-chan bool) *webhook_sink {
+	if config.MaxAttempts == 0 {
+		config.MaxAttempts = default_webhook_attempts
+	}
+	timeout := default_webhook_timeout
+	if config.TimeoutSeconds > 0 {
+		timeout = time.Duration(config.TimeoutSeconds) * time.Second
+	}
+	return &webhook_sink{config: config, client: &http.Client{Timeout: timeout}, stop: stop}
+}
+
+func (this *webhook_sink) retry_delay() time.Duration {
+	if this.config.RetryDelaySeconds == 0 {
+		return default_webhook_retry_delay
+	}
+	return time.Duration(this.config.RetryDelaySeconds) * time.Second
+}
+
+// Posts the event, retrying with a doubling delay on errors of the connection and of the server
+func (this *webhook_sink) Send(event Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	delay := this.retry_delay()
+	for attempt := 1; ; attempt++ {
+		retry, err := this.post(event, body)
+		if err == nil || !retry || attempt >= this.config.MaxAttempts {
+			return err
+		}
+		glog.Warningln("Webhook failed: Url=", this.config.Url, "Attempt=", attempt, "Err=", err)
+		select {
+		case <-time.After(delay):
+		case <-this.stop:
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// Returns true if a failed post can be retried
+func (this *webhook_sink) post(event Event, body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", this.config.Url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	for k, v := range this.config.Headers {
+		req.Header.Set(k, v)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Dash-Event", string(event.Type))
+	req.Header.Set("X-Dash-Domain", event.Domain)
+	if this.config.Secret != "" {
+		req.Header.Set("X-Dash-Signature", "sha256="+hmac_sha256(this.config.Secret, body))
+	}
+	resp, err := this.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests,
+			fmt.Errorf("webhook-status-%d", resp.StatusCode)
+	}
+	return false, nil
+}
+
+func (this *webhook_sink) Close() error {
+	return nil
+}
+
+// Returns the hex HMAC-SHA256 of the body
+func hmac_sha256(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+type file_sink struct {
+	config FileSinkConfig
+	file   *os.File
+	size   int64
+}
+
+func new_file_sink(config FileSinkConfig) (*file_sink, error) {
+	if config.MaxBytes == 0 {
+		config.MaxBytes = default_event_file_bytes
+	}
+	if config.MaxFiles == 0 {
+		config.MaxFiles = default_event_file_keep
+	}
+	if err := os.MkdirAll(filepath.Dir(config.Path), 0755); err != nil {
+		return nil, err
+	}
+	sink := &file_sink{config: config}
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+func (this *file_sink) open() error {
+	file, err := os.OpenFile(this.config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	this.file, this.size = file, info.Size()
+	return nil
+}
+
+// Appends the event as a line of JSON
+func (this *file_sink) Send(event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if this.size > 0 && this.size+int64(len(line)) > this.config.MaxBytes {
+		if err := this.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := this.file.Write(line)
+	this.size += int64(n)
+	return err
+}
+
+// Shifts {path}.i to {path}.i+1, dropping the oldest, and starts a new file
+func (this *file_sink) rotate() error {
+	if err := this.file.Close(); err != nil {
+		glog.Warningln("Cannot close", this.config.Path, "Err=", err)
+	}
+	for i := this.config.MaxFiles - 1; i >= 1; i-- {
+		from := fmt.Sprintf("%s.%d", this.config.Path, i)
+		if _, err := os.Stat(from); err == nil {
+			os.Rename(from, fmt.Sprintf("%s.%d", this.config.Path, i+1))
+		}
+	}
+	if err := os.Rename(this.config.Path, this.config.Path+".1"); err != nil {
+		return err
+	}
+	return this.open()
+}
+
+func (this *file_sink) Close() error {
+	return this.file.Close()
+}
+
+// The clients of pubsub brokers are cached by id and shared, so the client of a sink is never closed; a closed
+// client would be handed out again.
+type pubsub_sink struct {
+	topic pubsub.Topic
+	pb    pubsub.PubSub
+}
+
+func new_pubsub_sink(topic pubsub.Topic, id string) (*pubsub_sink, error) {
+	pb, err := topic.Broker().PubSub(id)
+	if err != nil {
+		return nil, err
+	}
+	return &pubsub_sink{topic: topic, pb: pb}, nil
+}
+
+func (this *pubsub_sink) Send(event Event) error {
+	msg, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return this.pb.Publish(this.topic, msg)
+}
+
+func (this *pubsub_sink) Close() error {
+	return nil
+}
+
+// The running sinks of a domain and the config they were started with
+type event_sinks struct {
+	spec    string
+	stop    chan bool
+	running sync.WaitGroup
+}
+
+// Starts sending the events of the domain to its sinks until the domain stops or the sinks are stopped
+func (this *Domain) StartEventSinks() error {
+	if this.agent == nil {
+		return nil
+	}
+	for _, config := range this.Config.EventSinks {
+		if !config.IsValid() {
+			return ErrBadEventSinkConfig
+		}
+	}
+	sinks := &event_sinks{spec: config_spec(this.Config.EventSinks), stop: make(chan bool)}
+
+	// All the sinks are created before any is started, so a domain runs either all its sinks or none
+	built := []EventSink{}
+	for i, config := range this.Config.EventSinks {
+		id := path.Join(this.Domain, this.agent.Name, this.agent.Host, fmt.Sprint("sink-", i))
+		sink, err := config.sink(id, sinks.stop)
+		if err != nil {
+			for _, sink := range built {
+				sink.Close()
+			}
+			return err
+		}
+		built = append(built, sink)
+	}
+
+	this.lock.Lock()
+	this.sinks = sinks
+	this.lock.Unlock()
+
+	for i, config := range this.Config.EventSinks {
+		events, cancel := this.agent.Subscribe(config.filter(), default_event_sink_buffer)
+		sinks.running.Add(1)
+		go this.send_events(config.Kind(), built[i], events, cancel, sinks)
+		glog.Infoln("Domain=", this.Domain, "Started event sink:", config.Kind())
+	}
+	return nil
+}
+
+// Stops the sinks of the domain.  Blocks until they have stopped.
+func (this *Domain) StopEventSinks() {
+	this.lock.Lock()
+	sinks := this.sinks
+	this.sinks = nil
+	this.lock.Unlock()
+
+	if sinks != nil {
+		close(sinks.stop)
+		sinks.running.Wait()
+	}
+}
+
+// Restarts the sinks of the domain if the config changed them
+func (this *Domain) apply_event_sinks(config *DomainConfig) error {
+	this.lock.Lock()
+	sinks := this.sinks
+	this.lock.Unlock()
+
+	if sinks != nil && sinks.spec == config_spec(config.EventSinks) {
+		return nil
+	}
+	glog.Infoln("Config reload: event sinks changed", "Domain=", this.Domain)
+	this.StopEventSinks()
+	return this.StartEventSinks()
+}
+
+func (this *Domain) send_events(kind string, sink EventSink, events <-chan Event, cancel func(),
+	sinks *event_sinks) {
+
+	defer sinks.running.Done()
+	defer sink.Close()
+	defer cancel()
+	for {
+		select {
+		case event := <-events:
+			// Events of other domains
+			if event.Domain != "" && event.Domain != this.Domain {
+				continue
+			}
+			if err := sink.Send(event); err != nil {
+				glog.Warningln("Domain=", this.Domain, "Event sink", kind, "failed. Err=", err)
+				metric_event_sink_failures.Inc(this.Domain, kind)
+			}
+		case <-sinks.stop:
+			return
+		}
+	}
+}
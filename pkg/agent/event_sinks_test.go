@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	. "github.com/infradash/dash/pkg/dash"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+func (suite *TestSuiteScheduler) TestEventSinks(c *C) {
+	c.Assert((&EventSinkConfig{}).IsValid(), Equals, false)
+	c.Assert((&EventSinkConfig{Webhook: &WebhookSinkConfig{Url: "http://hooks.test.com/dash"}}).IsValid(), Equals, true)
+	c.Assert((&EventSinkConfig{Webhook: &WebhookSinkConfig{Url: "hooks.test.com"}}).IsValid(), Equals, false)
+	c.Assert((&EventSinkConfig{File: &FileSinkConfig{Path: "/var/log/dash/events.json"},
+		Webhook: &WebhookSinkConfig{Url: "http://hooks.test.com/dash"}}).IsValid(), Equals, false)
+	c.Assert((&EventSinkConfig{Pubsub: &PubsubSinkConfig{Topic: "mqtt://iot.eclipse.org:1883/dash/events"}}).IsValid(),
+		Equals, true)
+	c.Assert(hmac_sha256("key", []byte("The quick brown fox jumps over the lazy dog")), Equals,
+		"f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8")
+
+	// Webhooks are signed and retried on errors of the server only
+	posts, status := 0, []int{http.StatusBadGateway, http.StatusOK, http.StatusBadRequest}
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		c.Assert(req.Header.Get("X-Dash-Signature"), Equals, "sha256="+hmac_sha256("secret", body))
+		c.Assert(req.Header.Get("X-Dash-Event"), Equals, "container")
+		c.Assert(req.Header.Get("X-Oncall"), Equals, "dash")
+		resp.WriteHeader(status[posts])
+		posts += 1
+	}))
+	defer server.Close()
+
+	webhook := new_webhook_sink(WebhookSinkConfig{Url: server.URL, Secret: "secret", RetryDelaySeconds: 1,
+		Headers: map[string]string{"X-Oncall": "dash"}}, make(chan bool))
+	c.Assert(webhook.Send(Event{Type: EventContainer}), Equals, nil)
+	c.Assert(posts, Equals, 2)
+	c.Assert(webhook.Send(Event{Type: EventContainer}), ErrorMatches, "webhook-status-400")
+	c.Assert(posts, Equals, 3)
+
+	// Files of events are rotated
+	dir, err := ioutil.TempDir("", "dash-events")
+	c.Assert(err, Equals, nil)
+	defer os.RemoveAll(dir)
+
+	file, err := new_file_sink(FileSinkConfig{Path: filepath.Join(dir, "events.json"), MaxBytes: 300, MaxFiles: 2})
+	c.Assert(err, Equals, nil)
+	for i := 0; i < 8; i++ {
+		c.Assert(file.Send(Event{Type: EventPull, Title: fmt.Sprint("pull ", i)}), Equals, nil)
+	}
+	c.Assert(file.Close(), Equals, nil)
+	files, _ := filepath.Glob(filepath.Join(dir, "events.json*"))
+	c.Assert(files, DeepEquals, []string{filepath.Join(dir, "events.json"), filepath.Join(dir, "events.json.1"),
+		filepath.Join(dir, "events.json.2")})
+	buff, _ := ioutil.ReadFile(filepath.Join(dir, "events.json"))
+	lines := strings.Split(strings.TrimSpace(string(buff)), "\n")
+	last := Event{}
+	c.Assert(json.Unmarshal([]byte(lines[len(lines)-1]), &last), Equals, nil)
+	c.Assert(last.Title, Equals, "pull 7")
+
+	// A domain sends its events and the agent's, filtered, to its sinks
+	agent := &Agent{}
+	domain := NewDomain(&DomainConfig{
+		RegistryContainerEntry: RegistryContainerEntry{
+			RegistryReleaseEntry: RegistryReleaseEntry{
+				RegistryEntryBase: RegistryEntryBase{Domain: "test.com"},
+			},
+		},
+		EventSinks: []*EventSinkConfig{
+			{Types: []EventType{EventContainer, EventZk}, File: &FileSinkConfig{Path: filepath.Join(dir, "test.com.json")}},
+		},
+	}, &test_zk{}, nil, agent)
+	c.Assert(domain.StartEventSinks(), Equals, nil)
+
+	domain.tracker.Running("infradash", tracked_container("140aaaaaaaaaaaaa", "infradash/infradash:develop-1.2"))
+	agent.Publish(Event{Type: EventZk, Status: StatusOk})
+	agent.Publish(Event{Type: EventContainer, Domain: "other.com"})
+	agent.Publish(Event{Type: EventPull, Domain: "test.com"})
+	time.Sleep(50 * time.Millisecond)
+	domain.Stop()
+
+	buff, _ = ioutil.ReadFile(filepath.Join(dir, "test.com.json"))
+	lines = strings.Split(strings.TrimSpace(string(buff)), "\n")
+	c.Assert(len(lines), Equals, 2)
+	c.Assert(strings.Contains(lines[0], `"type":"container"`), Equals, true)
+	c.Assert(strings.Contains(lines[1], `"type":"zk"`), Equals, true)
+
+	// Sinks changed by a new config are restarted
+	config := &DomainConfig{EventSinks: []*EventSinkConfig{{File: &FileSinkConfig{Path: filepath.Join(dir, "a.json")}}}}
+	config.Domain = "test.com"
+	domain = NewDomain(config, &test_zk{}, nil, agent)
+	c.Assert(domain.StartEventSinks(), Equals, nil)
+	changed := *config
+	changed.EventSinks = []*EventSinkConfig{{File: &FileSinkConfig{Path: filepath.Join(dir, "b.json")}}}
+	changed.Registries = &ImageRegistries{Default: "registry.example.com:5000"}
+	c.Assert(domain.ApplyConfig(&changed, QualifyByTags{}), Equals, nil)
+	c.Assert(domain.puller.registries, Equals, changed.Registries)
+	agent.Publish(Event{Type: EventZk, Status: StatusOk})
+	time.Sleep(50 * time.Millisecond)
+	domain.Stop()
+	buff, _ = ioutil.ReadFile(filepath.Join(dir, "a.json"))
+	c.Assert(len(buff), Equals, 0)
+	buff, _ = ioutil.ReadFile(filepath.Join(dir, "b.json"))
+	c.Assert(strings.Contains(string(buff), `"type":"zk"`), Equals, true)
+
+	// Sinks that can't all be created start none, and the rest of a new config still applies
+	broken := []*EventSinkConfig{{File: &FileSinkConfig{Path: filepath.Join(dir, "c.json")}},
+		{File: &FileSinkConfig{Path: filepath.Join(dir, "a.json", "d.json")}}}
+	domain = NewDomain(&DomainConfig{EventSinks: broken}, &test_zk{}, nil, agent)
+	c.Assert(domain.StartEventSinks(), Not(Equals), nil)
+	c.Assert(domain.sinks, IsNil)
+	domain = NewDomain(config, &test_zk{}, nil, agent)
+	c.Assert(domain.StartEventSinks(), Equals, nil)
+	changed = *config
+	changed.EventSinks = broken
+	changed.Registries = &ImageRegistries{Default: "registry.example.com:5000"}
+	c.Assert(domain.ApplyConfig(&changed, QualifyByTags{}), Equals, nil)
+	c.Assert(domain.sinks, IsNil)
+	c.Assert(domain.puller.registries, Equals, changed.Registries)
+	domain.Stop()
+
+	domain = NewDomain(&DomainConfig{EventSinks: []*EventSinkConfig{{}}}, &test_zk{}, nil, agent)
+	c.Assert(domain.StartEventSinks(), Equals, ErrBadEventSinkConfig)
+}
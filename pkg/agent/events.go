@@ -0,0 +1,292 @@
+package agent
+
+import (
+	"fmt"
+	. "github.com/infradash/dash/pkg/dash"
+	"github.com/qorio/maestro/pkg/docker"
+	"path"
+	"sync"
+	"time"
+)
+
+// Events -- what happens on the agent, as typed events: containers changing state, decisions of schedulers,
+// pulls, registrations, vacuums, exceptions and changes of the zk session.  Events follow the schema of the
+// status topic, where they are published, and are delivered to the local subscribers whose filter they match.
+
+type EventType string
+
+const (
+	EventContainer    EventType = "container"
+	EventSchedule     EventType = "schedule"
+	EventPull         EventType = "pull"
+	EventRegistration EventType = "registration"
+	EventVacuum       EventType = "vacuum"
+	EventException    EventType = "exception"
+	EventZk           EventType = "zk"
+	EventRestart      EventType = "restart"
+	EventRunOnce      EventType = "run_once"
+)
+
+const (
+	StatusOk      = "ok"
+	StatusWarning = "warning"
+	StatusFatal   = "fatal"
+)
+
+type Event struct {
+	Status      string    `json:"status"`
+	Title       string    `json:"title,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Note        string    `json:"note,omitempty"`
+	User        string    `json:"user,omitempty"`
+	Type        EventType `json:"type,omitempty"`
+	Url         string    `json:"url,omitempty"`
+	Timestamp   int64     `json:"timestamp,omitempty"`
+	ObjectId    string    `json:"object_id"`
+	ObjectType  string    `json:"object_type"`
+
+	Domain  string                 `json:"domain,omitempty"`
+	Service ServiceKey             `json:"service,omitempty"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+// Matches events of any of the types and statuses, and of the domain and service, when given
+type EventFilter struct {
+	Types   []EventType `json:"types,omitempty"`
+	Status  []string    `json:"status,omitempty"`
+	Domain  string      `json:"domain,omitempty"`
+	Service ServiceKey  `json:"service,omitempty"`
+}
+
+func (this EventFilter) Match(event *Event) bool {
+	if this.Domain != "" && this.Domain != event.Domain {
+		return false
+	}
+	if this.Service != "" && this.Service != event.Service {
+		return false
+	}
+	if len(this.Types) > 0 {
+		match := false
+		for _, t := range this.Types {
+			match = match || t == event.Type
+		}
+		if !match {
+			return false
+		}
+	}
+	if len(this.Status) > 0 {
+		match := false
+		for _, s := range this.Status {
+			match = match || s == event.Status
+		}
+		if !match {
+			return false
+		}
+	}
+	return true
+}
+
+type event_subscription struct {
+	filter EventFilter
+	events chan Event
+}
+
+// Delivers events to the subscribers.  Subscribers that don't keep up miss events.
+type event_bus struct {
+	lock        sync.Mutex
+	subscribers map[*event_subscription]bool
+}
+
+func (this *event_bus) subscribe(filter EventFilter, buffer int) (<-chan Event, func()) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.subscribers == nil {
+		this.subscribers = map[*event_subscription]bool{}
+	}
+	s := &event_subscription{filter: filter, events: make(chan Event, buffer)}
+	this.subscribers[s] = true
+	cancel := func() {
+		this.lock.Lock()
+		defer this.lock.Unlock()
+		if this.subscribers[s] {
+			delete(this.subscribers, s)
+			close(s.events)
+		}
+	}
+	return s.events, cancel
+}
+
+func (this *event_bus) publish(event Event) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for s := range this.subscribers {
+		if !s.filter.Match(&event) {
+			continue
+		}
+		select {
+		case s.events <- event:
+		default:
+		}
+	}
+}
+
+// Subscribes to the events matching the filter.  Call the returned function to unsubscribe.
+func (this *Agent) Subscribe(filter EventFilter, buffer int) (<-chan Event, func()) {
+	return this.events.subscribe(filter, buffer)
+}
+
+// Publishes the event on the status topic, if there is one, and to the subscribers
+func (this *Agent) Publish(event Event) {
+	event.ObjectId = path.Join(this.Domain, this.Name, this.Host)
+	event.ObjectType = "agent"
+	event.Timestamp = time.Now().Unix()
+	event.User = "dash"
+
+	this.statusLock.Lock()
+	status := this.status
+	this.statusLock.Unlock()
+
+	if status != nil {
+		status(event)
+	}
+	this.events.publish(event)
+}
+
+func (this *Domain) publish(event Event) {
+	if this.agent == nil {
+		return
+	}
+	event.Domain = this.Domain
+	this.agent.Publish(event)
+}
+
+func (this *Domain) on_transition(service ServiceKey, c *docker.Container, from, to *FsmState) {
+	status := StatusOk
+	switch to.State {
+	case Failed:
+		status = StatusFatal
+	case Stopping, Stopped, Removed:
+		status = StatusWarning
+	}
+	data := map[string]interface{}{
+		"id":    c.Id,
+		"image": c.Image,
+		"from":  state_label(from.State.String()),
+		"to":    state_label(to.State.String()),
+	}
+	if to.Error != nil {
+		data["error"] = to.Error.Error()
+	}
+	this.publish(Event{
+		Type:        EventContainer,
+		Status:      status,
+		Service:     service,
+		Title:       fmt.Sprint("container ", short_id(c.Id), " of ", this.Domain, "/", service, " is ", data["to"]),
+		Description: fmt.Sprint(data["from"], "=>", data["to"], ":", c.Image),
+		Data:        data,
+	})
+}
+
+func (this *Domain) on_registration(service ServiceKey, c *docker.Container, action string, err error) {
+	status, note := StatusOk, ""
+	if err != nil {
+		status, note = StatusWarning, err.Error()
+	}
+	this.publish(Event{
+		Type:        EventRegistration,
+		Status:      status,
+		Service:     service,
+		Title:       fmt.Sprint(action, " container ", short_id(c.Id), " of ", this.Domain, "/", service),
+		Description: fmt.Sprint(action, ":", c.Image, "@", this.Host),
+		Note:        note,
+		Data:        map[string]interface{}{"id": c.Id, "image": c.Image, "action": action},
+	})
+}
+
+// Publishes the containers the scheduler starts and stops
+func (this *Scheduler) decided(domain string, service ServiceKey, actions []Task) {
+	if this.status == nil || len(actions) == 0 {
+		return
+	}
+	start, stop := 0, []string{}
+	for _, task := range actions {
+		switch task.stopAction {
+		case Stop, Remove:
+			stop = append(stop, task.stopContainers...)
+		default:
+			start += 1
+		}
+	}
+	this.status(Event{
+		Type:        EventSchedule,
+		Status:      StatusOk,
+		Domain:      domain,
+		Service:     service,
+		Title:       fmt.Sprint("schedule of ", domain, "/", service, ": start ", start, ", stop ", len(stop)),
+		Description: fmt.Sprint("start=", start, " stop=", stop),
+		Data:        map[string]interface{}{"start": start, "stop": stop},
+	})
+}
+
+func (this *image_puller) pulled(image string, start time.Time, err error) {
+	if this.publish == nil {
+		return
+	}
+	status, note := StatusOk, ""
+	if err != nil {
+		status, note = StatusWarning, err.Error()
+	}
+	seconds := time.Since(start).Seconds()
+	this.publish(Event{
+		Type:        EventPull,
+		Status:      status,
+		Title:       fmt.Sprint("pull of ", image, " ", ResultLabel(err)),
+		Description: fmt.Sprint(image, "@", fmt.Sprintf("%.1fs", seconds)),
+		Note:        note,
+		Data:        map[string]interface{}{"image": image, "seconds": seconds},
+	})
+}
+
+func (this *Vacuum) vacuumed(step VacuumStep, err error) {
+	if this.publish == nil {
+		return
+	}
+	status, note := StatusOk, ""
+	if err != nil {
+		status, note = StatusWarning, err.Error()
+	}
+	this.publish(Event{
+		Type:        EventVacuum,
+		Status:      status,
+		Service:     this.Service,
+		Title:       fmt.Sprint("vacuum of ", this.Domain, "/", this.Service, ": ", step.Action, " ", short_id(step.Id)),
+		Description: fmt.Sprint(step.Action, ":", step.Image, "@", step.State),
+		Note:        note,
+		Data:        map[string]interface{}{"id": step.Id, "image": step.Image, "action": step.Action},
+	})
+}
+
+func (this *DiskVacuum) removed(kind, id string, err error) {
+	if this.publish == nil {
+		return
+	}
+	status, note := StatusOk, ""
+	if err != nil {
+		status, note = StatusWarning, err.Error()
+	}
+	this.publish(Event{
+		Type:        EventVacuum,
+		Status:      status,
+		Title:       fmt.Sprint("disk vacuum: remove ", kind, " ", short_id(id)),
+		Description: fmt.Sprint("remove_", kind, ":", id),
+		Note:        note,
+		Data:        map[string]interface{}{"id": id, "kind": kind, "action": "remove_" + kind},
+	})
+}
+
+func short_id(id string) string {
+	if len(id) > 12 {
+		return id[0:12]
+	}
+	return id
+}
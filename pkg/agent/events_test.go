@@ -0,0 +1,63 @@
+package agent
+
+import (
+	. "github.com/infradash/dash/pkg/dash"
+	. "gopkg.in/check.v1"
+)
+
+func (suite *TestSuiteScheduler) TestEvents(c *C) {
+	filter := EventFilter{Types: []EventType{EventContainer, EventPull}, Status: []string{StatusFatal}, Domain: "test.com"}
+	c.Assert(filter.Match(&Event{Type: EventContainer, Status: StatusFatal, Domain: "test.com"}), Equals, true)
+	c.Assert(filter.Match(&Event{Type: EventVacuum, Status: StatusFatal, Domain: "test.com"}), Equals, false)
+	c.Assert(filter.Match(&Event{Type: EventPull, Status: StatusOk, Domain: "test.com"}), Equals, false)
+	c.Assert(filter.Match(&Event{Type: EventPull, Status: StatusFatal, Domain: "other.com"}), Equals, false)
+	c.Assert(EventFilter{}.Match(&Event{Type: EventZk}), Equals, true)
+
+	agent := &Agent{}
+	published := []Event{}
+	agent.status = func(event Event) { published = append(published, event) }
+
+	all, cancel_all := agent.Subscribe(EventFilter{}, 10)
+	containers, cancel := agent.Subscribe(EventFilter{Types: []EventType{EventContainer}, Service: "infradash"}, 10)
+
+	domain := NewDomain(&DomainConfig{
+		RegistryContainerEntry: RegistryContainerEntry{
+			RegistryReleaseEntry: RegistryReleaseEntry{
+				RegistryEntryBase: RegistryEntryBase{Domain: "test.com"},
+			},
+		},
+	}, &test_zk{}, nil, agent)
+
+	// Transitions of the tracker are published as container events of the domain
+	domain.tracker.Starting("infradash", tracked_container("130aaaaaaaaaaaaa", "infradash/infradash:develop-1.2"))
+	domain.tracker.Running("infradash", tracked_container("130aaaaaaaaaaaaa", "infradash/infradash:develop-1.2"))
+	domain.tracker.Running("sidekiq", tracked_container("131aaaaaaaaaaaaa", "infradash/sidekiq:develop-1.2"))
+
+	event := <-containers
+	c.Assert(event.Type, Equals, EventContainer)
+	c.Assert(event.Domain, Equals, "test.com")
+	c.Assert(event.ObjectType, Equals, "agent")
+	c.Assert(event.Data["from"], Equals, "created")
+	c.Assert(event.Data["to"], Equals, "starting")
+	event = <-containers
+	c.Assert(event.Data["to"], Equals, "running")
+	c.Assert(len(containers), Equals, 0)
+	c.Assert(len(all), Equals, 3) // and created => running of sidekiq
+	c.Assert(len(published), Equals, 3)
+
+	// Scheduler decisions go through the status of the scheduler
+	scheduler := &Scheduler{status: agent.Publish}
+	scheduler.decided("test.com", "infradash", []Task{{stopAction: Stop, stopContainers: []string{"130aaaaaaaaaaaaa"}}})
+	c.Assert(published[3].Type, Equals, EventSchedule)
+	c.Assert(published[3].Data["stop"], DeepEquals, []string{"130aaaaaaaaaaaaa"})
+	scheduler.decided("test.com", "infradash", []Task{})
+	c.Assert(len(published), Equals, 4)
+
+	// No more events once cancelled
+	cancel()
+	_, open := <-containers
+	c.Assert(open, Equals, false)
+	cancel_all()
+	agent.Publish(Event{Type: EventContainer, Service: "infradash"})
+	c.Assert(len(published), Equals, 5)
+}
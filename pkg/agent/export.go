@@ -0,0 +1,330 @@
+package agent
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/golang/glog"
+	. "github.com/infradash/dash/pkg/dash"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Export -- keeps the evidence of a container before the vacuum removes it: the filesystem as a tar, the
+// output of docker inspect and the last lines of its log.  Exports are written to a directory (file://...),
+// where only the most recent ones of each service are kept, or POSTed as multipart form to a url (http(s)://...).
+
+const (
+	default_export_log_lines = 1000
+	default_export_retention = 10
+
+	export_filesystem = "filesystem.tar"
+	export_inspect    = "inspect.json"
+	export_log        = "container.log"
+
+	export_time_format = "20060102T150405Z"
+
+	// Delays before retrying a failed export, doubling up to the max
+	export_retry_delay     = time.Minute
+	export_retry_max_delay = time.Hour
+
+	// Bounds a POST of an export to a server that stops responding.  Long enough to upload the filesystems
+	// of large containers.
+	export_http_timeout = 30 * time.Minute
+)
+
+type export_retry struct {
+	attempts int
+	next     time.Time
+}
+
+type container_export struct {
+	domain    string
+	service   ServiceKey
+	id        string
+	logLines  int
+	retention int
+	engine    *docker_engine
+	client    *http.Client
+}
+
+func (this *VacuumConfig) export_log_lines() int {
+	if this.ExportLogLines == 0 {
+		return default_export_log_lines
+	}
+	return this.ExportLogLines
+}
+
+func (this *VacuumConfig) export_retention() int {
+	if this.ExportRetention == 0 {
+		return default_export_retention
+	}
+	return this.ExportRetention
+}
+
+func valid_export_destination(destination string) bool {
+	u, err := url.Parse(destination)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "file":
+		return u.Path != ""
+	case "http", "https":
+		return u.Host != ""
+	}
+	return false
+}
+
+// Exports the container to the destination
+func (this *container_export) Export(destination string) error {
+	u, err := url.Parse(destination)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "file":
+		return this.to_directory(u.Path)
+	case "http", "https":
+		return this.to_url(destination)
+	}
+	return ErrBadExportDestination
+}
+
+// Named {domain}_{service}-{time}-{container id}
+func (this *container_export) name(t time.Time) string {
+	return fmt.Sprintf("%s-%s", this.prefix(), t.UTC().Format(export_time_format)) + "-" + this.id[0:12]
+}
+
+// Returns the prefix of the name of an export, or false if not the name of an export
+func export_prefix(name string) (string, bool) {
+	// The time and the container id
+	suffix := len(export_time_format) + 12 + 2
+	if len(name) <= suffix || name[len(name)-suffix] != '-' || name[len(name)-13] != '-' {
+		return "", false
+	}
+	if _, err := time.Parse(export_time_format, name[len(name)-suffix+1:len(name)-13]); err != nil {
+		return "", false
+	}
+	return name[0 : len(name)-suffix], true
+}
+
+func (this *container_export) prefix() string {
+	return strings.Replace(this.domain+"_"+string(this.service), "/", "_", -1)
+}
+
+func (this *container_export) to_directory(dir string) error {
+	path := filepath.Join(dir, this.name(time.Now()))
+	if err := os.MkdirAll(path, 0700); err != nil {
+		return err
+	}
+	for _, part := range []string{export_inspect, export_log, export_filesystem} {
+		f, err := os.Create(filepath.Join(path, part))
+		if err != nil {
+			return err
+		}
+		err = this.write(part, f)
+		f.Close()
+		if err != nil {
+			os.RemoveAll(path)
+			return err
+		}
+	}
+	glog.Infoln("Exported container", this.id, "To=", path)
+	return this.prune(dir)
+}
+
+// Removes the oldest exports of the service beyond the retention
+func (this *container_export) prune(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	exports := []string{}
+	for _, entry := range entries {
+		if prefix, is := export_prefix(entry.Name()); entry.IsDir() && is && prefix == this.prefix() {
+			exports = append(exports, entry.Name())
+		}
+	}
+	sort.Strings(exports) // names sort by time
+	for i := 0; i < len(exports)-this.retention; i++ {
+		err := os.RemoveAll(filepath.Join(dir, exports[i]))
+		glog.Infoln("Removed export", exports[i], "Err=", err)
+	}
+	return nil
+}
+
+func (this *container_export) to_url(destination string) error {
+	reader, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+	go func() {
+		for _, part := range []string{export_inspect, export_log, export_filesystem} {
+			w, err := form.CreateFormFile(part, part)
+			if err == nil {
+				err = this.write(part, w)
+			}
+			if err != nil {
+				writer.CloseWithError(err)
+				return
+			}
+		}
+		writer.CloseWithError(form.Close())
+	}()
+
+	req, err := http.NewRequest("POST", destination, reader)
+	if err != nil {
+		reader.Close()
+		return err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("X-Dash-Domain", this.domain)
+	req.Header.Set("X-Dash-Service", string(this.service))
+	req.Header.Set("X-Dash-Container", this.id)
+
+	client := this.client
+	if client == nil {
+		client = &http.Client{Timeout: export_http_timeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		reader.Close()
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("export-status-%d", resp.StatusCode)
+	}
+	glog.Infoln("Exported container", this.id, "To=", destination)
+	return nil
+}
+
+func (this *container_export) write(part string, w io.Writer) error {
+	switch part {
+	case export_inspect:
+		return this.engine.copy("/containers/"+this.id+"/json", w)
+	case export_filesystem:
+		return this.engine.copy("/containers/"+this.id+"/export", w)
+	case export_log:
+		tty, err := this.engine.Tty(this.id)
+		if err != nil {
+			return err
+		}
+		path := fmt.Sprintf("/containers/%s/logs?stdout=1&stderr=1&timestamps=1&tail=%d", this.id, this.logLines)
+		if tty {
+			return this.engine.copy(path, w)
+		}
+		reader, writer := io.Pipe()
+		go func() {
+			writer.CloseWithError(this.engine.copy(path, writer))
+		}()
+		err = demux_logs(reader, w)
+		reader.Close()
+		return err
+	}
+	return nil
+}
+
+// Copies the multiplexed stdout and stderr of a container without a tty to w
+func demux_logs(r io.Reader, w io.Writer) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		size := int64(binary.BigEndian.Uint32(header[4:]))
+		if _, err := io.CopyN(w, r, size); err != nil {
+			return err
+		}
+	}
+}
+
+// Copies the response of a GET to w
+func (this *docker_engine) copy(path string, w io.Writer) error {
+	resp, err := this.client.Get(this.base + path)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("docker-api-status-%d", resp.StatusCode)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// Returns true if the container has a tty, in which case its log is not multiplexed
+func (this *docker_engine) Tty(id string) (bool, error) {
+	inspect := struct {
+		Config struct {
+			Tty bool
+		}
+	}{}
+	if err := this.call("GET", "/containers/"+id+"/json", nil, &inspect); err != nil {
+		return false, err
+	}
+	return inspect.Config.Tty, nil
+}
+
+// Exports the container if configured to and not exported already.  Returns nil if the container can be
+// removed.  A failed export is retried after a delay, until then ErrExportRetryLater is returned.
+func (this *Vacuum) export(containerId string, now time.Time) error {
+	if !this.Config.ExportContainer || this.exported[containerId] {
+		return nil
+	}
+	if retry, has := this.export_retries[containerId]; has && now.Before(retry.next) {
+		return ErrExportRetryLater
+	}
+	if err := this.export_container(containerId); err != nil {
+		retry := this.export_retries[containerId]
+		delay := export_retry_delay
+		for i := 0; i < retry.attempts && delay < export_retry_max_delay; i++ {
+			delay *= 2
+		}
+		if delay > export_retry_max_delay {
+			delay = export_retry_max_delay
+		}
+		this.export_retries[containerId] = export_retry{attempts: retry.attempts + 1, next: now.Add(delay)}
+		return err
+	}
+	delete(this.export_retries, containerId)
+	this.exported[containerId] = true
+	return nil
+}
+
+// Forgets the exports of the containers no longer to be removed
+func (this *Vacuum) forget_exports(remove map[string]bool) {
+	for id := range this.exported {
+		if !remove[id] {
+			delete(this.exported, id)
+		}
+	}
+	for id := range this.export_retries {
+		if !remove[id] {
+			delete(this.export_retries, id)
+		}
+	}
+}
+
+func (this *Vacuum) export_container(containerId string) error {
+	if this.engine == nil {
+		return ErrNoDockerEngine
+	}
+	export := &container_export{
+		domain:    this.Domain,
+		service:   this.Service,
+		id:        containerId,
+		logLines:  this.Config.export_log_lines(),
+		retention: this.Config.export_retention(),
+		engine:    this.engine,
+	}
+	return export.Export(this.Config.ExportDestination)
+}
@@ -0,0 +1,155 @@
+package agent
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	. "github.com/infradash/dash/pkg/dash"
+	. "gopkg.in/check.v1"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExport(t *testing.T) { TestingT(t) }
+
+type TestSuiteExport struct {
+}
+
+var _ = Suite(&TestSuiteExport{})
+
+func (suite *TestSuiteExport) TestExportContainer(c *C) {
+	id := "120aaaaaaaaaaaaaaaaa"
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/containers/" + id + "/json":
+			json.NewEncoder(resp).Encode(map[string]interface{}{"Id": id, "Config": map[string]interface{}{"Tty": false}})
+		case "/containers/" + id + "/export":
+			resp.Write([]byte("tar"))
+		case "/containers/" + id + "/logs":
+			c.Assert(req.URL.Query().Get("tail"), Equals, "100")
+			for _, line := range []string{"out\n", "err\n"} {
+				header := make([]byte, 8)
+				header[0] = 1
+				binary.BigEndian.PutUint32(header[4:], uint32(len(line)))
+				resp.Write(append(header, line...))
+			}
+		default:
+			resp.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	engine, err := new_docker_engine(DockerSettings{DockerPort: server.URL})
+	c.Assert(err, Equals, nil)
+
+	c.Assert(valid_export_destination("file:///var/exports"), Equals, true)
+	c.Assert(valid_export_destination("https://forensics"), Equals, true)
+	c.Assert(valid_export_destination("/var/exports"), Equals, false)
+
+	dir := c.MkDir()
+	export := &container_export{domain: "test.com", service: "batch", id: id, logLines: 100, retention: 2, engine: engine}
+	for i := 0; i < 3; i++ {
+		// a previous export, as named by the time
+		os.Mkdir(filepath.Join(dir, export.name(time.Now().Add(-time.Duration(i+1)*time.Hour))), 0700)
+	}
+	os.Mkdir(filepath.Join(dir, "test.com_other-20150101T000000Z-aaaaaaaaaaaa"), 0700)
+	os.Mkdir(filepath.Join(dir, "test.com_batch-api-20150101T000000Z-aaaaaaaaaaaa"), 0700)
+
+	c.Assert(export.Export("file://"+dir), Equals, nil)
+
+	entries, err := ioutil.ReadDir(dir)
+	c.Assert(err, Equals, nil)
+	c.Assert(len(entries), Equals, 4) // 2 kept of the service, and the other services
+	latest := filepath.Join(dir, entries[1].Name())
+	log, err := ioutil.ReadFile(filepath.Join(latest, export_log))
+	c.Assert(err, Equals, nil)
+	c.Assert(string(log), Equals, "out\nerr\n")
+	tar, err := ioutil.ReadFile(filepath.Join(latest, export_filesystem))
+	c.Assert(err, Equals, nil)
+	c.Assert(string(tar), Equals, "tar")
+
+	parts := map[string]string{}
+	receiver := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		c.Assert(req.Header.Get("X-Dash-Container"), Equals, id)
+		reader, err := req.MultipartReader()
+		c.Assert(err, Equals, nil)
+		for {
+			part, err := reader.NextPart()
+			if err != nil {
+				break
+			}
+			content, _ := ioutil.ReadAll(part)
+			parts[part.FormName()] = string(content)
+		}
+	}))
+	defer receiver.Close()
+
+	c.Assert(export.Export(receiver.URL), Equals, nil)
+	c.Assert(parts[export_filesystem], Equals, "tar")
+	c.Assert(parts[export_log], Equals, "out\nerr\n")
+	c.Assert(len(parts[export_inspect]) > 0, Equals, true)
+}
+
+func (suite *TestSuiteExport) TestExportPrefix(c *C) {
+	prefix, is := export_prefix("test.com_batch-api-20150101T000000Z-aaaaaaaaaaaa")
+	c.Assert(is, Equals, true)
+	c.Assert(prefix, Equals, "test.com_batch-api")
+	_, is = export_prefix("test.com_batch-api")
+	c.Assert(is, Equals, false)
+	_, is = export_prefix("test.com_batch-2015-01-01T00:00-aaaaaaaaaaaa")
+	c.Assert(is, Equals, false)
+}
+
+func (suite *TestSuiteExport) TestExportRetry(c *C) {
+	var lock sync.Mutex
+	exports, failing := 0, true
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch {
+		case strings.HasSuffix(req.URL.Path, "/export"):
+			exports++
+			if failing {
+				resp.WriteHeader(http.StatusInternalServerError)
+			}
+		case strings.HasSuffix(req.URL.Path, "/json"):
+			json.NewEncoder(resp).Encode(map[string]interface{}{"Config": map[string]interface{}{"Tty": true}})
+		}
+	}))
+	defer server.Close()
+
+	engine, err := new_docker_engine(DockerSettings{DockerPort: server.URL})
+	c.Assert(err, Equals, nil)
+	vacuum := NewVacuum("test.com", "batch", VacuumConfig{ExportContainer: true,
+		ExportDestination: "file://" + c.MkDir()}, nil, nil)
+	vacuum.engine = engine
+	count := func() int {
+		lock.Lock()
+		defer lock.Unlock()
+		return exports
+	}
+
+	// A failed export is retried after a doubling delay
+	id, now := "120aaaaaaaaaaaaaaaaa", time.Now()
+	c.Assert(vacuum.export(id, now), Not(Equals), nil)
+	c.Assert(vacuum.export(id, now.Add(time.Second)), Equals, ErrExportRetryLater)
+	c.Assert(vacuum.export(id, now.Add(export_retry_delay)), Not(Equals), nil)
+	c.Assert(vacuum.export(id, now.Add(2*export_retry_delay)), Equals, ErrExportRetryLater)
+	c.Assert(count(), Equals, 2)
+
+	// An export is done once, until the container is no longer to be removed
+	lock.Lock()
+	failing = false
+	lock.Unlock()
+	c.Assert(vacuum.export(id, now.Add(3*export_retry_delay)), Equals, nil)
+	c.Assert(vacuum.export(id, now.Add(3*export_retry_delay)), Equals, nil)
+	c.Assert(count(), Equals, 3)
+	vacuum.forget_exports(map[string]bool{})
+	c.Assert(len(vacuum.exported)+len(vacuum.export_retries), Equals, 0)
+}
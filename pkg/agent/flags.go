@@ -2,12 +2,26 @@ package agent
 
 import (
 	"flag"
+	"time"
 )
 
 func (this *Agent) BindFlags() {
 	flag.BoolVar(&this.selfRegister, "self_register", true, "Registers self with the registry.")
+	flag.BoolVar(&this.PlanOnly, "plan", false, "Prints what the agent would register, start, stop and vacuum, and exits.")
 	flag.IntVar(&this.ListenPort, "port", 25657, "Listening port for agent")
+	flag.Var(&this.Attributes, "attributes", "Host attributes for placement, e.g. zone=us-east-1a,disk=ssd")
+	flag.Uint64Var(&this.MinFreeDiskMB, "min_free_disk_mb", 0, "Min free disk in MB reported by the docker storage driver for starting containers, 0 to not check.")
+	flag.DurationVar(&this.ReconcileInterval, "reconcile_interval", time.Minute, "Interval between reconciliations of containers with the tracker and the registry. 0 disables.")
+	flag.StringVar(&this.StateDir, "state_dir", "", "Directory where the container states of each domain are saved and restored from on start. Empty disables.")
+	flag.DurationVar(&this.StateSaveInterval, "state_save_interval", 10*time.Second, "Interval between saves of the container states when they changed.")
+	flag.BoolVar(&this.PrePull, "prepull", true, "Pulls the image of a release in the background before its containers are started.")
+	flag.IntVar(&this.DiskVacuum.HighWatermark, "disk_vacuum_high_watermark", 0, "Percent of docker data root used to start removing unused images and containers, e.g. 85. 0 disables.")
+	flag.IntVar(&this.DiskVacuum.LowWatermark, "disk_vacuum_low_watermark", 75, "Percent of docker data root used to stop removing unused images.")
+	flag.IntVar(&this.DiskVacuum.CheckIntervalSeconds, "disk_vacuum_interval_seconds", 60, "Seconds between disk usage checks.")
+	flag.IntVar(&this.DiskVacuum.MinExitedAgeSeconds, "disk_vacuum_min_exited_age_seconds", 3600, "Exited containers younger than this, in seconds, are not removed.")
 	flag.StringVar(&this.StatusPubsubTopic, "status_topic", "", "Status pubsub topic")
+	flag.BoolVar(&this.ConfigReload, "config_reload", false, "Watches the config url and applies changes without restart.")
+	flag.DurationVar(&this.ConfigPollInterval, "config_poll_interval", 30*time.Second, "Poll interval for config urls that are not in zk.")
 
 	flag.BoolVar(&this.EnableUI, "enable_ui", false, "Enables UI")
 	flag.IntVar(&this.DockerUIPort, "dockerui_port", 25658, "Listening port for dockerui")
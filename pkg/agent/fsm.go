@@ -1,6 +1,7 @@
 package agent
 
 import (
+	"encoding/json"
 	. "github.com/infradash/dash/pkg/dash"
 )
 
@@ -42,6 +43,24 @@ func (this ContainerState) String() string {
 	return container_state_labels[this]
 }
 
+func (this ContainerState) MarshalJSON() ([]byte, error) {
+	return json.Marshal(this.String())
+}
+
+func (this *ContainerState) UnmarshalJSON(s []byte) error {
+	label := ""
+	if err := json.Unmarshal(s, &label); err != nil {
+		return err
+	}
+	for state, l := range container_state_labels {
+		if l == label {
+			*this = state
+			return nil
+		}
+	}
+	return ErrUnknownState
+}
+
 func (this ContainerState) Equals(that State) bool {
 	if typed, ok := that.(ContainerState); ok {
 		return typed == this
@@ -1,8 +1,13 @@
 package agent
 
 import (
+	"encoding/json"
+	"fmt"
+	. "github.com/infradash/dash/pkg/dash"
 	"github.com/qorio/omni/rest"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 )
 
@@ -28,7 +33,15 @@ func NewApiEndPoint(agent *Agent) (ep *EndPoint, err error) {
 	ep.engine.Bind(
 		rest.SetHandler(Methods[GetInfo], ep.GetInfo),
 		rest.SetHandler(Methods[HealthCheck], ep.HealthCheck),
+		rest.SetHandler(Methods[ListDomains], ep.ListDomains),
+		rest.SetHandler(Methods[ListServices], ep.ListServices),
+		rest.SetHandler(Methods[ListContainers], ep.ListContainers),
+		rest.SetHandler(Methods[PlanConfig], ep.PlanConfig),
+		rest.SetHandler(Methods[PlanDomains], ep.PlanDomains),
+		rest.SetHandler(Methods[GetMetrics], ep.Metrics),
+		rest.SetHandler(Methods[StreamEvents], ep.StreamEvents),
 	)
+	metrics.Collect(agent.collect_metrics)
 
 	return ep, nil
 }
@@ -59,3 +72,131 @@ func (this *EndPoint) HealthCheck(resp http.ResponseWriter, req *http.Request) {
 		return
 	}
 }
+
+func (this *EndPoint) ListDomains(resp http.ResponseWriter, req *http.Request) {
+	err := this.engine.MarshalJSON(req, this.agent.GetDomains(), resp)
+	if err != nil {
+		this.engine.HandleError(resp, req, "malformed", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (this *EndPoint) ListServices(resp http.ResponseWriter, req *http.Request) {
+	domain := this.engine.GetUrlParameter(req, "domain")
+	services, err := this.agent.GetServices(domain)
+	if err != nil {
+		this.engine.HandleError(resp, req, err.Error(), http.StatusNotFound)
+		return
+	}
+	err = this.engine.MarshalJSON(req, services, resp)
+	if err != nil {
+		this.engine.HandleError(resp, req, "malformed", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (this *EndPoint) ListContainers(resp http.ResponseWriter, req *http.Request) {
+	domain := this.engine.GetUrlParameter(req, "domain")
+	service := this.engine.GetUrlParameter(req, "service")
+	containers, err := this.agent.GetContainers(domain, service)
+	if err != nil {
+		this.engine.HandleError(resp, req, err.Error(), http.StatusNotFound)
+		return
+	}
+	err = this.engine.MarshalJSON(req, containers, resp)
+	if err != nil {
+		this.engine.HandleError(resp, req, "malformed", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (this *EndPoint) PlanConfig(resp http.ResponseWriter, req *http.Request) {
+	plans, err := this.agent.PlanConfig()
+	if err != nil {
+		this.engine.HandleError(resp, req, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = this.engine.MarshalJSON(req, plans, resp)
+	if err != nil {
+		this.engine.HandleError(resp, req, "malformed", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (this *EndPoint) PlanDomains(resp http.ResponseWriter, req *http.Request) {
+	configs := Types.DomainConfigs(req).(*[]DomainConfig)
+	err := this.engine.UnmarshalJSON(req, configs)
+	if err != nil {
+		this.engine.HandleError(resp, req, "malformed", http.StatusBadRequest)
+		return
+	}
+	plans, err := this.agent.Plan(*configs)
+	if err != nil {
+		this.engine.HandleError(resp, req, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = this.engine.MarshalJSON(req, plans, resp)
+	if err != nil {
+		this.engine.HandleError(resp, req, "malformed", http.StatusInternalServerError)
+		return
+	}
+}
+
+func (this *EndPoint) Metrics(resp http.ResponseWriter, req *http.Request) {
+	metrics.ServeHTTP(resp, req)
+}
+
+func (this *EndPoint) StreamEvents(resp http.ResponseWriter, req *http.Request) {
+	flusher, ok := resp.(http.Flusher)
+	if !ok {
+		this.engine.HandleError(resp, req, "streaming-not-supported", http.StatusInternalServerError)
+		return
+	}
+	var closed <-chan bool
+	if notifier, ok := resp.(http.CloseNotifier); ok {
+		closed = notifier.CloseNotify()
+	}
+
+	events, cancel := this.agent.Subscribe(event_filter(req.URL.Query()), 100)
+	defer cancel()
+
+	resp.Header().Set("Content-Type", "text/event-stream")
+	resp.Header().Set("Cache-Control", "no-cache")
+	resp.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case event := <-events:
+			buff, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(resp, "data: %s\n\n", buff); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-closed:
+			return
+		}
+	}
+}
+
+func event_filter(query url.Values) EventFilter {
+	filter := EventFilter{Domain: query.Get("domain"), Service: ServiceKey(query.Get("service"))}
+	for _, t := range split_query(query.Get("type")) {
+		filter.Types = append(filter.Types, EventType(t))
+	}
+	filter.Status = split_query(query.Get("status"))
+	return filter
+}
+
+func split_query(value string) []string {
+	values := []string{}
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
@@ -0,0 +1,130 @@
+package agent
+
+import (
+	"github.com/golang/glog"
+	. "github.com/infradash/dash/pkg/dash"
+	"github.com/qorio/maestro/pkg/docker"
+	"net/url"
+	"strings"
+)
+
+// Image registries -- where the images of a domain are pulled from.  Images named without a registry come from
+// the default registry of the domain, if set, instead of the docker hub.  The mirrors of a registry are tried in
+// order before the registry itself; an image pulled from a mirror is tagged with its name in the registry so
+// containers and releases refer to it the same way.  Images pinned by digest are pulled from their registry only,
+// since a digest can't be given to another name.
+
+const docker_hub = "docker.io"
+
+type ImageRegistries struct {
+	// Registry of images named without one, e.g. registry.example.com:5000
+	Default string `json:"default,omitempty"`
+
+	// Mirrors by the registry they mirror, in the order tried.  The docker hub is docker.io.
+	Mirrors map[string][]string `json:"mirrors,omitempty"`
+}
+
+// Parses the image, in the default registry unless it names one
+func (this *ImageRegistries) resolve(image string) (*ImageReference, error) {
+	ref, err := ParseImageReference(image)
+	if err != nil {
+		return nil, err
+	}
+	if this != nil && ref.Registry == "" && this.Default != "" {
+		ref.Registry = this.Default
+	}
+	return ref, nil
+}
+
+// Returns where to pull the image from, in order: its mirrors, then its registry
+func (this *ImageRegistries) sources(ref *ImageReference) []*ImageReference {
+	sources := []*ImageReference{}
+	if this != nil && ref.Digest == "" {
+		registry, repository := ref.Registry, ref.Repository
+		if registry == "" {
+			registry = docker_hub
+			if !strings.Contains(repository, "/") {
+				repository = "library/" + repository
+			}
+		}
+		for _, mirror := range this.Mirrors[registry] {
+			sources = append(sources, &ImageReference{Registry: mirror, Repository: repository, Tag: ref.Tag})
+		}
+	}
+	return append(sources, ref)
+}
+
+// Returns the image to pull.  The tag of the pull is the digest of images pinned by digest, and latest for
+// images without a tag.
+func image_to_pull(ref *ImageReference) *docker.Image {
+	tag := ref.Tag
+	switch {
+	case ref.Digest != "":
+		tag = ref.Digest
+	case tag == "":
+		tag = "latest"
+	}
+	return &docker.Image{Registry: ref.Registry, Repository: ref.Name(), Tag: tag}
+}
+
+// Returns the name to start containers of the pulled image with
+func image_name(image *docker.Image) string {
+	if strings.Contains(image.Tag, ":") {
+		return image.Repository + "@" + image.Tag
+	}
+	return image.Repository + ":" + image.Tag
+}
+
+// Pulls the image from the first of its sources that has it
+func (this *image_puller) pull_from_sources(login *docker.AuthIdentity, image *docker.Image) error {
+	ref, err := ParseImageReference(image_name(image))
+	if err != nil {
+		return err
+	}
+	this.lock.Lock()
+	registries := this.registries
+	this.lock.Unlock()
+
+	sources := []*ImageReference{ref}
+	if this.engine != nil {
+		sources = registries.sources(ref)
+	}
+	for i, source := range sources {
+		if i == len(sources)-1 {
+			break // the registry itself
+		}
+		if err = pull_image(this.docker, login_for(login, source.Registry), image_to_pull(source)); err != nil {
+			glog.Warningln("Cannot pull", ref, "from mirror", source.Registry, "Err=", err)
+			continue
+		}
+		if err = this.engine.Tag(source.String(), ref.Name(), ref.Tag); err != nil {
+			glog.Warningln("Cannot tag", source, "as", ref, "Err=", err)
+			continue
+		}
+		glog.Infoln("Pulled", ref, "from mirror", source.Registry)
+		return nil
+	}
+	return pull_image(this.docker, login, image)
+}
+
+// Returns the login to send to the registry: the login if it's for the registry, or no login at all.  Logins
+// name their registry by server address.
+func login_for(login *docker.AuthIdentity, registry string) *docker.AuthIdentity {
+	if login != nil && login.ServerAddress != "" && registry_host(login.ServerAddress) == registry {
+		return login
+	}
+	return &docker.AuthIdentity{}
+}
+
+// Returns the host of a registry address like https://registry.example.com:5000/v1/
+func registry_host(address string) string {
+	if u, err := url.Parse(address); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return strings.SplitN(address, "/", 2)[0]
+}
+
+// Gives the image another name
+func (this *docker_engine) Tag(image, repository, tag string) error {
+	return this.call("POST", "/images/"+image+"/tag?repo="+url.QueryEscape(repository)+"&tag="+url.QueryEscape(tag), nil, nil)
+}
@@ -0,0 +1,62 @@
+package agent
+
+import (
+	. "github.com/infradash/dash/pkg/dash"
+	"github.com/qorio/maestro/pkg/docker"
+	. "gopkg.in/check.v1"
+)
+
+func (suite *TestSuiteScheduler) TestImageRegistries(c *C) {
+	registries := &ImageRegistries{
+		Default: "registry.example.com:5000",
+		Mirrors: map[string][]string{
+			"docker.io":                 {"mirror1:5000", "mirror2:5000"},
+			"registry.example.com:5000": {"mirror3"},
+		},
+	}
+	ref, err := registries.resolve("infradash/dash:1.2-34")
+	c.Assert(err, Equals, nil)
+	c.Assert(ref.String(), Equals, "registry.example.com:5000/infradash/dash:1.2-34")
+
+	sources := []string{}
+	for _, s := range registries.sources(ref) {
+		sources = append(sources, s.String())
+	}
+	c.Assert(sources, DeepEquals, []string{"mirror3/infradash/dash:1.2-34", "registry.example.com:5000/infradash/dash:1.2-34"})
+
+	ref, _ = ParseImageReference("nginx:1.9")
+	sources = []string{}
+	for _, s := range registries.sources(ref) {
+		sources = append(sources, s.String())
+	}
+	c.Assert(sources, DeepEquals, []string{"mirror1:5000/library/nginx:1.9", "mirror2:5000/library/nginx:1.9", "nginx:1.9"})
+
+	// Pinned by digest
+	ref, _ = registries.resolve("infradash/dash@sha256:abc")
+	c.Assert(len(registries.sources(ref)), Equals, 1)
+	pull := image_to_pull(ref)
+	c.Assert(pull.Tag, Equals, "sha256:abc")
+	c.Assert(image_name(pull), Equals, "registry.example.com:5000/infradash/dash@sha256:abc")
+
+	// Without a tag
+	ref, _ = registries.resolve("registry:5000/dash")
+	c.Assert(image_name(image_to_pull(ref)), Equals, "registry:5000/dash:latest")
+
+	image, err := AssignContainerImageFromRegistry(&test_global{image: "registry:5000/dash:1.2"}, nil, "test.com", "dash")(0, nil)
+	c.Assert(err, Equals, nil)
+	c.Assert(*image, DeepEquals, docker.Image{Registry: "registry:5000", Repository: "registry:5000/dash", Tag: "1.2"})
+	_, err = AssignContainerImageFromRegistry(&test_global{image: "registry:5000/dash"}, nil, "test.com", "dash")(0, nil)
+	c.Assert(err, Equals, ErrNoImage)
+
+	c.Assert(image_reference("registry:5000/dash"), Equals, "registry:5000/dash:latest")
+	c.Assert(image_reference("dash:1.2@sha256:abc"), Equals, "dash@sha256:abc")
+
+	// Logins only go to the registry they're for
+	login := &docker.AuthIdentity{}
+	login.ServerAddress = "https://registry.example.com:5000/v1/"
+	c.Assert(login_for(login, "registry.example.com:5000"), Equals, login)
+	c.Assert(*login_for(login, "mirror3"), DeepEquals, docker.AuthIdentity{})
+	login.ServerAddress = ""
+	c.Assert(*login_for(login, "mirror3"), DeepEquals, docker.AuthIdentity{})
+	c.Assert(registry_host("mirror1:5000"), Equals, "mirror1:5000")
+}
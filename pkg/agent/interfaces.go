@@ -18,4 +18,13 @@ type HostContainerStates interface {
 type GlobalServiceState interface {
 	Image() (path, version, image string, err error)
 	Instances() (count int, err error)
+
+	// Containers of all the running instances beyond the global max, which should be stopped
+	Surplus(max int) (containers []string, err error)
+
+	// Attributes of the hosts of the domain, by host
+	Hosts() (map[string]HostAttributes, error)
+
+	// Registered instances of the current image, by host
+	InstancesByHost() (map[string]int, error)
 }
@@ -0,0 +1,74 @@
+package agent
+
+import (
+	. "github.com/infradash/dash/pkg/dash"
+	"strings"
+	"time"
+)
+
+// Metrics -- exported at /metrics in the Prometheus text format.  The containers by state are counted from the
+// trackers when the metrics are read.
+
+var (
+	metrics = NewMetrics()
+
+	metric_containers = metrics.Gauge("dash_agent_containers",
+		"Containers tracked by state.", "domain", "service", "state")
+	metric_synchronize = metrics.Histogram("dash_agent_synchronize_seconds",
+		"Duration of the synchronizations of schedulers.", DefaultBuckets, "domain", "service", "result")
+	metric_pull = metrics.Histogram("dash_agent_image_pull_seconds",
+		"Duration of image pulls.", DefaultBuckets, "result")
+	metric_prepull = metrics.Counter("dash_agent_prepulls_total",
+		"Pre-pulls of release images by outcome.", "domain", "service", "state")
+	metric_zk_connected = metrics.Gauge("dash_agent_zk_connected",
+		"1 if the zk session is connected, 0 otherwise.")
+	metric_zk_events = metrics.Counter("dash_agent_zk_events_total",
+		"Changes of the zk session state.", "state")
+	metric_vacuum_removed = metrics.Counter("dash_agent_vacuum_removed_total",
+		"Containers and images removed by the vacuums of services.", "domain", "service", "kind")
+	metric_disk_vacuum_removed = metrics.Counter("dash_agent_disk_vacuum_removed_total",
+		"Containers and images removed by the disk vacuum.", "kind")
+	metric_registration_failures = metrics.Counter("dash_agent_registration_failures_total",
+		"Containers that could not be registered.", "domain", "service")
+	metric_drift = metrics.Counter("dash_agent_drift_total",
+		"Drift fixed by reconciliations.", "domain", "kind")
+	metric_deadlines = metrics.Counter("dash_agent_state_deadlines_exceeded_total",
+		"Containers stuck in a state past its deadline.", "domain", "service", "state")
+	metric_event_sink_failures = metrics.Counter("dash_agent_event_sink_failures_total",
+		"Events that could not be sent to a sink.", "domain", "kind")
+)
+
+func state_label(state string) string {
+	return strings.TrimPrefix(state, "container:")
+}
+
+func observe_synchronize(domain string, service ServiceKey, start time.Time, err error) {
+	metric_synchronize.Observe(time.Since(start).Seconds(), domain, string(service), ResultLabel(err))
+}
+
+func observe_drift(domain string, drift Drift) {
+	metric_drift.Add(float64(drift.Untracked), domain, "untracked")
+	metric_drift.Add(float64(drift.Stale), domain, "stale")
+	metric_drift.Add(float64(drift.Vanished), domain, "vanished")
+	metric_drift.Add(float64(drift.MissingRegistrations), domain, "missing_registration")
+	metric_drift.Add(float64(drift.StaleRegistrations), domain, "stale_registration")
+}
+
+// Counts the tracked containers of the domains by state
+func (this *Agent) collect_metrics() {
+	this.lock.Lock()
+	domains := []*Domain{}
+	for _, domain := range this.domains {
+		domains = append(domains, domain)
+	}
+	this.lock.Unlock()
+
+	metric_containers.Reset()
+	for _, domain := range domains {
+		for _, service := range domain.tracker.Services() {
+			for _, c := range domain.tracker.Containers(service) {
+				metric_containers.Inc(domain.Domain, string(service), state_label(c.State))
+			}
+		}
+	}
+}
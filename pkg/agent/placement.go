@@ -0,0 +1,197 @@
+package agent
+
+import (
+	"encoding/json"
+	"github.com/golang/glog"
+	. "github.com/infradash/dash/pkg/dash"
+	"github.com/qorio/maestro/pkg/registry"
+	"github.com/qorio/maestro/pkg/zk"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Placement -- rules on the attributes of hosts that decide whether a host can run instances of a service.
+// Hosts publish their attributes when registering themselves under /{domain}/dash/{host}.
+
+type HostAttributes map[string]string
+
+type Placement struct {
+	// Attributes the host must have, e.g. {"disk": "ssd"}
+	Require HostAttributes `json:"require,omitempty"`
+
+	// Spread instances evenly across the values of this attribute, e.g. zone
+	SpreadBy string `json:"spread_by,omitempty"`
+
+	// Services of the domain whose instances must not run on the same host
+	AntiAffinity []ServiceKey `json:"anti_affinity,omitempty"`
+}
+
+// implements flag.Value for -attributes k1=v1,k2=v2
+func (this *HostAttributes) Set(s string) error {
+	if *this == nil {
+		*this = HostAttributes{}
+	}
+	for _, kv := range strings.Split(s, ",") {
+		if kv == "" {
+			continue
+		}
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return ErrBadHostAttributes
+		}
+		(*this)[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return nil
+}
+
+func (this *HostAttributes) String() string {
+	if this == nil {
+		return ""
+	}
+	kv := []string{}
+	for k, v := range *this {
+		kv = append(kv, k+"="+v)
+	}
+	sort.Strings(kv)
+	return strings.Join(kv, ",")
+}
+
+// Returns true if instances of the service can be started on the host.  If not, the reason is returned.
+func (this *Placement) Eligible(host string, attributes HostAttributes, local HostContainerStates,
+	global GlobalServiceState) (bool, string) {
+
+	for k, v := range this.Require {
+		if attributes[k] != v {
+			return false, "missing attribute " + k + "=" + v
+		}
+	}
+
+	for _, other := range this.AntiAffinity {
+		running := 0
+		local.VisitVersions(func(s ServiceKey, cg *ContainerGroup) {
+			if s != other {
+				return
+			}
+			for _, instance := range cg.Instances() {
+				switch instance.Current().State {
+				case Running, Starting:
+					running += 1
+				}
+			}
+		})
+		if running > 0 {
+			return false, "running instances of " + string(other)
+		}
+	}
+
+	if this.SpreadBy != "" {
+		hosts, err := global.Hosts()
+		if err != nil {
+			return false, err.Error()
+		}
+		instances, err := global.InstancesByHost()
+		if err != nil {
+			return false, err.Error()
+		}
+		hosts[host] = attributes
+		if !spread(this.SpreadBy, host, hosts, instances) {
+			return false, "spreading by " + this.SpreadBy
+		}
+	}
+	return true, ""
+}
+
+// Returns true if the host's value of the attribute has no more instances than any other value.
+func spread(attribute, host string, hosts map[string]HostAttributes, instances map[string]int) bool {
+	mine, has := hosts[host][attribute]
+	if !has {
+		return false
+	}
+	counts := map[string]int{}
+	for _, attributes := range hosts {
+		if v, has := attributes[attribute]; has {
+			counts[v] += 0
+		}
+	}
+	for h, count := range instances {
+		if v, has := hosts[h][attribute]; has {
+			counts[v] += count
+		}
+	}
+	for _, count := range counts {
+		if count < counts[mine] {
+			return false
+		}
+	}
+	return true
+}
+
+// implements GlobalServiceState
+func (this *Task) Hosts() (map[string]HostAttributes, error) {
+	hosts := map[string]HostAttributes{}
+	parent, err := this.zk.Get(registry.NewPath(this.domain, "dash").Path())
+	switch {
+	case err == zk.ErrNotExist:
+		return hosts, nil
+	case err != nil:
+		return nil, err
+	}
+	children, err := parent.Children()
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range children {
+		info := struct {
+			Agent struct {
+				Attributes HostAttributes `json:"attributes"`
+			} `json:"agent"`
+		}{}
+		if err := json.Unmarshal(child.GetValue(), &info); err != nil {
+			glog.Warningln("Cannot parse host info at", child.GetPath(), "Err=", err)
+			continue
+		}
+		hosts[child.GetBasename()] = info.Agent.Attributes
+	}
+	return hosts, nil
+}
+
+// implements GlobalServiceState
+func (this *Task) InstancesByHost() (map[string]int, error) {
+	_, version, image, err := this.Image()
+	if err != nil {
+		return nil, err
+	}
+	key, _, err := RegistryKeyValue(KImage, map[string]interface{}{
+		"Domain":  this.domain,
+		"Service": this.service,
+		"Version": version,
+		"Image":   image,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	instances := map[string]int{}
+	n, err := this.zk.Get(key)
+	switch {
+	case err == zk.ErrNotExist:
+		return instances, nil
+	case err != nil:
+		return nil, err
+	}
+	containers, err := n.FilterChildrenRecursive(func(z *zk.Node) bool {
+		return !z.IsLeaf()
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, container := range containers {
+		host, _ := ParseHostPort(container.GetValueString())
+		if host == "" {
+			host = filepath.Base(container.GetPath())
+		}
+		instances[host] += 1
+	}
+	return instances, nil
+}
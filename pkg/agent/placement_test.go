@@ -0,0 +1,44 @@
+package agent
+
+import (
+	. "github.com/infradash/dash/pkg/dash"
+	. "gopkg.in/check.v1"
+)
+
+func (suite *TestSuiteScheduler) TestPlacement(c *C) {
+	attributes := HostAttributes{}
+	c.Assert(attributes.Set("zone=us-east-1a, disk=ssd"), Equals, nil)
+	c.Assert(attributes.String(), Equals, "disk=ssd,zone=us-east-1a")
+	c.Assert(attributes.Set("zone"), Equals, ErrBadHostAttributes)
+
+	global := &test_global{
+		hosts: map[string]HostAttributes{
+			"host1": HostAttributes{"zone": "us-east-1a"},
+			"host2": HostAttributes{"zone": "us-east-1b"},
+			"host3": HostAttributes{"zone": "us-east-1b"},
+		},
+		instances: map[string]int{"host1": 1},
+	}
+	ct := NewContainerTracker("test")
+
+	placement := &Placement{Require: HostAttributes{"disk": "ssd"}}
+	ok, _ := placement.Eligible("host1", attributes, ct, global)
+	c.Assert(ok, Equals, true)
+	ok, _ = placement.Eligible("host1", HostAttributes{"zone": "us-east-1a"}, ct, global)
+	c.Assert(ok, Equals, false)
+
+	// zone us-east-1a has one already
+	placement = &Placement{SpreadBy: "zone"}
+	ok, _ = placement.Eligible("host1", global.hosts["host1"], ct, global)
+	c.Assert(ok, Equals, false)
+	ok, _ = placement.Eligible("host3", global.hosts["host3"], ct, global)
+	c.Assert(ok, Equals, true)
+
+	placement = &Placement{AntiAffinity: []ServiceKey{"postgres"}}
+	ok, _ = placement.Eligible("host1", attributes, ct, global)
+	c.Assert(ok, Equals, true)
+	ct.Running("postgres", tracked_container("120aaaaaaaaaaaaa", "postgres:9.4"))
+	ok, reason := placement.Eligible("host1", attributes, ct, global)
+	c.Assert(ok, Equals, false)
+	c.Assert(reason, Equals, "running instances of postgres")
+}
@@ -0,0 +1,241 @@
+package agent
+
+import (
+	"encoding/json"
+	"github.com/golang/glog"
+	. "github.com/infradash/dash/pkg/dash"
+	"github.com/qorio/maestro/pkg/docker"
+	"os"
+	"time"
+)
+
+// Plan -- what the agent would do with a configuration, against the live state of docker and the registry: the
+// containers each service matches and would register, and the containers its scheduler and vacuum would start,
+// stop and remove.  Nothing is executed and nothing is registered.
+
+type PlannedContainer struct {
+	Id    string `json:"id"`
+	Name  string `json:"name,omitempty"`
+	Image string `json:"image"`
+	State string `json:"state"`
+}
+
+type PlannedStart struct {
+	Image string `json:"image,omitempty"`
+	Name  string `json:"name,omitempty"`
+	Run   string `json:"run,omitempty"`
+}
+
+type ServicePlan struct {
+	Matched  []PlannedContainer `json:"matched"`
+	Register []PlannedContainer `json:"register,omitempty"`
+	Start    []PlannedStart     `json:"start,omitempty"`
+	Stop     []string           `json:"stop,omitempty"`
+	Remove   []string           `json:"remove,omitempty"`
+	Vacuum   []VacuumStep       `json:"vacuum,omitempty"`
+
+	// For services on a cron schedule
+	NextRun *time.Time `json:"next_run,omitempty"`
+
+	Error string `json:"error,omitempty"`
+}
+
+type DomainPlan struct {
+	Domain   string                      `json:"domain"`
+	Services map[ServiceKey]*ServicePlan `json:"services"`
+}
+
+// Plans the domains of the config at the agent's config url
+func (this *Agent) PlanConfig() ([]DomainPlan, error) {
+	if this.Initializer == nil {
+		return nil, ErrNoConfig
+	}
+	list, err := this.fetch_config(this.Initializer)
+	if err != nil {
+		return nil, err
+	}
+	return this.Plan(list)
+}
+
+func (this *Agent) Plan(configs []DomainConfig) ([]DomainPlan, error) {
+	all, err := this.docker.FindContainers(nil)
+	if err != nil {
+		return nil, err
+	}
+	plans := []DomainPlan{}
+	for i := range configs {
+		plan, err := this.plan_domain(&configs[i], all)
+		if err != nil {
+			return nil, err
+		}
+		plans = append(plans, *plan)
+	}
+	return plans, nil
+}
+
+// Runs the plan of the configured domains, writes it to stdout and exits.
+func (this *Agent) RunPlan() {
+	this.checkPreconditions()
+
+	err := this.ConnectServices()
+	if err != nil {
+		panic(err)
+	}
+	defer this.zk.Close()
+
+	plans, err := this.PlanConfig()
+	if err != nil {
+		panic(err)
+	}
+	buff, err := json.MarshalIndent(plans, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	os.Stdout.Write(append(buff, '\n'))
+}
+
+func (this *Agent) plan_domain(config *DomainConfig, all []*docker.Container) (*DomainPlan, error) {
+	if config.Domain == "" {
+		return nil, ErrNoDomain
+	}
+	plan := &DomainPlan{Domain: config.Domain, Services: map[ServiceKey]*ServicePlan{}}
+	service_plan := func(service ServiceKey) *ServicePlan {
+		if _, has := plan.Services[service]; !has {
+			plan.Services[service] = &ServicePlan{Matched: []PlannedContainer{}}
+		}
+		return plan.Services[service]
+	}
+
+	// Discovery
+	tracker := NewContainerTracker(config.Domain)
+	matcher := new(DiscoveryContainerMatcher).Init()
+	schedulers := map[ServiceKey]*Scheduler{}
+	for service, scheduler := range config.Services {
+		if !scheduler.QualifyByTags.Matches(this.QualifyByTags.Tags) {
+			continue
+		}
+		schedulers[service] = scheduler
+		service_plan(service)
+		matcher.C(config.Domain, service, scheduler.GetMatchContainerRule())
+	}
+	for _, c := range all {
+		for service := range matcher.Match(c) {
+			if _, has := schedulers[service]; !has {
+				continue
+			}
+			planned := PlannedContainer{Id: c.Id, Name: c.Name, Image: c.Image}
+			if track_discovered(tracker, service, c) {
+				service_plan(service).Register = append(service_plan(service).Register, planned)
+			}
+			if fsm := tracker.GetFsm(service, c); fsm != nil {
+				planned.State = fsm.Current().State.String()
+			}
+			service_plan(service).Matched = append(service_plan(service).Matched, planned)
+		}
+	}
+
+	// Scheduling, held for the jobs services wait for as the domain would
+	jobs := &Domain{Domain: config.Domain, Config: config, zk: this.zk}
+	for service, scheduler := range schedulers {
+		scheduler.Task.zk = this.zk
+		scheduler.Task.domain = config.Domain
+		scheduler.Task.service = service
+		scheduler.Task.host = this.Host
+		scheduler.Task.attributes = this.Attributes
+		scheduler.Task.registries = config.Registries
+		scheduler.local = tracker
+		scheduler.planning = true
+		if scheduler.WaitForJob != "" {
+			job := scheduler.WaitForJob
+			scheduler.job = func() (*JobOutcome, error) {
+				return jobs.JobOutcome(job)
+			}
+		}
+
+		sp := service_plan(service)
+		if scheduler.Cron != nil {
+			if cron, err := parse_cron(scheduler.Cron.Spec); err == nil {
+				next := cron.Next(time.Now())
+				sp.NextRun = &next
+			}
+		}
+
+		inbox := make(chan []Task, 8)
+		err := scheduler.Synchronize(config.Domain, service, tracker, &scheduler.Task, inbox)
+		scheduler.stop_timers()
+		close(inbox)
+		if err != nil {
+			sp.Error = err.Error()
+		}
+		for tasks := range inbox {
+			for _, task := range tasks {
+				this.plan_task(sp, &task, all)
+			}
+		}
+	}
+
+	// Vacuums
+	for service, vacuumConfig := range config.Vacuums {
+		if !vacuumConfig.QualifyByTags.Matches(this.QualifyByTags.Tags) {
+			continue
+		}
+		vacuum := NewVacuum(config.Domain, service, *vacuumConfig, tracker, this.docker)
+		vacuum.ticker.Stop()
+		if scheduler, has := config.Services[service]; has && scheduler.UpdateStrategy != nil {
+			vacuum.keepRunning = true
+		}
+		if err := vacuum.Validate(); err != nil {
+			service_plan(service).Error = err.Error()
+			continue
+		}
+		service_plan(service).Vacuum = vacuum.Plan()
+	}
+
+	glog.Infoln("Planned Domain=", config.Domain, "Services=", len(plan.Services))
+	return plan, nil
+}
+
+func (this *Agent) plan_task(plan *ServicePlan, task *Task, all []*docker.Container) {
+	switch task.stopAction {
+	case Stop:
+		plan.Stop = append(plan.Stop, task.stopContainers...)
+		return
+	case Remove:
+		plan.Remove = append(plan.Remove, task.stopContainers...)
+		return
+	}
+
+	for i, action := range task.Actions {
+		switch action.Type {
+		case Stop, Remove:
+			name, image, err := task.match_target(i, action)
+			if err != nil {
+				continue
+			}
+			for _, c := range match_containers(task.service_containers(all), name, image) {
+				if action.Type == Stop {
+					plan.Stop = append(plan.Stop, c.Id)
+				} else {
+					plan.Remove = append(plan.Remove, c.Id)
+				}
+			}
+			continue
+		}
+
+		start := PlannedStart{Run: task.run}
+		opts := action.ContainerControl
+		if task.assignImage != nil {
+			if img, err := task.assignImage(i, &opts); err == nil {
+				start.Image = image_name(img)
+			}
+		} else if opts.Config != nil {
+			if ref, err := task.registries.resolve(opts.Image); err == nil {
+				start.Image = image_name(image_to_pull(ref))
+			}
+		}
+		if task.assignName != nil && action.ContainerNameTemplate != nil {
+			start.Name = task.assignName(i, *action.ContainerNameTemplate, &opts)
+		}
+		plan.Start = append(plan.Start, start)
+	}
+}
@@ -0,0 +1,82 @@
+package agent
+
+import (
+	. "github.com/infradash/dash/pkg/dash"
+	"github.com/qorio/maestro/pkg/docker"
+	. "gopkg.in/check.v1"
+)
+
+func (suite *TestSuiteScheduler) TestPlan(c *C) {
+	old, current := "infradash/infradash:develop-1.1", "infradash/infradash:develop-1.2"
+	ct := NewContainerTracker("test")
+	ct.Running("infradash", tracked_container("120aaaaaaaaaaaaa", old))
+	ct.Running("infradash", tracked_container("121aaaaaaaaaaaaa", old))
+	ct.Stopped("infradash", tracked_container("121aaaaaaaaaaaaa", old))
+	ct.Running("infradash", tracked_container("122aaaaaaaaaaaaa", current))
+
+	vacuum := NewVacuum("test.com", "infradash", VacuumConfig{ByVersion: &VacuumByVersions{VersionsToKeep: 1}}, ct, nil)
+	vacuum.ticker.Stop()
+	steps := vacuum.Plan()
+	c.Assert(len(steps), Equals, 2)
+	actions := map[string]string{}
+	for _, step := range steps {
+		c.Assert(step.Image, Equals, old)
+		actions[step.Id] = step.Action
+	}
+	c.Assert(actions, DeepEquals, map[string]string{"120aaaaaaaaaaaaa": vacuum_stop, "121aaaaaaaaaaaaa": vacuum_remove})
+
+	vacuum.keepRunning = true
+	c.Assert(len(vacuum.Plan()), Equals, 1)
+
+	// Scaling down and typed actions
+	agent := &Agent{}
+	plan := &ServicePlan{}
+	scheduler := &Scheduler{}
+	for _, task := range scheduler.ScaleDown("test.com", "infradash", ct.Instances("infradash", current), 1) {
+		agent.plan_task(plan, &task, nil)
+	}
+	c.Assert(plan.Stop, DeepEquals, []string{"122aaaaaaaaaaaaa"})
+
+	name := "proxy"
+	ct.Running("proxy", tracked_container("130aaaaaaaaaaaaa", "infradash/proxy:1"))
+	task := &Task{service: "proxy", local: ct, Actions: []ContainerAction{{Type: Remove, ContainerNameTemplate: &name}}}
+	agent.plan_task(plan, task, []*docker.Container{
+		{Id: "130aaaaaaaaaaaaa", Name: "proxy", Image: "infradash/proxy:1"},
+		{Id: "131aaaaaaaaaaaaa", Name: "proxy", Image: "infradash/proxy:1"},
+	})
+	c.Assert(plan.Remove, DeepEquals, []string{"130aaaaaaaaaaaaa"})
+	c.Assert(len(plan.Start), Equals, 0)
+}
+
+func (suite *TestSuiteScheduler) TestPlanWaitForJob(c *C) {
+	zkc := &test_runs_zk{nodes: map[string][]byte{
+		"/test.com/api":        []byte("/test.com/api/v1"),
+		"/test.com/api/v1":     []byte("infradash/api:v1-1"),
+		"/test.com/migrate":    []byte("/test.com/migrate/v1"),
+		"/test.com/migrate/v1": []byte("infradash/migrate:v1-1"),
+	}}
+	tags := QualifyByTags{Tags: []string{"api"}}
+	start := Task{MaxAttempts: 1, Actions: []ContainerAction{{}}}
+	agent := &Agent{zk: zkc, QualifyByTags: tags}
+	config := &DomainConfig{Domain: "test.com", Services: map[ServiceKey]*Scheduler{
+		"api": &Scheduler{
+			QualifyByTags: tags,
+			Task:          start,
+			Constraint:    &Constraint{MinInstancesPerHost: ref(1)},
+			WaitForJob:    "migrate",
+		},
+		"migrate": &Scheduler{QualifyByTags: tags, Task: start, RunOnce: &RunOnceSchedule{}},
+	}}
+
+	// Held until the job of the release succeeds
+	plan, err := agent.plan_domain(config, []*docker.Container{})
+	c.Assert(err, Equals, nil)
+	c.Assert(len(plan.Services["api"].Start), Equals, 0)
+	c.Assert(len(plan.Services["migrate"].Start), Equals, 1)
+
+	zkc.nodes["/test.com/migrate/run_once/test.com_migrate_v1"] = []byte(`{"state":"succeeded"}`)
+	plan, err = agent.plan_domain(config, []*docker.Container{})
+	c.Assert(err, Equals, nil)
+	c.Assert(len(plan.Services["api"].Start), Equals, 1)
+	c.Assert(len(plan.Services["migrate"].Start), Equals, 0)
+}
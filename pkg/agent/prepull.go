@@ -0,0 +1,188 @@
+package agent
+
+import (
+	"encoding/json"
+	"github.com/golang/glog"
+	. "github.com/infradash/dash/pkg/dash"
+	"github.com/qorio/maestro/pkg/docker"
+	"github.com/qorio/maestro/pkg/zk"
+	"sync"
+	"time"
+)
+
+// Pre-pull -- pulls the image of a release in the background as soon as it's released, so the containers of
+// the release start without waiting for the download.  The state of the pull on each host is recorded under
+// /{domain}/{service}/{version}/pull/{host}, where registry -setlive can count the hosts that have the image.
+
+// Pulls images, one pull at a time for each image.  Pulls of an image in progress are joined.
+type image_puller struct {
+	docker     *docker.Docker
+	engine     *docker_engine
+	registries *ImageRegistries
+	lock       sync.Mutex
+	pulls      map[string]*image_pull
+	publish    func(Event)
+}
+
+type image_pull struct {
+	done chan bool
+	err  error
+}
+
+func new_image_puller(dockerc *docker.Docker, engine *docker_engine, registries *ImageRegistries) *image_puller {
+	return &image_puller{docker: dockerc, engine: engine, registries: registries, pulls: map[string]*image_pull{}}
+}
+
+func (this *image_puller) set_registries(registries *ImageRegistries) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.registries = registries
+}
+
+func (this *image_puller) Pull(login *docker.AuthIdentity, image *docker.Image) error {
+	key := image_name(image)
+
+	this.lock.Lock()
+	pull, has := this.pulls[key]
+	if !has {
+		pull = &image_pull{done: make(chan bool)}
+		this.pulls[key] = pull
+	}
+	this.lock.Unlock()
+
+	if has {
+		glog.Infoln("Waiting for pull in progress of", key)
+		<-pull.done
+		return pull.err
+	}
+
+	start := time.Now()
+	pull.err = this.pull_from_sources(login, image)
+	this.pulled(key, start, pull.err)
+
+	this.lock.Lock()
+	delete(this.pulls, key)
+	this.lock.Unlock()
+	close(pull.done)
+	return pull.err
+}
+
+// Pulls the current image of the service in the background and records the progress in the registry
+func (this *Domain) prepull(service ServiceKey, scheduler *Scheduler) {
+	if this.agent == nil || !this.agent.PrePull || this.puller == nil {
+		return
+	}
+	this.running.Add(1)
+	go func() {
+		defer this.running.Done()
+
+		global := &scheduler.Task
+		image, err := AssignContainerImageFromRegistry(global, this.tracker, this.Domain, service)(0, nil)
+		if err != nil {
+			glog.Warningln("Domain=", this.Domain, "Service=", service, "No image to pre-pull. Err=", err)
+			return
+		}
+		name := image_name(image)
+		path, err := pull_status_path(this.Domain, service, name, this.Host)
+		if err != nil {
+			glog.Warningln("Domain=", this.Domain, "Service=", service, "Cannot pre-pull", name, "Err=", err)
+			return
+		}
+		if status := pull_status(this.zk, path); status != nil && status.Image == name && status.State == PullCached {
+			return
+		}
+
+		status := &PullStatus{Image: name, Host: this.Host, State: PullPulling, Started: time.Now()}
+		record_pull(this.zk, path, status)
+
+		login, err := global.login(this.zk)
+		if err == nil {
+			glog.Infoln("Domain=", this.Domain, "Service=", service, "Pre-pulling", name)
+			err = this.puller.Pull(login, image)
+		}
+		finished := time.Now()
+		status.Finished, status.State = &finished, PullCached
+		if err != nil {
+			status.State, status.Error = PullFailed, err.Error()
+			ExceptionEvent(err, status, "Pre-pull failed: Image=", name)
+		}
+		glog.Infoln("Domain=", this.Domain, "Service=", service, "Pre-pull of", name, status.State)
+		metric_prepull.Inc(this.Domain, string(service), string(status.State))
+		record_pull(this.zk, path, status)
+	}()
+}
+
+// Watches the release of the service to pre-pull its image as soon as it's released, ahead of the trigger of
+// the rollout.  Returns false if the release is not watched apart from the trigger.
+func (this *Domain) watch_release(service ServiceKey, scheduler *Scheduler) bool {
+	if this.agent == nil || !this.agent.PrePull || this.puller == nil {
+		return false
+	}
+	release, err := scheduler.Task.release_path(this.zk)
+	if err != nil || release == "" {
+		glog.Warningln("Domain=", this.Domain, "Service=", service, "No release to pre-pull. Err=", err)
+		return false
+	}
+	if scheduler.TriggerPath != nil && string(*scheduler.TriggerPath) == release {
+		return false
+	}
+	err = this.triggers.AddWatcher(release, &scheduler.Task, func(e zk.Event) bool {
+		glog.Infoln("Event for release", release, e)
+		if e.State != zk.StateDisconnected {
+			this.prepull(service, scheduler)
+		}
+		return true
+	})
+	if err != nil {
+		glog.Warningln("Cannot watch release", release, "Err=", err)
+		return false
+	}
+	this.lock.Lock()
+	this.releases[service] = release
+	this.lock.Unlock()
+	return true
+}
+
+func pull_status_path(domain string, service ServiceKey, image, host string) (string, error) {
+	_, version, _, err := ParseVersion(image)
+	if err != nil {
+		return "", err
+	}
+	path, _, err := RegistryKeyValue(KPull, map[string]interface{}{
+		"Domain":  domain,
+		"Service": service,
+		"Version": version,
+		"Host":    host,
+	})
+	return path, err
+}
+
+// Returns the recorded status of the pull, or nil if there is none
+func pull_status(zkc zk.ZK, path string) *PullStatus {
+	n, err := zkc.Get(path)
+	if err != nil {
+		return nil
+	}
+	status := new(PullStatus)
+	if json.Unmarshal(n.GetValue(), status) != nil {
+		return nil
+	}
+	return status
+}
+
+func record_pull(zkc zk.ZK, path string, status *PullStatus) {
+	value, err := json.Marshal(status)
+	if err != nil {
+		return
+	}
+	n, err := zkc.Get(path)
+	switch {
+	case err == zk.ErrNotExist:
+		_, err = zkc.CreateEphemeral(path, value)
+	case err == nil:
+		err = n.Set(value)
+	}
+	if err != nil {
+		glog.Warningln("Cannot record pull status", path, "Err=", err)
+	}
+}
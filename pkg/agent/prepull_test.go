@@ -0,0 +1,39 @@
+package agent
+
+import (
+	"github.com/qorio/maestro/pkg/docker"
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+func (suite *TestSuiteScheduler) TestPrePull(c *C) {
+	path, err := pull_status_path("test.com", "infradash", "infradash/infradash:develop-1.2-34", "host1")
+	c.Assert(err, Equals, nil)
+	c.Assert(path, Equals, "/test.com/infradash/develop-1.2/pull/host1")
+
+	// A pull in progress is joined
+	puller := new_image_puller(nil, nil, nil)
+	pull := &image_pull{done: make(chan bool)}
+	puller.pulls["infradash/infradash:develop-1.2-34"] = pull
+	joined := make(chan error)
+	go func() {
+		joined <- puller.Pull(nil, &docker.Image{Repository: "infradash/infradash", Tag: "develop-1.2-34"})
+	}()
+	pull.err = ErrNoImage
+	close(pull.done)
+	c.Assert(<-joined, Equals, ErrNoImage)
+
+	// A download that completes with an error fails the pull
+	stopped := make(chan error, 1)
+	stopped <- ErrNoImage
+	c.Assert(await_pull(&docker.Image{Repository: "infradash/infradash", Tag: "develop-1.2-34"}, time.Now(), stopped),
+		Equals, ErrNoImage)
+
+	// The release watched for pre-pulls is the node of the image
+	zkc := &test_runs_zk{nodes: map[string][]byte{"/test.com/infradash": []byte("/test.com/infradash/develop")}}
+	task := &Task{domain: "test.com", service: "infradash"}
+	release, err := task.release_path(zkc)
+	c.Assert(err, Equals, nil)
+	c.Assert(release, Equals, "/test.com/infradash/develop")
+	c.Assert(task.ImagePath, Equals, "")
+}
@@ -0,0 +1,323 @@
+package agent
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	. "github.com/infradash/dash/pkg/dash"
+	"github.com/qorio/maestro/pkg/docker"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Probes -- checks whether a container is ready to take traffic (readiness) and whether it is still
+// healthy (liveness).  When a container image declares a Docker HEALTHCHECK and no probe is configured,
+// the health status reported by Docker is used instead.
+
+type HttpProbe struct {
+	Path   string `json:"path,omitempty"`
+	Port   int    `json:"port"`
+	Scheme string `json:"scheme,omitempty"`
+}
+
+type TcpProbe struct {
+	Port int `json:"port"`
+}
+
+type ExecProbe struct {
+	Command []string `json:"command"`
+}
+
+type Probe struct {
+	Http *HttpProbe `json:"http,omitempty"`
+	Tcp  *TcpProbe  `json:"tcp,omitempty"`
+	Exec *ExecProbe `json:"exec,omitempty"`
+
+	InitialDelaySeconds uint32 `json:"initial_delay_seconds,omitempty"`
+	PeriodSeconds       uint32 `json:"period_seconds,omitempty"`
+	TimeoutSeconds      uint32 `json:"timeout_seconds,omitempty"`
+
+	// Consecutive failures before a live container is considered failed
+	FailureThreshold int `json:"failure_threshold,omitempty"`
+}
+
+const (
+	health_starting = "starting"
+	health_healthy  = "healthy"
+)
+
+func (this *Probe) IsValid() bool {
+	implementations := 0
+	if this.Http != nil {
+		implementations += 1
+	}
+	if this.Tcp != nil {
+		implementations += 1
+	}
+	if this.Exec != nil && len(this.Exec.Command) > 0 {
+		implementations += 1
+	}
+	return implementations <= 1 && this.FailureThreshold >= 0
+}
+
+func (this *Probe) initial_delay() time.Duration {
+	return time.Duration(this.InitialDelaySeconds) * time.Second
+}
+
+func (this *Probe) period() time.Duration {
+	if this.PeriodSeconds == 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(this.PeriodSeconds) * time.Second
+}
+
+func (this *Probe) timeout() time.Duration {
+	if this.TimeoutSeconds == 0 {
+		return 2 * time.Second
+	}
+	return time.Duration(this.TimeoutSeconds) * time.Second
+}
+
+func (this *Probe) failure_threshold() int {
+	if this.FailureThreshold == 0 {
+		return 3
+	}
+	return this.FailureThreshold
+}
+
+// Returns true if the probe checks the container itself rather than relying on Docker's health status
+// Returns true if the probe is checked through the docker api: exec probes, and probes of the HEALTHCHECK
+func (this *Probe) needs_engine() bool {
+	return this != nil && (this.Exec != nil || !this.declared())
+}
+
+func (this *Probe) declared() bool {
+	return this.Http != nil || this.Tcp != nil || (this.Exec != nil && len(this.Exec.Command) > 0)
+}
+
+func probe_address(c *docker.Container, port int) string {
+	ip := c.Ip
+	if ip == "" {
+		ip = "127.0.0.1"
+	}
+	return net.JoinHostPort(ip, fmt.Sprintf("%d", port))
+}
+
+// Runs the probe once against the container.  Returns nil if the probe passes.
+func (this *Probe) Check(engine *docker_engine, c *docker.Container) error {
+	switch {
+	case this.Http != nil:
+		scheme := this.Http.Scheme
+		if scheme == "" {
+			scheme = "http"
+		}
+		path := this.Http.Path
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		client := &http.Client{Timeout: this.timeout()}
+		resp, err := client.Get(scheme + "://" + probe_address(c, this.Http.Port) + path)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+			return fmt.Errorf("probe-http-status-%d", resp.StatusCode)
+		}
+		return nil
+
+	case this.Tcp != nil:
+		conn, err := net.DialTimeout("tcp", probe_address(c, this.Tcp.Port), this.timeout())
+		if err != nil {
+			return err
+		}
+		conn.Close()
+		return nil
+
+	case this.Exec != nil && len(this.Exec.Command) > 0:
+		if engine == nil {
+			return ErrNoDockerEngine
+		}
+		code, err := engine.Exec(c.Id, this.Exec.Command, this.timeout())
+		if err != nil {
+			return err
+		}
+		if code != 0 {
+			return fmt.Errorf("probe-exec-exit-code-%d", code)
+		}
+		return nil
+
+	default:
+		if engine == nil {
+			return ErrNoDockerEngine
+		}
+		status, err := engine.Health(c.Id)
+		switch {
+		case err != nil:
+			return err
+		case status == health_healthy:
+			return nil
+		case status == health_starting:
+			return ErrProbeHealthStarting
+		default:
+			return ErrProbeUnhealthy
+		}
+	}
+}
+
+// Returns the readiness and liveness probes to run for a container.  A nil readiness probe means the
+// container is registered as soon as Docker reports it started.
+func (this *Domain) container_probes(spec *MatchContainerRule, c *docker.Container) (readiness, liveness *Probe) {
+	readiness, liveness = spec.ReadinessProbe, spec.LivenessProbe
+	if (readiness != nil && readiness.declared()) && (liveness != nil && liveness.declared()) {
+		return
+	}
+	if this.engine == nil {
+		return
+	}
+	// Fall back to the HEALTHCHECK of the image, if any
+	status, err := this.engine.Health(c.Id)
+	if err != nil || status == "" {
+		return
+	}
+	glog.Infoln("Container", c.Id[0:12], "has a Docker HEALTHCHECK, Status=", status)
+	if readiness == nil || !readiness.declared() {
+		health := Probe{}
+		if readiness != nil {
+			health = *readiness
+		}
+		readiness = &health
+	}
+	if liveness == nil || !liveness.declared() {
+		health := Probe{}
+		if liveness != nil {
+			health = *liveness
+		}
+		liveness = &health
+	}
+	return
+}
+
+// Probes the container until it is ready, then registers it and keeps checking its liveness.
+func (this *Domain) ProbeContainer(service ServiceKey, spec *MatchContainerRule, c *docker.Container) {
+	if this.engine == nil && spec.ReadinessProbe == nil && spec.LivenessProbe == nil {
+		this.register_container(service, spec, c)
+		return
+	}
+
+	stop := make(chan bool)
+	this.lock.Lock()
+	if previous, has := this.probes[c.Id]; has {
+		close(previous)
+	}
+	this.probes[c.Id] = stop
+	this.lock.Unlock()
+
+	this.running.Add(1)
+	go func() {
+		defer this.running.Done()
+
+		readiness, liveness := this.container_probes(spec, c)
+		defer this.end_probe(c, stop)
+
+		wait := func(d time.Duration) bool {
+			select {
+			case <-time.After(d):
+				return true
+			case <-stop:
+			case <-this.stopping:
+			}
+			return false
+		}
+
+		if readiness != nil {
+			this.set_unready(c, stop, true)
+			if !wait(readiness.initial_delay()) {
+				return
+			}
+			for {
+				err := readiness.Check(this.engine, c)
+				if err == nil {
+					break
+				}
+				glog.Infoln("Readiness probe: Service=", service, "Id=", c.Id[0:12], "Err=", err)
+				if !wait(readiness.period()) {
+					return
+				}
+			}
+			this.set_unready(c, stop, false)
+		}
+
+		if this.register_container(service, spec, c) != nil || liveness == nil {
+			return
+		}
+
+		if !wait(liveness.initial_delay()) {
+			return
+		}
+		failures := 0
+		for wait(liveness.period()) {
+			err := liveness.Check(this.engine, c)
+			switch {
+			case err == nil:
+				failures = 0
+				continue
+			case err == ErrProbeHealthStarting:
+				continue
+			}
+			failures += 1
+			glog.Warningln("Liveness probe: Service=", service, "Id=", c.Id[0:12], "Failures=", failures, "Err=", err)
+			if failures >= liveness.failure_threshold() {
+				ExceptionEvent(err, c.Id, "Liveness probe failed: Service=", service)
+				this.deregister_container(service, c)
+				this.tracker.Unhealthy(service, c, err)
+				return
+			}
+		}
+	}()
+}
+
+// Sets whether the container waits for readiness, unless a later probe of the container replaced the probe
+func (this *Domain) set_unready(c *docker.Container, probe chan bool, unready bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if current, has := this.probes[c.Id]; has && current != probe {
+		return
+	}
+	if unready {
+		this.unready[c.Id] = true
+	} else {
+		delete(this.unready, c.Id)
+	}
+}
+
+// Forgets the probe of the container when it ends, unless a later probe of the container replaced it
+func (this *Domain) end_probe(c *docker.Container, probe chan bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if current, has := this.probes[c.Id]; has && current != probe {
+		return
+	}
+	delete(this.probes, c.Id)
+	delete(this.unready, c.Id)
+}
+
+// Returns true if the container is being probed, and if it is still waiting to pass its readiness probe
+func (this *Domain) probing(c *docker.Container) (bool, bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	_, probing := this.probes[c.Id]
+	return probing, this.unready[c.Id]
+}
+
+// Stops probing a container, if it is being probed.
+func (this *Domain) StopProbe(c *docker.Container) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if stop, has := this.probes[c.Id]; has {
+		close(stop)
+		delete(this.probes, c.Id)
+	}
+}
@@ -0,0 +1,151 @@
+package agent
+
+import (
+	"encoding/json"
+	. "github.com/infradash/dash/pkg/dash"
+	"github.com/qorio/maestro/pkg/docker"
+	. "gopkg.in/check.v1"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProbe(t *testing.T) { TestingT(t) }
+
+type TestSuiteProbe struct {
+}
+
+var _ = Suite(&TestSuiteProbe{})
+
+func (suite *TestSuiteProbe) SetUpSuite(c *C) {
+}
+
+func (suite *TestSuiteProbe) TearDownSuite(c *C) {
+}
+
+func server_port(server *httptest.Server) (string, int) {
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return host, p
+}
+
+func (suite *TestSuiteProbe) TestHttpAndTcpProbes(c *C) {
+	var lock sync.Mutex
+	ready := false
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		if !ready || req.URL.Path != "/health" {
+			resp.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	host, port := server_port(server)
+	container := &docker.Container{Id: "120aaaaaaaaaaaaa", Ip: host}
+
+	probe := &Probe{Http: &HttpProbe{Path: "health", Port: port}}
+	c.Assert(probe.IsValid(), Equals, true)
+	c.Assert(probe.Check(nil, container), Not(Equals), nil)
+	lock.Lock()
+	ready = true
+	lock.Unlock()
+	c.Assert(probe.Check(nil, container), Equals, nil)
+
+	probe = &Probe{Tcp: &TcpProbe{Port: port}}
+	c.Assert(probe.Check(nil, container), Equals, nil)
+
+	c.Assert((&Probe{Tcp: &TcpProbe{}, Http: &HttpProbe{}}).IsValid(), Equals, false)
+
+	// A container without a liveness probe is no longer probed once registered
+	zkc := &test_runs_zk{nodes: map[string][]byte{}}
+	config := &DomainConfig{}
+	config.Domain = "test.com"
+	domain := NewDomain(config, zkc, nil, nil)
+	container.Image = "infradash/infradash:develop-1.2"
+	domain.ProbeContainer("infradash", &MatchContainerRule{ReadinessProbe: probe}, container)
+	domain.running.Wait()
+	probing, unready := domain.probing(container)
+	c.Assert(probing || unready, Equals, false)
+	c.Assert(len(zkc.nodes), Equals, 1)
+
+	// Probes through the docker api are refused without it
+	exec := &Scheduler{Register: &MatchContainerRule{LivenessProbe: &Probe{Exec: &ExecProbe{Command: []string{"true"}}}}}
+	c.Assert(domain.StartService("infradash", exec), Equals, ErrNoDockerEngine)
+	health := &Scheduler{Register: &MatchContainerRule{}, ReadinessProbe: &Probe{InitialDelaySeconds: 5}}
+	c.Assert(domain.StartService("infradash", health), Equals, ErrNoDockerEngine)
+}
+
+func (suite *TestSuiteProbe) TestDockerHealthAndExec(c *C) {
+	var lock sync.Mutex
+	status, exitCode := "starting", 1
+	set := func(s string, code int) {
+		lock.Lock()
+		defer lock.Unlock()
+		status, exitCode = s, code
+	}
+	hung := make(chan bool)
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		switch req.URL.Path {
+		case "/containers/120aaaaaaaaaaaaa/json":
+			json.NewEncoder(resp).Encode(map[string]interface{}{
+				"State": map[string]interface{}{"Health": map[string]interface{}{"Status": status}},
+			})
+		case "/containers/110aaaaaaaaaaaaa/json":
+			json.NewEncoder(resp).Encode(map[string]interface{}{"State": map[string]interface{}{}})
+		case "/containers/120aaaaaaaaaaaaa/exec":
+			json.NewEncoder(resp).Encode(map[string]interface{}{"Id": "exec1"})
+		case "/containers/130aaaaaaaaaaaaa/exec":
+			json.NewEncoder(resp).Encode(map[string]interface{}{"Id": "exec2"})
+		case "/exec/exec1/start", "/exec/exec2/start":
+		case "/exec/exec2/json":
+			lock.Unlock()
+			<-hung
+			lock.Lock()
+		case "/exec/exec1/json":
+			json.NewEncoder(resp).Encode(map[string]interface{}{"Running": false, "ExitCode": exitCode})
+		default:
+			resp.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	defer close(hung)
+
+	engine, err := new_docker_engine(DockerSettings{DockerPort: server.URL})
+	c.Assert(err, Equals, nil)
+
+	h, err := engine.Health("110aaaaaaaaaaaaa")
+	c.Assert(err, Equals, nil)
+	c.Assert(h, Equals, "")
+
+	container := &docker.Container{Id: "120aaaaaaaaaaaaa"}
+	health := &Probe{}
+	c.Assert(health.Check(engine, container), Equals, ErrProbeHealthStarting)
+	set("unhealthy", 1)
+	c.Assert(health.Check(engine, container), Equals, ErrProbeUnhealthy)
+	set("healthy", 1)
+	c.Assert(health.Check(engine, container), Equals, nil)
+
+	// Without declared probes, the HEALTHCHECK is used for both
+	domain := &Domain{engine: engine}
+	readiness, liveness := domain.container_probes(&MatchContainerRule{}, container)
+	c.Assert(readiness != nil && liveness != nil, Equals, true)
+	readiness, liveness = domain.container_probes(&MatchContainerRule{}, &docker.Container{Id: "110aaaaaaaaaaaaa"})
+	c.Assert(readiness == nil && liveness == nil, Equals, true)
+
+	exec := &Probe{Exec: &ExecProbe{Command: []string{"true"}}}
+	c.Assert(exec.Check(engine, container), Not(Equals), nil)
+	set("healthy", 0)
+	c.Assert(exec.Check(engine, container), Equals, nil)
+
+	// A daemon that doesn't answer fails the probe after its timeout
+	start := time.Now()
+	c.Assert(exec.Check(engine, &docker.Container{Id: "130aaaaaaaaaaaaa"}), Equals, ErrProbeTimeout)
+	c.Assert(time.Since(start) < 5*time.Second, Equals, true)
+}
@@ -0,0 +1,320 @@
+package agent
+
+import (
+	"github.com/golang/glog"
+	. "github.com/infradash/dash/pkg/dash"
+	"github.com/qorio/maestro/pkg/docker"
+	"github.com/qorio/maestro/pkg/zk"
+	"path/filepath"
+	"time"
+)
+
+// Reconcile -- the tracker and the registry follow the docker event stream, so an event missed while dockerd
+// restarts or the stream is down, or a registration that failed to be removed, leaves them out of sync for good.
+// Periodically the domain lists the containers of its services and brings the tracker and the registrations of
+// this host back in line with them.  Since drift means events were missed, the container watches are restarted.
+
+// Differences found between docker, the tracker and the registry
+type Drift struct {
+	// Running containers not tracked as such
+	Untracked int `json:"untracked"`
+
+	// Containers tracked as running that are not
+	Stale int `json:"stale"`
+
+	// Tracked containers that docker doesn't have anymore
+	Vanished int `json:"vanished"`
+
+	// Running containers without registration, and registrations of containers not running
+	MissingRegistrations int `json:"missing_registrations"`
+	StaleRegistrations   int `json:"stale_registrations"`
+}
+
+func (this Drift) Events() int {
+	return this.Untracked + this.Stale + this.Vanished
+}
+
+func (this Drift) Total() int {
+	return this.Events() + this.MissingRegistrations + this.StaleRegistrations
+}
+
+func (this *Drift) add(that Drift) {
+	this.Untracked += that.Untracked
+	this.Stale += that.Stale
+	this.Vanished += that.Vanished
+	this.MissingRegistrations += that.MissingRegistrations
+	this.StaleRegistrations += that.StaleRegistrations
+}
+
+// What to do to reconcile a service
+type reconcile_plan struct {
+	track      []*docker.Container // running but not tracked as running
+	died       []*docker.Container // tracked as running but not running
+	removed    []*docker.Container // tracked but gone
+	register   []*docker.Container // running without registration
+	deregister []string            // registry paths of containers not running
+}
+
+func (this reconcile_plan) drift() Drift {
+	return Drift{
+		Untracked:            len(this.track),
+		Stale:                len(this.died),
+		Vanished:             len(this.removed),
+		MissingRegistrations: len(this.register),
+		StaleRegistrations:   len(this.deregister),
+	}
+}
+
+// Compares the containers of a service in docker with the states in the tracker, by container id, and the
+// paths of the registrations of this host, by container id.
+func plan_reconcile(containers []*docker.Container, tracked map[string]*docker.Container, states map[string]ContainerState,
+	registered map[string][]string, registers func(*docker.Container) bool) reconcile_plan {
+
+	plan := reconcile_plan{
+		track:      []*docker.Container{},
+		died:       []*docker.Container{},
+		removed:    []*docker.Container{},
+		register:   []*docker.Container{},
+		deregister: []string{},
+	}
+	running := map[string]bool{}
+	seen := map[string]bool{}
+	for _, c := range containers {
+		seen[c.Id] = true
+		state, has := states[c.Id]
+		if c.DockerData == nil || !c.DockerData.State.Running {
+			if has && (state == Starting || state == Running) {
+				plan.died = append(plan.died, c)
+			}
+			continue
+		}
+		running[c.Id] = true
+		// A container failed while running has failed its liveness probe
+		switch {
+		case !has, state == Created, state == Stopped:
+			plan.track = append(plan.track, c)
+		case state == Running && len(registered[c.Id]) == 0 && registers(c):
+			plan.register = append(plan.register, c)
+		}
+	}
+	for id, c := range tracked {
+		if !seen[id] {
+			plan.removed = append(plan.removed, c)
+		}
+	}
+	for id, paths := range registered {
+		if !running[id] {
+			plan.deregister = append(plan.deregister, paths...)
+		}
+	}
+	return plan
+}
+
+// Reconciles the domain every interval until the domain stops
+func (this *Domain) StartReconcile(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+	this.running.Add(1)
+	go func() {
+		defer this.running.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		lost := false
+		for {
+			select {
+			case <-ticker.C:
+			case <-this.stopping:
+				return
+			}
+			drift, err := this.Reconcile()
+			switch {
+			case err != nil:
+				glog.Warningln("Domain=", this.Domain, "Cannot reconcile. Err=", err)
+				lost = true
+			case lost || drift.Events() > 0:
+				glog.Infoln("Domain=", this.Domain, "Restarting container watches. Drift=", drift)
+				lost = this.restart_container_watches() != nil
+			}
+		}
+	}()
+}
+
+// Returns the drift found, which has been fixed.
+func (this *Domain) Reconcile() (Drift, error) {
+	drift := Drift{}
+	containers, err := this.docker.FindContainers(nil)
+	if err != nil {
+		return drift, err
+	}
+	specs, err := this.GetContainerWatcherSpecs()
+	if err != nil {
+		return drift, err
+	}
+	matcher := new(DiscoveryContainerMatcher).Init()
+	for service, spec := range specs {
+		matcher.C(this.Domain, service, spec)
+	}
+	matched := map[ServiceKey][]*docker.Container{}
+	for _, c := range containers {
+		for service := range matcher.Match(c) {
+			matched[service] = append(matched[service], c)
+		}
+	}
+
+	for service, spec := range specs {
+		tracked, states := this.tracked_states(service)
+		registered, err := this.registrations(service)
+		if err != nil {
+			glog.Warningln("Domain=", this.Domain, "Service=", service, "Cannot list registrations. Err=", err)
+			registered = map[string][]string{}
+		}
+		port := spec.GetMatchContainerPort()
+		plan := plan_reconcile(matched[service], tracked, states, registered, func(c *docker.Container) bool {
+			// Not registered until ready
+			if _, unready := this.probing(c); unready {
+				return false
+			}
+			entry, _ := BuildRegistryEntry(c, port)
+			return entry != nil
+		})
+		if plan.drift().Total() > 0 {
+			glog.Warningln("Domain=", this.Domain, "Service=", service, "Drift=", plan.drift())
+		}
+		this.apply_reconcile(service, spec, plan, states)
+		drift.add(plan.drift())
+	}
+
+	this.lock.Lock()
+	this.drift.add(drift)
+	this.lock.Unlock()
+	observe_drift(this.Domain, drift)
+	return drift, nil
+}
+
+func (this *Domain) apply_reconcile(service ServiceKey, spec *MatchContainerRule, plan reconcile_plan,
+	states map[string]ContainerState) {
+
+	for _, c := range plan.track {
+		if state, has := states[c.Id]; has && state != Created {
+			this.tracker.Removed(service, c) // so it can start over
+		}
+		this.on_container_event(service, spec, docker.Start, c)
+	}
+	for _, c := range plan.died {
+		this.on_container_event(service, spec, docker.Die, c)
+	}
+	for _, c := range plan.removed {
+		switch states[c.Id] {
+		case Starting, Running, Stopping:
+			this.on_container_event(service, spec, docker.Die, c)
+		}
+		this.on_container_event(service, spec, docker.Remove, c)
+	}
+	for _, c := range plan.register {
+		if probing, _ := this.probing(c); probing {
+			// ready, and probed for liveness
+			this.register_container(service, spec, c)
+		} else {
+			this.ProbeContainer(service, spec, c)
+		}
+	}
+	for _, path := range plan.deregister {
+		err := this.zk.Delete(path)
+		glog.Infoln("Removed stale registration", path, "Err=", err)
+	}
+}
+
+// Returns the containers of the service in the tracker and their states, by container id
+func (this *Domain) tracked_states(service ServiceKey) (map[string]*docker.Container, map[string]ContainerState) {
+	tracked, states := map[string]*docker.Container{}, map[string]ContainerState{}
+	this.tracker.lock.Lock()
+	defer this.tracker.lock.Unlock()
+	this.tracker.VisitVersions(func(s ServiceKey, cg *ContainerGroup) {
+		if s != service {
+			return
+		}
+		for id, fsm := range cg.FsmById {
+			tracked[id] = &docker.Container{Id: id, Image: cg.Image}
+			states[id] = fsm.Current().State.(ContainerState)
+		}
+	})
+	return tracked, states
+}
+
+// Returns the paths of the registrations of the service by this host, by container id
+func (this *Domain) registrations(service ServiceKey) (map[string][]string, error) {
+	registered := map[string][]string{}
+	root, err := this.zk.Get("/" + this.Domain + "/" + string(service))
+	switch {
+	case err == zk.ErrNotExist:
+		return registered, nil
+	case err != nil:
+		return nil, err
+	}
+	versions, err := root.Children()
+	if err != nil {
+		return nil, err
+	}
+	for _, version := range versions {
+		containers, err := this.zk.Get(version.GetPath() + "/container")
+		if err == zk.ErrNotExist {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		entries, err := containers.ChildrenRecursive()
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if !entry.IsLeaf() {
+				continue
+			}
+			id, _ := ParseHostPort(filepath.Base(entry.GetPath()))
+			host, _ := ParseHostPort(entry.GetValueString())
+			if id != "" && host == this.Host {
+				registered[id] = append(registered[id], entry.GetPath())
+			}
+		}
+	}
+	return registered, nil
+}
+
+// Replaces the watches of the services with new ones, connected to the docker event stream again.  Services
+// whose watch failed to restart before are watched again.
+func (this *Domain) restart_container_watches() error {
+	specs, err := this.GetContainerWatcherSpecs()
+	if err != nil {
+		return err
+	}
+	this.lock.Lock()
+	watched := map[ServiceKey]bool{}
+	for service := range this.container_watchers {
+		watched[service] = true
+	}
+	for service := range this.schedulers {
+		watched[service] = true
+	}
+	this.lock.Unlock()
+
+	for service := range watched {
+		spec, has := specs[service]
+		if !has {
+			continue
+		}
+		this.StopContainerWatch(service)
+		if err = this.WatchContainer(service, spec); err != nil {
+			glog.Warningln("Domain=", this.Domain, "Service=", service, "Cannot watch containers. Err=", err)
+		}
+	}
+	return err
+}
+
+// Returns the drift found and fixed by reconciliations since the domain started
+func (this *Domain) Drift() Drift {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.drift
+}
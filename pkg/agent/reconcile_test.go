@@ -0,0 +1,67 @@
+package agent
+
+import (
+	"github.com/qorio/maestro/pkg/docker"
+	. "gopkg.in/check.v1"
+)
+
+func reconcile_container(id string, running bool) *docker.Container {
+	c := tracked_container(id, "infradash/infradash:develop-1.2")
+	c.DockerData.State.Running = running
+	return c
+}
+
+func (suite *TestSuiteScheduler) TestReconcile(c *C) {
+	containers := []*docker.Container{
+		reconcile_container("100aaaaaaaaaaaaa", true),  // untracked
+		reconcile_container("101aaaaaaaaaaaaa", true),  // created
+		reconcile_container("102aaaaaaaaaaaaa", true),  // running, not registered
+		reconcile_container("103aaaaaaaaaaaaa", true),  // failed its probe
+		reconcile_container("104aaaaaaaaaaaaa", true),  // running, registered
+		reconcile_container("105aaaaaaaaaaaaa", false), // tracked as running
+	}
+	tracked := map[string]*docker.Container{}
+	for _, id := range []string{"101aaaaaaaaaaaaa", "102aaaaaaaaaaaaa", "103aaaaaaaaaaaaa", "104aaaaaaaaaaaaa",
+		"105aaaaaaaaaaaaa", "106aaaaaaaaaaaaa"} {
+		tracked[id] = tracked_container(id, "infradash/infradash:develop-1.2")
+	}
+	states := map[string]ContainerState{
+		"101aaaaaaaaaaaaa": Created,
+		"102aaaaaaaaaaaaa": Running,
+		"103aaaaaaaaaaaaa": Failed,
+		"104aaaaaaaaaaaaa": Running,
+		"105aaaaaaaaaaaaa": Running,
+		"106aaaaaaaaaaaaa": Running, // gone
+	}
+	registered := map[string][]string{
+		"104aaaaaaaaaaaaa": {"/test.com/infradash/develop-1.2/container/104aaaaaaaaaaaaa"},
+		"105aaaaaaaaaaaaa": {"/test.com/infradash/develop-1.2/container/105aaaaaaaaaaaaa"},
+	}
+	registers := func(*docker.Container) bool { return true }
+
+	ids := func(containers []*docker.Container) []string {
+		list := []string{}
+		for _, c := range containers {
+			list = append(list, c.Id)
+		}
+		return list
+	}
+
+	plan := plan_reconcile(containers, tracked, states, registered, registers)
+	c.Assert(ids(plan.track), DeepEquals, []string{"100aaaaaaaaaaaaa", "101aaaaaaaaaaaaa"})
+	c.Assert(ids(plan.register), DeepEquals, []string{"102aaaaaaaaaaaaa"})
+	c.Assert(ids(plan.died), DeepEquals, []string{"105aaaaaaaaaaaaa"})
+	c.Assert(ids(plan.removed), DeepEquals, []string{"106aaaaaaaaaaaaa"})
+	c.Assert(plan.deregister, DeepEquals, []string{"/test.com/infradash/develop-1.2/container/105aaaaaaaaaaaaa"})
+
+	drift := plan.drift()
+	c.Assert(drift, DeepEquals, Drift{Untracked: 2, Stale: 1, Vanished: 1, MissingRegistrations: 1, StaleRegistrations: 1})
+	c.Assert(drift.Events(), Equals, 4)
+	drift.add(plan.drift())
+	c.Assert(drift.Total(), Equals, 12)
+
+	// Nothing to do once in sync
+	plan = plan_reconcile(containers[4:5], map[string]*docker.Container{"104aaaaaaaaaaaaa": tracked["104aaaaaaaaaaaaa"]},
+		states, map[string][]string{"104aaaaaaaaaaaaa": registered["104aaaaaaaaaaaaa"]}, registers)
+	c.Assert(plan.drift().Total(), Equals, 0)
+}
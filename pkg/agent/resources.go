@@ -0,0 +1,170 @@
+package agent
+
+import (
+	"github.com/golang/glog"
+	"github.com/qorio/maestro/pkg/docker"
+	"strconv"
+	"strings"
+)
+
+// Resources -- admission of containers based on the memory, cpu and disk of the host.  A start that would
+// overcommit the host is refused instead of letting the container be killed after it starts.
+
+type HostResources struct {
+	MemTotal int64  `json:"mem_total"`
+	CPUs     int    `json:"cpus"`
+	DiskFree uint64 `json:"disk_free"`
+
+	// Reserved by the running containers
+	MemCommitted       int64 `json:"mem_committed"`
+	CpuSharesCommitted int64 `json:"cpu_shares_committed"`
+}
+
+const (
+	// Docker's default cpu shares per container
+	cpu_shares_per_cpu = 1024
+)
+
+// Gathers the resources of the host from the docker daemon, which may not run on the agent's host.  The free
+// disk is known only when the storage driver reports it.
+func (this *docker_engine) Resources() (*HostResources, error) {
+	info := struct {
+		MemTotal     int64
+		NCPU         int
+		DriverStatus [][2]string
+	}{}
+	if err := this.call("GET", "/info", nil, &info); err != nil {
+		return nil, err
+	}
+
+	resources := &HostResources{
+		MemTotal: info.MemTotal,
+		CPUs:     info.NCPU,
+		DiskFree: driver_disk_free(info.DriverStatus),
+	}
+
+	running := []struct{ Id string }{}
+	if err := this.call("GET", "/containers/json", nil, &running); err != nil {
+		return nil, err
+	}
+	for _, c := range running {
+		inspect := struct {
+			Config struct {
+				Memory    int64
+				CpuShares int64
+			}
+			HostConfig struct {
+				Memory    int64
+				CpuShares int64
+			}
+		}{}
+		if err := this.call("GET", "/containers/"+c.Id+"/json", nil, &inspect); err != nil {
+			continue // may have just stopped
+		}
+		resources.MemCommitted += max64(inspect.HostConfig.Memory, inspect.Config.Memory)
+		resources.CpuSharesCommitted += max64(inspect.HostConfig.CpuShares, inspect.Config.CpuShares)
+	}
+	return resources, nil
+}
+
+// Returns nil if the host can take a container with the given control.  minDiskFree is in bytes.
+func (this *HostResources) Admit(opts *docker.ContainerControl, minDiskFree uint64) error {
+	memory, cpuShares := requested(opts)
+
+	glog.Infoln("Admission: Memory=", memory, "CpuShares=", cpuShares, "Host=", *this)
+
+	if memory > 0 {
+		if this.MemTotal > 0 && this.MemCommitted+memory > this.MemTotal {
+			return ErrInsufficientMemory
+		}
+	}
+
+	if cpuShares > 0 && this.CPUs > 0 {
+		if capacity := int64(this.CPUs * cpu_shares_per_cpu); this.CpuSharesCommitted+cpuShares > capacity {
+			return ErrInsufficientCpu
+		}
+	}
+
+	if minDiskFree > 0 && this.DiskFree > 0 && this.DiskFree < minDiskFree {
+		return ErrInsufficientDisk
+	}
+	return nil
+}
+
+// Returns the memory and cpu shares requested by the container
+func requested(opts *docker.ContainerControl) (memory, cpuShares int64) {
+	if opts.Config != nil {
+		memory, cpuShares = opts.Config.Memory, opts.Config.CPUShares
+	}
+	if opts.HostConfig != nil {
+		memory = max64(memory, opts.HostConfig.Memory)
+		cpuShares = max64(cpuShares, opts.HostConfig.CPUShares)
+	}
+	return
+}
+
+// Returns the free space of the storage driver, as in the status of devicemapper, or 0 if not reported
+func driver_disk_free(status [][2]string) uint64 {
+	for _, kv := range status {
+		if kv[0] == "Data Space Available" {
+			if size, err := parse_size(kv[1]); err == nil {
+				return size
+			}
+			glog.Warningln("Cannot parse", kv[0], kv[1])
+		}
+	}
+	return 0
+}
+
+var size_units = map[string]uint64{
+	"b": 1, "kb": 1000, "mb": 1000 * 1000, "gb": 1000 * 1000 * 1000, "tb": 1000 * 1000 * 1000 * 1000,
+	"kib": 1 << 10, "mib": 1 << 20, "gib": 1 << 30, "tib": 1 << 40,
+}
+
+// Parses sizes as formatted by docker, like 10.5 GB
+func parse_size(s string) (uint64, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return 0, ErrBadSize
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, err
+	}
+	unit, has := size_units[strings.ToLower(fields[1])]
+	if !has || value < 0 {
+		return 0, ErrBadSize
+	}
+	return uint64(value * float64(unit)), nil
+}
+
+// Admits the container if the host has the resources for it.  Without access to the docker api, all
+// containers are admitted.
+func (this *Domain) AdmitContainer(opts *docker.ContainerControl) error {
+	if this.engine == nil {
+		return nil
+	}
+	resources, err := this.engine.Resources()
+	if err != nil {
+		glog.Warningln("Cannot determine host resources. Admitting container. Err=", err)
+		return nil
+	}
+	minDiskFree := uint64(0)
+	if this.agent != nil {
+		minDiskFree = this.agent.MinFreeDiskMB * 1024 * 1024
+	}
+	err = resources.Admit(opts, minDiskFree)
+	if err != nil {
+		memory, cpuShares := requested(opts)
+		ExceptionEvent(err, opts, "Refusing to start container: Image=", opts.Image,
+			"Memory=", memory, "CpuShares=", cpuShares, "Host=", *resources)
+	}
+	return err
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,75 @@
+package agent
+
+import (
+	"encoding/json"
+	_docker "github.com/fsouza/go-dockerclient"
+	. "github.com/infradash/dash/pkg/dash"
+	"github.com/qorio/maestro/pkg/docker"
+	. "gopkg.in/check.v1"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResources(t *testing.T) { TestingT(t) }
+
+type TestSuiteResources struct {
+}
+
+var _ = Suite(&TestSuiteResources{})
+
+func (suite *TestSuiteResources) TestResourceAdmission(c *C) {
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/info":
+			json.NewEncoder(resp).Encode(map[string]interface{}{"MemTotal": 4096, "NCPU": 2,
+				"DriverStatus": [][2]string{{"Pool Name", "docker-pool"}, {"Data Space Available", "2.1 GB"}}})
+		case "/containers/json":
+			json.NewEncoder(resp).Encode([]map[string]interface{}{{"Id": "120aaaaaaaaaaaaa"}})
+		case "/containers/120aaaaaaaaaaaaa/json":
+			json.NewEncoder(resp).Encode(map[string]interface{}{
+				"HostConfig": map[string]interface{}{"Memory": 3072, "CpuShares": 1024},
+			})
+		default:
+			resp.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	engine, err := new_docker_engine(DockerSettings{DockerPort: server.URL})
+	c.Assert(err, Equals, nil)
+
+	resources, err := engine.Resources()
+	c.Assert(err, Equals, nil)
+	c.Assert(resources.MemTotal, Equals, int64(4096))
+	c.Assert(resources.MemCommitted, Equals, int64(3072))
+	c.Assert(resources.CpuSharesCommitted, Equals, int64(1024))
+	c.Assert(resources.DiskFree, Equals, uint64(2100*1000*1000))
+
+	opts := &docker.ContainerControl{Config: &_docker.Config{}, HostConfig: &_docker.HostConfig{}}
+	c.Assert(resources.Admit(opts, 0), Equals, nil)
+
+	opts.HostConfig.Memory = 2048
+	c.Assert(resources.Admit(opts, 0), Equals, ErrInsufficientMemory)
+
+	opts.HostConfig.Memory = 1024
+	opts.HostConfig.CPUShares = 1024
+	c.Assert(resources.Admit(opts, 0), Equals, nil)
+	opts.Config.CPUShares = 2048
+	c.Assert(resources.Admit(opts, 0), Equals, ErrInsufficientCpu)
+
+	resources.DiskFree = 1024
+	c.Assert(resources.Admit(&docker.ContainerControl{}, 2048), Equals, ErrInsufficientDisk)
+}
+
+func (suite *TestSuiteResources) TestParseSize(c *C) {
+	size, err := parse_size("10.5 GB")
+	c.Assert(err, Equals, nil)
+	c.Assert(size, Equals, uint64(10500*1000*1000))
+	size, err = parse_size("512 MiB")
+	c.Assert(err, Equals, nil)
+	c.Assert(size, Equals, uint64(512<<20))
+	_, err = parse_size("lots")
+	c.Assert(err, Equals, ErrBadSize)
+	c.Assert(driver_disk_free([][2]string{{"Backing Filesystem", "extfs"}}), Equals, uint64(0))
+}
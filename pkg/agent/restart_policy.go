@@ -0,0 +1,253 @@
+package agent
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	. "github.com/infradash/dash/pkg/dash"
+	"sort"
+	"time"
+)
+
+// Restart policy -- restarts failed containers of a service with exponential backoff.  Failures are counted
+// over a sliding window and forgotten once an instance has run healthy long enough.  Too many failures in the
+// window put the service in crashloop, where starts are held off until the window slides.
+
+type RestartPolicy struct {
+	InitialBackoffSeconds uint32 `json:"initial_backoff_seconds,omitempty"`
+	MaxBackoffSeconds     uint32 `json:"max_backoff_seconds,omitempty"`
+
+	// Failures within the window before the service is considered crashlooping
+	MaxFailures          int    `json:"max_failures,omitempty"`
+	FailureWindowSeconds uint32 `json:"failure_window_seconds,omitempty"`
+
+	// Running this long without failing clears the failures before it
+	HealthyResetSeconds uint32 `json:"healthy_reset_seconds,omitempty"`
+}
+
+type RestartState string
+
+const (
+	RestartOk        RestartState = "ok"
+	RestartBackoff   RestartState = "backoff"
+	RestartCrashLoop RestartState = "crashloop"
+)
+
+func (this *RestartPolicy) IsValid() bool {
+	return this.MaxFailures >= 0 && this.max_backoff() >= this.initial_backoff()
+}
+
+func (this *RestartPolicy) initial_backoff() time.Duration {
+	if this.InitialBackoffSeconds == 0 {
+		return time.Second
+	}
+	return time.Duration(this.InitialBackoffSeconds) * time.Second
+}
+
+func (this *RestartPolicy) max_backoff() time.Duration {
+	if this.MaxBackoffSeconds == 0 {
+		return 5 * time.Minute
+	}
+	return time.Duration(this.MaxBackoffSeconds) * time.Second
+}
+
+func (this *RestartPolicy) max_failures() int {
+	if this.MaxFailures == 0 {
+		return 5
+	}
+	return this.MaxFailures
+}
+
+func (this *RestartPolicy) window() time.Duration {
+	if this.FailureWindowSeconds == 0 {
+		return 10 * time.Minute
+	}
+	return time.Duration(this.FailureWindowSeconds) * time.Second
+}
+
+func (this *RestartPolicy) healthy_reset() time.Duration {
+	if this.HealthyResetSeconds == 0 {
+		return this.window()
+	}
+	return time.Duration(this.HealthyResetSeconds) * time.Second
+}
+
+// Returns the times of the failures that count against the policy, oldest first.  Removed are the times of
+// the failures of instances no longer tracked.
+func (this *RestartPolicy) failures(instances []*Fsm, removed []time.Time, now time.Time) []time.Time {
+	since := now.Add(-this.window())
+	for _, instance := range instances {
+		for i, s := range instance.History {
+			if s.State != Running {
+				continue
+			}
+			end := now
+			if i+1 < len(instance.History) {
+				end = instance.History[i+1].Started
+			}
+			if healthy := s.Started.Add(this.healthy_reset()); !end.Before(healthy) && healthy.After(since) {
+				since = healthy
+			}
+		}
+	}
+
+	failures := []time.Time{}
+	for _, instance := range instances {
+		for _, t := range failed_times(instance) {
+			if t.After(since) {
+				failures = append(failures, t)
+			}
+		}
+	}
+	for _, t := range removed {
+		if t.After(since) {
+			failures = append(failures, t)
+		}
+	}
+	sort.Sort(failure_times(failures))
+	return failures
+}
+
+// Returns the times the instance failed
+func failed_times(instance *Fsm) []time.Time {
+	times := []time.Time{}
+	for _, s := range instance.History {
+		if s.State == Failed {
+			times = append(times, s.Started)
+		}
+	}
+	return times
+}
+
+type failure_times []time.Time
+
+func (s failure_times) Len() int           { return len(s) }
+func (s failure_times) Less(i, j int) bool { return s[i].Before(s[j]) }
+func (s failure_times) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+
+// Returns the restart state and how long to wait before starting another instance.  Removed are the times of
+// the failures of instances no longer tracked.
+func (this *RestartPolicy) Check(instances []*Fsm, removed []time.Time, now time.Time) (RestartState, time.Duration) {
+	failures := this.failures(instances, removed, now)
+	count := len(failures)
+	if count == 0 {
+		return RestartOk, 0
+	}
+
+	last := failures[count-1]
+	if count >= this.max_failures() {
+		// Wait until enough failures slide out of the window
+		wait := failures[count-this.max_failures()].Add(this.window()).Sub(now)
+		if backoff := last.Add(this.max_backoff()).Sub(now); backoff > wait {
+			wait = backoff
+		}
+		return RestartCrashLoop, wait
+	}
+
+	backoff := this.initial_backoff()
+	for i := 1; i < count && backoff < this.max_backoff(); i++ {
+		backoff *= 2
+	}
+	if backoff > this.max_backoff() {
+		backoff = this.max_backoff()
+	}
+	if wait := last.Add(backoff).Sub(now); wait > 0 {
+		return RestartBackoff, wait
+	}
+	return RestartOk, 0
+}
+
+// Returns the restart state of the service
+func (this *Scheduler) RestartState() RestartState {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.restart_state
+}
+
+// Applies the restart policy.  Returns true if starting instances must wait, in which case the
+// scheduler synchronizes again after the wait.
+func (this *Scheduler) hold_restarts(domain string, service ServiceKey, image string,
+	local HostContainerStates, resync func()) bool {
+
+	instances, now := local.Instances(service, image), time.Now()
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	state, wait := this.RestartPolicy.Check(instances, this.removed_failures(image, instances, now), now)
+
+	if state != this.restart_state {
+		glog.Infoln("Domain=", domain, "Service=", service, "Image=", image, "Restart state:",
+			this.restart_state, "=>", state, "Wait=", wait)
+		if state == RestartCrashLoop {
+			ExceptionEvent(ErrCrashLoop, image, "Container failures exceeded max failures, Image=", image)
+		}
+		if this.status != nil {
+			status := map[RestartState]string{RestartOk: StatusOk, RestartBackoff: StatusWarning, RestartCrashLoop: StatusFatal}
+			this.status(Event{
+				Type:        EventRestart,
+				Status:      status[state],
+				Domain:      domain,
+				Service:     service,
+				Title:       fmt.Sprint("restart state of ", domain, "/", service, " is ", state),
+				Description: fmt.Sprint(state, ":", image, "@", "wait=", wait),
+				Data:        map[string]interface{}{"state": state, "image": image, "wait": wait.String()},
+			})
+		}
+		this.restart_state = state
+	}
+
+	if this.restart_timer != nil {
+		this.restart_timer.Stop()
+		this.restart_timer = nil
+	}
+	if wait <= 0 {
+		return false
+	}
+	if resync != nil {
+		this.restart_timer = time.AfterFunc(wait, resync)
+	}
+	return true
+}
+
+type instance_failures struct {
+	image string
+	times []time.Time
+}
+
+// Remembers the failures of the instances, since the tracker forgets the instances once removed.  Returns the
+// failures within the window of the instances of the image removed since.
+func (this *Scheduler) removed_failures(image string, instances []*Fsm, now time.Time) []time.Time {
+	if this.restart_failures == nil {
+		this.restart_failures = map[*Fsm]instance_failures{}
+	}
+	tracked := map[*Fsm]bool{}
+	for _, instance := range instances {
+		tracked[instance] = true
+		if times := failed_times(instance); len(times) > 0 {
+			this.restart_failures[instance] = instance_failures{image: image, times: times}
+		}
+	}
+
+	since := now.Add(-this.RestartPolicy.window())
+	removed := []time.Time{}
+	for instance, failures := range this.restart_failures {
+		if tracked[instance] {
+			continue
+		}
+		kept := []time.Time{}
+		for _, t := range failures.times {
+			if t.After(since) {
+				kept = append(kept, t)
+			}
+		}
+		if len(kept) == 0 {
+			delete(this.restart_failures, instance)
+			continue
+		}
+		this.restart_failures[instance] = instance_failures{image: failures.image, times: kept}
+		if failures.image == image {
+			removed = append(removed, kept...)
+		}
+	}
+	return removed
+}
@@ -0,0 +1,74 @@
+package agent
+
+import (
+	. "github.com/infradash/dash/pkg/dash"
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+func failed_instance(started, failed time.Time) *Fsm {
+	fsm := ContainerFsm.Instance(Starting)
+	fsm.Next(Running, "", nil)
+	fsm.Next(Failed, "", nil)
+	fsm.History[0].Started = started
+	fsm.History[1].Started = started
+	fsm.History[2].Started = failed
+	return fsm
+}
+
+func (suite *TestSuiteScheduler) TestRestartPolicy(c *C) {
+	policy := &RestartPolicy{
+		InitialBackoffSeconds: 10,
+		MaxBackoffSeconds:     60,
+		MaxFailures:           3,
+		FailureWindowSeconds:  600,
+		HealthyResetSeconds:   300,
+	}
+	c.Assert(policy.IsValid(), Equals, true)
+	c.Assert((&RestartPolicy{InitialBackoffSeconds: 600}).IsValid(), Equals, false)
+
+	now := time.Now()
+	at := func(seconds int) time.Time { return now.Add(time.Duration(seconds) * time.Second) }
+
+	state, wait := policy.Check([]*Fsm{}, nil, now)
+	c.Assert(state, Equals, RestartOk)
+
+	// backoff doubles with each failure in the window
+	instances := []*Fsm{failed_instance(at(-10), at(-5))}
+	state, wait = policy.Check(instances, nil, now)
+	c.Assert(state, Equals, RestartBackoff)
+	c.Assert(wait, Equals, 5*time.Second)
+
+	instances = append(instances, failed_instance(at(-4), at(-2)))
+	state, wait = policy.Check(instances, nil, now)
+	c.Assert(state, Equals, RestartBackoff)
+	c.Assert(wait, Equals, 18*time.Second)
+
+	// failures outside the window don't count
+	state, _ = policy.Check([]*Fsm{failed_instance(at(-1000), at(-900))}, nil, now)
+	c.Assert(state, Equals, RestartOk)
+
+	// too many failures in the window: crashloop until the oldest slides out of it
+	instances = append(instances, failed_instance(at(-2), at(-1)))
+	state, wait = policy.Check(instances, nil, now)
+	c.Assert(state, Equals, RestartCrashLoop)
+	c.Assert(wait, Equals, 595*time.Second)
+
+	// a healthy run clears the failures before it
+	instances = append(instances, failed_instance(at(-500), at(-100)))
+	instances[0] = failed_instance(at(-590), at(-580))
+	c.Assert(len(policy.failures(instances, nil, now)), Equals, 3)
+
+	// failures of instances removed since still count, until they slide out of the window
+	scheduler := &Scheduler{RestartPolicy: policy}
+	image := "infradash/infradash:develop-1.2"
+	failed := []*Fsm{failed_instance(at(-10), at(-5)), failed_instance(at(-4), at(-2)), failed_instance(at(-2), at(-1))}
+	c.Assert(len(scheduler.removed_failures(image, failed, now)), Equals, 0)
+	removed := scheduler.removed_failures(image, failed[2:], now)
+	c.Assert(len(removed), Equals, 2)
+	state, _ = policy.Check(failed[2:], removed, now)
+	c.Assert(state, Equals, RestartCrashLoop)
+	c.Assert(len(scheduler.removed_failures("infradash/infradash:develop-1.3", nil, now)), Equals, 0)
+	c.Assert(len(scheduler.removed_failures(image, nil, at(600))), Equals, 0)
+	c.Assert(len(scheduler.restart_failures), Equals, 0)
+}
@@ -0,0 +1,173 @@
+package agent
+
+import (
+	"github.com/golang/glog"
+	. "github.com/infradash/dash/pkg/dash"
+	"sort"
+	"time"
+)
+
+// Rolling update -- when the release changes, replaces the instances of the other versions of a service
+// a batch at a time instead of starting the new version and leaving the old ones to the vacuum.
+
+type UpdateStrategy struct {
+	// Max number of instances above the desired count while updating
+	MaxSurge int `json:"max_surge,omitempty"`
+
+	// Max number of instances below the desired count while updating
+	MaxUnavailable int `json:"max_unavailable,omitempty"`
+
+	// Seconds to wait after a step before taking the next one
+	StepWaitSeconds uint32 `json:"step_wait_seconds,omitempty"`
+}
+
+// State of an update in progress on this host
+type rollout struct {
+	image    string
+	desired  int
+	stopping map[string]bool
+	last     time.Time
+	timer    *time.Timer
+}
+
+func (this *UpdateStrategy) IsValid() bool {
+	return this.MaxSurge >= 0 && this.MaxUnavailable >= 0 && this.MaxSurge+this.MaxUnavailable > 0
+}
+
+// Returns how many new instances to start and old instances to stop in the next step.  Nothing is done
+// while new instances are still starting.
+func (this *UpdateStrategy) step(desired, newRunning, newStarting, oldActive int) (start, stop int) {
+	if newStarting > 0 {
+		return 0, 0
+	}
+
+	// Old instances can be stopped as long as enough instances remain available
+	stop = newRunning + oldActive - (desired - this.MaxUnavailable)
+	switch {
+	case stop < 0:
+		stop = 0
+	case stop > oldActive:
+		stop = oldActive
+	}
+
+	// New instances can be started as long as the total stays within the surge
+	start = desired + this.MaxSurge - (newRunning + oldActive - stop)
+	if remaining := desired - newRunning; start > remaining {
+		start = remaining
+	}
+	if start < 0 {
+		start = 0
+	}
+	return start, stop
+}
+
+// Returns the running or starting instances of the versions of a service other than image, oldest first.
+func other_versions(local HostContainerStates, service ServiceKey, image string) []*Fsm {
+	groups := MinVersionHeap{}
+	local.VisitVersions(func(s ServiceKey, cg *ContainerGroup) {
+		if s == service && cg.Image != image {
+			groups = append(groups, cg)
+		}
+	})
+	sort.Sort(groups)
+
+	active := []*Fsm{}
+	for _, cg := range groups {
+		for _, instance := range cg.Instances() {
+			switch instance.Current().State {
+			case Running, Starting:
+				active = append(active, instance)
+			}
+		}
+	}
+	return active
+}
+
+// Computes the next step of a rolling update.  Returns false if there is no update in progress, in
+// which case the scheduler should schedule as usual.
+func (this *Scheduler) rolling_update(domain string, service ServiceKey, image string,
+	local HostContainerStates, global GlobalServiceState, resync func()) (bool, []Task) {
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	newRunning, newStarting := 0, 0
+	for _, instance := range local.Instances(service, image) {
+		switch instance.Current().State {
+		case Running:
+			newRunning += 1
+		case Starting:
+			newStarting += 1
+		}
+	}
+
+	if this.rollout == nil || this.rollout.image != image {
+		old := other_versions(local, service, image)
+		if len(old) == 0 {
+			this.cancel_rollout()
+			return false, nil
+		}
+		this.cancel_rollout()
+		this.rollout = &rollout{
+			image:    image,
+			desired:  len(old) + newRunning + newStarting,
+			stopping: map[string]bool{},
+		}
+		if this.Constraint != nil {
+			if _, _, localMax, _, err := this.Constraint.check(); err == nil && this.rollout.desired > localMax {
+				this.rollout.desired = localMax
+			}
+		}
+		glog.Infoln("Domain=", domain, "Service=", service, "Rolling update to Image=", image,
+			"Desired=", this.rollout.desired)
+	}
+
+	active, old := other_versions(local, service, image), []*Fsm{}
+	for _, instance := range active {
+		if !this.rollout.stopping[instance.CustomData.(string)] {
+			old = append(old, instance)
+		}
+	}
+
+	// Done only after the old instances we stopped are observed as stopped
+	if len(active) == 0 && newRunning >= this.rollout.desired {
+		glog.Infoln("Domain=", domain, "Service=", service, "Rolling update completed, Image=", image)
+		this.cancel_rollout()
+		return false, nil
+	}
+
+	wait := time.Duration(this.UpdateStrategy.StepWaitSeconds) * time.Second
+	if elapsed := time.Since(this.rollout.last); !this.rollout.last.IsZero() && elapsed < wait {
+		if this.rollout.timer == nil && resync != nil {
+			this.rollout.timer = time.AfterFunc(wait-elapsed, resync)
+		}
+		return true, NoActions()
+	}
+
+	start, stop := this.UpdateStrategy.step(this.rollout.desired, newRunning, newStarting, len(old))
+	glog.Infoln("Domain=", domain, "Service=", service, "Rolling update: Running=", newRunning,
+		"Starting=", newStarting, "Old=", len(old), "Start=", start, "Stop=", stop)
+
+	actions := []Task{}
+	for i := 0; i < stop; i++ {
+		containerId := old[i].CustomData.(string)
+		this.rollout.stopping[containerId] = true
+		actions = append(actions, this.StopOne(domain, service, containerId))
+	}
+	for i := 0; i < start; i++ {
+		actions = append(actions, this.StartOne(domain, service, global, local))
+	}
+	if len(actions) > 0 {
+		this.rollout.last = time.Now()
+		this.rollout.timer = nil
+	}
+	return true, actions
+}
+
+// Stops the timer of any pending step.  Must hold the lock.
+func (this *Scheduler) cancel_rollout() {
+	if this.rollout != nil && this.rollout.timer != nil {
+		this.rollout.timer.Stop()
+	}
+	this.rollout = nil
+}
@@ -0,0 +1,75 @@
+package agent
+
+import (
+	. "gopkg.in/check.v1"
+)
+
+func (suite *TestSuiteScheduler) TestUpdateStrategyStep(c *C) {
+	strategy := UpdateStrategy{MaxSurge: 1}
+	c.Assert(strategy.IsValid(), Equals, true)
+	c.Assert((&UpdateStrategy{}).IsValid(), Equals, false)
+
+	// A rolling update replaces the instances of a constraint
+	c.Assert((&Scheduler{UpdateStrategy: &strategy}).IsValid(), Equals, false)
+	c.Assert((&Scheduler{UpdateStrategy: &strategy, Constraint: &Constraint{}}).IsValid(), Equals, true)
+
+	start, stop := strategy.step(3, 0, 0, 3)
+	c.Assert([]int{start, stop}, DeepEquals, []int{1, 0})
+
+	// wait for the new instance to be running
+	start, stop = strategy.step(3, 0, 1, 3)
+	c.Assert([]int{start, stop}, DeepEquals, []int{0, 0})
+
+	start, stop = strategy.step(3, 1, 0, 3)
+	c.Assert([]int{start, stop}, DeepEquals, []int{1, 1})
+
+	start, stop = strategy.step(3, 3, 0, 1)
+	c.Assert([]int{start, stop}, DeepEquals, []int{0, 1})
+
+	strategy = UpdateStrategy{MaxUnavailable: 2}
+	start, stop = strategy.step(3, 0, 0, 3)
+	c.Assert([]int{start, stop}, DeepEquals, []int{2, 2})
+}
+
+func (suite *TestSuiteScheduler) TestRollingUpdate(c *C) {
+	scheduler := &Scheduler{
+		Constraint:     &Constraint{},
+		UpdateStrategy: &UpdateStrategy{MaxSurge: 1},
+	}
+
+	old, image := "infradash/infradash:develop-1.1", "infradash/infradash:develop-1.2"
+	ct := NewContainerTracker("test")
+	ct.Running("infradash", tracked_container("110aaaaaaaaaaaaa", old))
+	ct.Running("infradash", tracked_container("111aaaaaaaaaaaaa", old))
+
+	updating, actions := scheduler.rolling_update("test.com", "infradash", image, ct, nil, nil)
+	c.Assert(updating, Equals, true)
+	c.Assert(len(actions), Equals, 1)
+	c.Assert(len(actions[0].stopContainers), Equals, 0)
+
+	ct.Starting("infradash", tracked_container("120aaaaaaaaaaaaa", image))
+	_, actions = scheduler.rolling_update("test.com", "infradash", image, ct, nil, nil)
+	c.Assert(len(actions), Equals, 0)
+
+	// once running, replace an old instance
+	ct.Running("infradash", tracked_container("120aaaaaaaaaaaaa", image))
+	_, actions = scheduler.rolling_update("test.com", "infradash", image, ct, nil, nil)
+	c.Assert(len(actions), Equals, 2)
+	c.Assert(len(actions[0].stopContainers), Equals, 1)
+	c.Assert(len(actions[1].stopContainers), Equals, 0)
+	first := actions[0].stopContainers[0]
+
+	ct.Stopped("infradash", tracked_container(first, old))
+	ct.Running("infradash", tracked_container("121aaaaaaaaaaaaa", image))
+	_, actions = scheduler.rolling_update("test.com", "infradash", image, ct, nil, nil)
+	c.Assert(len(actions), Equals, 1)
+	c.Assert(len(actions[0].stopContainers), Equals, 1)
+	second := actions[0].stopContainers[0]
+	c.Assert(second != first, Equals, true)
+
+	// completed once the last old instance stops; scheduling goes back to the constraint
+	ct.Stopped("infradash", tracked_container(second, old))
+	updating, _ = scheduler.rolling_update("test.com", "infradash", image, ct, nil, nil)
+	c.Assert(updating, Equals, false)
+	c.Assert(scheduler.rollout == nil, Equals, true)
+}
@@ -0,0 +1,365 @@
+package agent
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
+	. "github.com/infradash/dash/pkg/dash"
+	"github.com/qorio/maestro/pkg/docker"
+	"github.com/qorio/maestro/pkg/zk"
+	"path"
+	"strings"
+	"time"
+)
+
+// Run once -- jobs like db migrations that run exactly once per value of their trigger across all agents.  The
+// agent that runs the job claims the run by creating its outcome node; since creating a node is atomic, only one
+// agent succeeds.  The node records the host, the container, its exit code and when it started and finished.
+// A job that failed is not run again for the same trigger value; delete its outcome node to run it again.
+// While the job runs, the agent owns the run with an ephemeral node; a run left running without an owner, when
+// its agent went away, is failed by the agents that see it.
+
+type JobState string
+
+const (
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+)
+
+type JobOutcome struct {
+	Trigger   string     `json:"trigger"`
+	Host      string     `json:"host"`
+	Container string     `json:"container,omitempty"`
+	State     JobState   `json:"state"`
+	ExitCode  *int       `json:"exit_code,omitempty"`
+	Started   time.Time  `json:"started"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+const (
+	// How often a service waiting for a job checks the outcome of the job
+	job_gate_poll_interval = 10 * time.Second
+
+	// How long a run may be claimed without an owner, for a restarted agent to take back the run
+	job_claim_grace = time.Minute
+)
+
+// Returns the value of the trigger, which identifies the run, and the path of the outcome of the run.  Without
+// a trigger, the job runs once per release of the service.
+func (this *Task) run_once(schedule *RunOnceSchedule) (run, path string, err error) {
+	trigger := schedule.Trigger
+	if trigger == "" {
+		trigger, _, err = RegistryKeyValue(KReleaseWatch, map[string]interface{}{
+			"Domain":  this.domain,
+			"Service": this.service,
+		})
+		if err != nil {
+			return
+		}
+	}
+	n, err := this.zk.Get(trigger)
+	if err != nil {
+		return
+	}
+	run = n.GetValueString()
+	if run == "" {
+		return "", "", ErrNoJobTrigger
+	}
+	path, _, err = RegistryKeyValue(KRunOnce, map[string]interface{}{
+		"Domain":  this.domain,
+		"Service": this.service,
+		"Run":     run_name(run),
+	})
+	return
+}
+
+// Trigger values are often paths themselves
+func run_name(run string) string {
+	return strings.Replace(strings.Trim(run, "/"), "/", "_", -1)
+}
+
+// Returns the outcome of the run at path, or nil if the run has not been claimed.
+func job_outcome(zkc zk.ZK, path string) (*JobOutcome, error) {
+	n, err := zkc.Get(path)
+	switch {
+	case err == zk.ErrNotExist:
+		return nil, nil
+	case err != nil:
+		return nil, err
+	}
+	outcome := new(JobOutcome)
+	if err := json.Unmarshal(n.GetValue(), outcome); err != nil {
+		return nil, err
+	}
+	return outcome, nil
+}
+
+// Claims the run for this host.  Returns ErrJobClaimed if another agent, or an earlier task, has claimed it.
+func (this *Task) claim_run(zkc zk.ZK) (*JobOutcome, error) {
+	outcome := &JobOutcome{Trigger: this.run, Host: this.host, State: JobRunning, Started: time.Now()}
+	value, err := json.Marshal(outcome)
+	if err != nil {
+		return nil, err
+	}
+	_, err = zkc.Create(this.runPath, value)
+	switch err {
+	case nil:
+		glog.Infoln("Claimed run", this.runPath, "Trigger=", this.run)
+		if _, err := zkc.CreateEphemeral(run_owner(this.runPath), []byte(this.host)); err != nil {
+			glog.Warningln("Cannot own run", this.runPath, "Err=", err)
+		}
+		return outcome, nil
+	case zk.ErrNodeExists:
+		return nil, ErrJobClaimed
+	}
+	return nil, err
+}
+
+// Ends the claim of a task that failed.  The run fails if the task was starting the job; otherwise the task
+// failed before the job started, and the claim is removed so the run is tried again.
+func (this *Task) end_claim(zkc zk.ZK, run *JobOutcome, starting bool, err error) {
+	switch {
+	case err == nil:
+		return
+	case starting:
+		finished := time.Now()
+		run.State, run.Error, run.Finished = JobFailed, err.Error(), &finished
+		if err := record_outcome(zkc, this.runPath, run); err != nil {
+			glog.Warningln("Cannot record outcome of", this.runPath, "Err=", err)
+		}
+	default:
+		if err := zkc.Delete(this.runPath); err != nil && err != zk.ErrNotExist {
+			glog.Warningln("Cannot remove claim of", this.runPath, "Err=", err)
+		}
+	}
+	release_run(zkc, this.runPath)
+}
+
+// Returns the path of the owner of the run.  Owners live beside the runs, not under them, since deleting a
+// run doesn't delete its children.
+func run_owner(run string) string {
+	runs := path.Dir(run)
+	return path.Join(path.Dir(runs), "run_owners", path.Base(runs)+"_"+path.Base(run))
+}
+
+// Removes the owner of a run that's no longer running
+func release_run(zkc zk.ZK, run string) {
+	if err := zkc.Delete(run_owner(run)); err != nil && err != zk.ErrNotExist {
+		glog.Warningln("Cannot release run", run, "Err=", err)
+	}
+}
+
+// Fails the run if it's been running without an owner past the grace period.  If the container of the run
+// still runs on this host, this agent restarted and owns the run again.
+func (this *Scheduler) check_run_owner(service ServiceKey, path string, outcome *JobOutcome,
+	local HostContainerStates) error {
+
+	if this.planning || outcome.State != JobRunning || time.Since(outcome.Started) < job_claim_grace {
+		return nil
+	}
+	zkc := this.Task.zk
+	owner := run_owner(path)
+	switch _, err := zkc.Get(owner); {
+	case err == nil:
+		return nil
+	case err != zk.ErrNotExist:
+		return err
+	}
+	// The run may have completed since it was read
+	outcome, err := job_outcome(zkc, path)
+	if err != nil || outcome == nil || outcome.State != JobRunning {
+		return err
+	}
+	running := false
+	if local != nil && outcome.Host == this.Task.host && outcome.Container != "" {
+		local.VisitVersions(func(s ServiceKey, cg *ContainerGroup) {
+			if s != service {
+				return
+			}
+			for _, instance := range cg.Instances() {
+				switch instance.Current().State {
+				case Running, Starting:
+					running = running || instance.CustomData == outcome.Container
+				}
+			}
+		})
+	}
+	if running {
+		glog.Infoln("Owning run", path, "of Container=", outcome.Container)
+		_, err := zkc.CreateEphemeral(owner, []byte(this.Task.host))
+		return err
+	}
+	finished := time.Now()
+	outcome.State, outcome.Error, outcome.Finished = JobFailed, ErrJobOwnerLost.Error(), &finished
+	ExceptionEvent(ErrJobOwnerLost, outcome, "Run failed: Path=", path)
+	return record_outcome(zkc, path, outcome)
+}
+
+func record_outcome(zkc zk.ZK, path string, outcome *JobOutcome) error {
+	value, err := json.Marshal(outcome)
+	if err != nil {
+		return err
+	}
+	n, err := zkc.Get(path)
+	if err != nil {
+		return err
+	}
+	return n.Set(value)
+}
+
+// Records the container running the job, unless the run completed already
+func record_container(zkc zk.ZK, path, containerId string) error {
+	outcome, err := job_outcome(zkc, path)
+	switch {
+	case err != nil:
+		return err
+	case outcome == nil || outcome.State != JobRunning || outcome.Container != "":
+		return nil
+	}
+	outcome.Container = containerId
+	return record_outcome(zkc, path, outcome)
+}
+
+// Starts the job unless the run for the current trigger value has been claimed.
+func (this *Scheduler) schedule_run_once(domain string, service ServiceKey,
+	local HostContainerStates, global GlobalServiceState, control SchedulerExecutor) error {
+
+	run, path, err := this.Task.run_once(this.RunOnce)
+	if err != nil {
+		glog.Warningln("Domain=", domain, "Service=", service, "Cannot determine run of job. Err=", err)
+		return err
+	}
+	outcome, err := job_outcome(this.Task.zk, path)
+	if err != nil {
+		return err
+	}
+	if outcome != nil {
+		glog.Infoln("Domain=", domain, "Service=", service, "Run=", run, "already claimed:", *outcome)
+		return this.check_run_owner(service, path, outcome, local)
+	}
+
+	task := this.StartOne(domain, service, global, local)
+	task.run, task.runPath = run, path
+	if control != nil {
+		control <- []Task{task}
+	}
+	return nil
+}
+
+// Returns true if the job the service waits for has succeeded for its current trigger value.  If not, the
+// scheduler synchronizes again later.
+func (this *Scheduler) hold_for_job(domain string, service ServiceKey, resync func()) bool {
+	if this.job == nil {
+		return false
+	}
+	outcome, err := this.job()
+	succeeded := err == nil && outcome != nil && outcome.State == JobSucceeded
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.job_timer != nil {
+		this.job_timer.Stop()
+		this.job_timer = nil
+	}
+	if succeeded {
+		return false
+	}
+	glog.Infoln("Domain=", domain, "Service=", service, "Waiting for Job=", this.WaitForJob,
+		"Outcome=", outcome, "Err=", err)
+	if outcome != nil && outcome.State == JobFailed {
+		ExceptionEvent(ErrJobFailed, outcome, "Rollout held: Service=", service, "Job=", this.WaitForJob)
+	}
+	if resync != nil {
+		this.job_timer = time.AfterFunc(job_gate_poll_interval, resync)
+	}
+	return true
+}
+
+// Returns the outcome of the current run of the job of the domain, or nil if it has not run yet.
+func (this *Domain) JobOutcome(job ServiceKey) (*JobOutcome, error) {
+	if this.Config == nil {
+		return nil, ErrNoJob
+	}
+	scheduler, has := this.Config.Services[job]
+	if !has || scheduler.RunOnce == nil {
+		return nil, ErrNoJob
+	}
+	task := Task{domain: this.Domain, service: job, zk: this.zk}
+	_, path, err := task.run_once(scheduler.RunOnce)
+	if err != nil {
+		return nil, err
+	}
+	return job_outcome(this.zk, path)
+}
+
+// Records the outcome of the run of a run once job or a cron schedule, if the container ran one.
+func (this *Domain) complete_job(service ServiceKey, container *docker.Container) {
+	this.lock.Lock()
+	scheduler, has := this.schedulers[service]
+	this.lock.Unlock()
+
+	runs := ""
+	switch {
+	case !has:
+		return
+	case scheduler.RunOnce != nil:
+		runs = fmt.Sprintf("/%s/%s/run_once", this.Domain, service)
+	case scheduler.Cron != nil:
+		runs = fmt.Sprintf("/%s/%s/cron", this.Domain, service)
+	default:
+		return
+	}
+	parent, err := this.zk.Get(runs)
+	if err != nil {
+		glog.Warningln("Cannot find runs of Job=", service, "Err=", err)
+		return
+	}
+	children, err := parent.Children()
+	if err != nil {
+		glog.Warningln("Cannot find runs of Job=", service, "Err=", err)
+		return
+	}
+	for _, n := range children {
+		outcome := new(JobOutcome)
+		if json.Unmarshal(n.GetValue(), outcome) != nil {
+			continue
+		}
+		// The container may die before it's recorded in the run it claimed, or after the run was failed
+		// for a lost owner
+		mine := outcome.Container == container.Id || (outcome.Container == "" && outcome.Host == this.Host)
+		lost := outcome.State == JobFailed && outcome.Error == ErrJobOwnerLost.Error()
+		if !mine || (outcome.State != JobRunning && !lost) {
+			continue
+		}
+		outcome.Container, outcome.Error = container.Id, ""
+		finished := time.Now()
+		outcome.Finished = &finished
+		outcome.State = JobFailed
+		if container.DockerData != nil {
+			code := container.DockerData.State.ExitCode
+			outcome.ExitCode = &code
+			if code == 0 {
+				outcome.State = JobSucceeded
+			}
+		}
+		if err := record_outcome(this.zk, n.GetPath(), outcome); err != nil {
+			glog.Warningln("Cannot record outcome of", n.GetPath(), "Err=", err)
+			return
+		}
+		release_run(this.zk, n.GetPath())
+		glog.Infoln("Job=", service, "Run=", outcome.Trigger, "completed:", outcome.State, "ExitCode=", outcome.ExitCode)
+		status := map[JobState]string{JobSucceeded: StatusOk, JobFailed: StatusFatal}
+		this.publish(Event{
+			Type:        EventRunOnce,
+			Status:      status[outcome.State],
+			Service:     service,
+			Title:       fmt.Sprint("run of ", this.Domain, "/", service, " ", outcome.State),
+			Description: fmt.Sprint(outcome.State, ":", outcome.Trigger, "@", outcome.Host),
+			Data:        map[string]interface{}{"outcome": outcome},
+		})
+		return
+	}
+}
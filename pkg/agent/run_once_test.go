@@ -0,0 +1,110 @@
+package agent
+
+import (
+	"github.com/qorio/maestro/pkg/zk"
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+func (suite *TestSuiteScheduler) TestRunOnce(c *C) {
+	job := &Scheduler{RunOnce: &RunOnceSchedule{Trigger: "/test.com/migrate/schema"}}
+	c.Assert(job.IsValid(), Equals, true)
+	c.Assert((&Scheduler{RunOnce: &RunOnceSchedule{}, Constraint: &Constraint{}}).IsValid(), Equals, false)
+
+	c.Assert(run_name("/test.com/api/release_1"), Equals, "test.com_api_release_1")
+	c.Assert(run_name("v42"), Equals, "v42")
+
+	// A service without a job to wait for is never held
+	service := &Scheduler{}
+	c.Assert(service.hold_for_job("test.com", "api", nil), Equals, false)
+
+	var outcome *JobOutcome
+	service = &Scheduler{WaitForJob: "migrate", job: func() (*JobOutcome, error) { return outcome, nil }}
+	c.Assert(service.hold_for_job("test.com", "api", nil), Equals, true)
+
+	outcome = &JobOutcome{Trigger: "v42", State: JobRunning}
+	c.Assert(service.hold_for_job("test.com", "api", nil), Equals, true)
+
+	outcome.State = JobFailed
+	c.Assert(service.hold_for_job("test.com", "api", nil), Equals, true)
+
+	outcome.State = JobSucceeded
+	c.Assert(service.hold_for_job("test.com", "api", nil), Equals, false)
+
+	// Checked again later while held
+	resynced := make(chan bool, 1)
+	outcome = nil
+	c.Assert(service.hold_for_job("test.com", "api", func() { resynced <- true }), Equals, true)
+	c.Assert(service.job_timer, Not(Equals), (*time.Timer)(nil))
+	service.job_timer.Stop()
+}
+
+func (suite *TestSuiteScheduler) TestRunOwner(c *C) {
+	c.Assert(run_owner("/test.com/migrate/run_once/v42"), Equals, "/test.com/migrate/run_owners/run_once_v42")
+	c.Assert(run_owner("/test.com/backup/cron/2015-06-01T00:00:00Z"), Equals,
+		"/test.com/backup/run_owners/cron_2015-06-01T00:00:00Z")
+
+	zkc := &test_runs_zk{nodes: map[string][]byte{}}
+	task := &Task{host: "host1", run: "v42", runPath: "/test.com/migrate/run_once/v42"}
+	run, err := task.claim_run(zkc)
+	c.Assert(err, Equals, nil)
+	c.Assert(run.State, Equals, JobRunning)
+	c.Assert(string(zkc.nodes[run_owner(task.runPath)]), Equals, "host1")
+	_, err = task.claim_run(zkc)
+	c.Assert(err, Equals, ErrJobClaimed)
+
+	// A task failing before the job starts gives the run back
+	task.end_claim(zkc, run, false, ErrGlobalMaxInstances)
+	c.Assert(zkc.nodes, DeepEquals, map[string][]byte{})
+
+	// An owned run, or a run just claimed, is left alone
+	scheduler := &Scheduler{Task: Task{host: "host1", zk: zkc}}
+	outcome := &JobOutcome{Host: "host1", Container: "120aaaaaaaaaaaaa", State: JobRunning, Started: time.Now()}
+	zkc.nodes[task.runPath] = []byte(`{"host":"host1","container":"120aaaaaaaaaaaaa","state":"running"}`)
+	c.Assert(scheduler.check_run_owner("migrate", task.runPath, outcome, nil), Equals, nil)
+	outcome.Started = time.Now().Add(-2 * job_claim_grace)
+	zkc.nodes[run_owner(task.runPath)] = []byte("host1")
+	c.Assert(scheduler.check_run_owner("migrate", task.runPath, outcome, nil), Equals, nil)
+
+	// A restarted agent owns the run of its container again
+	delete(zkc.nodes, run_owner(task.runPath))
+	ct := NewContainerTracker("test")
+	ct.Running("migrate", tracked_container("120aaaaaaaaaaaaa", "infradash/migrate:v42"))
+	c.Assert(scheduler.check_run_owner("migrate", task.runPath, outcome, ct), Equals, nil)
+	c.Assert(string(zkc.nodes[run_owner(task.runPath)]), Equals, "host1")
+}
+
+// Keeps the values of nodes without a connection; nodes can be created and removed but not set
+
+type test_runs_zk struct {
+	zk.ZK
+	nodes map[string][]byte
+}
+
+func (this *test_runs_zk) Get(path string) (*zk.Node, error) {
+	value, has := this.nodes[path]
+	if !has {
+		return nil, zk.ErrNotExist
+	}
+	return &zk.Node{Path: path, Value: value}, nil
+}
+
+func (this *test_runs_zk) Create(path string, value []byte) (*zk.Node, error) {
+	if _, has := this.nodes[path]; has {
+		return nil, zk.ErrNodeExists
+	}
+	this.nodes[path] = value
+	return &zk.Node{Path: path, Value: value}, nil
+}
+
+func (this *test_runs_zk) CreateEphemeral(path string, value []byte) (*zk.Node, error) {
+	return this.Create(path, value)
+}
+
+func (this *test_runs_zk) Delete(path string) error {
+	if _, has := this.nodes[path]; !has {
+		return zk.ErrNotExist
+	}
+	delete(this.nodes, path)
+	return nil
+}
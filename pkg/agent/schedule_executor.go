@@ -9,21 +9,25 @@ import (
 type ScheduleExecutor struct {
 	Inbox chan<- []Task
 	Stop  chan<- bool
+	Done  <-chan bool // closed when the executor has stopped
 
 	inbox chan []Task
 	stop  chan bool
+	done  chan bool
 
 	zk     zk.ZK
 	docker *docker.Docker
 }
 
 func NewScheduleExecutor(zk zk.ZK, docker *docker.Docker) *ScheduleExecutor {
-	inbox, stop := make(chan []Task), make(chan bool)
+	inbox, stop, done := make(chan []Task), make(chan bool, 1), make(chan bool)
 	return &ScheduleExecutor{
 		Inbox:  inbox,
 		Stop:   stop,
+		Done:   done,
 		inbox:  inbox,
 		stop:   stop,
+		done:   done,
 		zk:     zk,
 		docker: docker,
 	}
@@ -31,18 +35,29 @@ func NewScheduleExecutor(zk zk.ZK, docker *docker.Docker) *ScheduleExecutor {
 
 func (this *ScheduleExecutor) Run() error {
 	go func() {
+		defer close(this.done)
 		for {
 			select {
 			case actions := <-this.inbox:
 				for i, action := range actions {
 					glog.Infoln(i, "**************************************************")
 					action.Execute(this.zk, this.docker)
+
+					// Don't start the remaining actions if we are asked to stop
+					select {
+					case stop := <-this.stop:
+						if stop {
+							glog.Infoln("Stopping schedule executor. Skipped", len(actions)-i-1, "actions")
+							return
+						}
+					default:
+					}
 				}
 
 			case stop := <-this.stop:
 				if stop {
 					glog.Infoln("Stopping schedule executor")
-					break
+					return
 				}
 			}
 		}
@@ -6,8 +6,9 @@ import (
 	. "github.com/infradash/dash/pkg/dash"
 	"github.com/qorio/maestro/pkg/docker"
 	"github.com/qorio/maestro/pkg/zk"
-	"strings"
+	"sort"
 	"text/template"
+	"time"
 )
 
 var (
@@ -31,36 +32,58 @@ func get_sequence_by_image(image string) int {
 func AssignContainerNameFromRegistry(global GlobalServiceState, local HostContainerStates,
 	domain string, service ServiceKey) AssignContainerName {
 	return func(step int, _template string, opts *docker.ContainerControl) string {
-		if _, _, image, err := global.Image(); err == nil {
-
-			context := map[string]interface{}{
-				"Step":     step,
-				"Sequence": get_sequence_by_image(image),
-				"Running":  len(local.Instances(service, image)),
-				"Domain":   domain,
-				"Service":  service,
-				"Image":    image,
-				"Tag":      "",
-			}
-			if _, tag, err := ParseDockerImage(image); err == nil {
-				context["Tag"] = tag
-			}
-			if repo, version, build, err := ParseVersion(image); err == nil {
-				context["Repo"] = repo
-				context["Version"] = version
-				context["Build"] = build
-			}
+		return container_name(global, local, domain, service, step, _template, true)
+	}
+}
 
-			// Apply the template
-			if cname, err := template.New(_template).Parse(_template); err == nil {
-				var buff bytes.Buffer
-				if err = cname.Execute(&buff, context); err == nil {
-					return buff.String()
-				}
-			}
-		}
+// Names the containers that stop and remove actions match.  The name resolves against the current release,
+// without Sequence and Running, which number the containers as they start; templates using them match nothing.
+func MatchContainerNameFromRegistry(global GlobalServiceState, local HostContainerStates,
+	domain string, service ServiceKey) AssignContainerName {
+	return func(step int, _template string, opts *docker.ContainerControl) string {
+		return container_name(global, local, domain, service, step, _template, false)
+	}
+}
+
+func container_name(global GlobalServiceState, local HostContainerStates,
+	domain string, service ServiceKey, step int, _template string, starting bool) string {
+
+	_, _, image, err := global.Image()
+	if err != nil {
 		return ""
 	}
+	context := map[string]interface{}{
+		"Step":    step,
+		"Domain":  domain,
+		"Service": service,
+		"Image":   image,
+		"Tag":     "",
+	}
+	if starting {
+		context["Sequence"] = get_sequence_by_image(image)
+		context["Running"] = len(local.Instances(service, image))
+	}
+	if _, tag, err := ParseDockerImage(image); err == nil {
+		context["Tag"] = tag
+	}
+	if repo, version, build, err := ParseVersion(image); err == nil {
+		context["Repo"] = repo
+		context["Version"] = version
+		context["Build"] = build
+	}
+
+	// Apply the template
+	cname := template.New(_template)
+	if !starting {
+		cname = cname.Option("missingkey=error")
+	}
+	if cname, err := cname.Parse(_template); err == nil {
+		var buff bytes.Buffer
+		if err = cname.Execute(&buff, context); err == nil {
+			return buff.String()
+		}
+	}
+	return ""
 }
 
 func AssignContainerImageFromRegistry(global GlobalServiceState, local HostContainerStates,
@@ -74,16 +97,11 @@ func AssignContainerImageFromRegistry(global GlobalServiceState, local HostConta
 			return nil, ErrNoImage
 		}
 
-		k := strings.LastIndex(new_image, ":")
-		if k < 0 {
+		ref, err := ParseImageReference(new_image)
+		if err != nil || ref.Version() == "" {
 			return nil, ErrNoImage
 		}
-		repository, tag := new_image[0:k], new_image[k+1:]
-		return &docker.Image{
-			Registry:   "https://index.docker.io",
-			Repository: repository,
-			Tag:        tag,
-		}, nil
+		return image_to_pull(ref), nil
 	}
 }
 
@@ -93,17 +111,56 @@ func (this *Scheduler) GetMatchContainerRule() *MatchContainerRule {
 	if this.Register == nil {
 		this.Register = &MatchContainerRule{}
 	}
+	if this.Register.ReadinessProbe == nil {
+		this.Register.ReadinessProbe = this.ReadinessProbe
+	}
+	if this.Register.LivenessProbe == nil {
+		this.Register.LivenessProbe = this.LivenessProbe
+	}
 	// TODO - infer this...
 	return this.Register
 }
 
+// Runs the scheduler until true is sent on stopper.  The done channel is closed when the scheduler has stopped.
 func (this *Scheduler) Run(domain string, service ServiceKey, global GlobalServiceState,
-	channel HostContainerStatesChanged, stopper <-chan bool, inbox SchedulerExecutor) error {
+	channel HostContainerStatesChanged, stopper <-chan bool, done chan<- bool, inbox SchedulerExecutor) error {
+
+	var cron *cron_expression
+	if this.Cron != nil {
+		expr, err := parse_cron(this.Cron.Spec)
+		if err != nil {
+			return err
+		}
+		cron = expr
+	}
 
 	go func() {
+		defer close(done)
 		glog.Infoln("Starting scheduler for Service=", service)
+
+		var fire <-chan time.Time
+		var scheduled time.Time
+		next_run := func() {
+			if cron == nil {
+				return
+			}
+			if scheduled = cron.Next(time.Now()); !scheduled.IsZero() {
+				fire = time.After(scheduled.Sub(time.Now()))
+				glog.Infoln("Service=", service, "Next cron run at", scheduled)
+			}
+		}
+		next_run()
+
 		for {
 			select {
+			case <-fire:
+
+				err := this.run_cron(domain, service, scheduled, this.local, global, inbox)
+				if err != nil {
+					glog.Warningln("Error while running cron of Service=", service, "Err=", err)
+				}
+				next_run()
+
 			case local := <-channel:
 
 				glog.Infoln("ContainerStates changed. Synchronize.")
@@ -115,15 +172,30 @@ func (this *Scheduler) Run(domain string, service ServiceKey, global GlobalServi
 			case stop := <-stopper:
 
 				if stop {
-					break
+					glog.Infoln("Stop: scheduler for Service=", service)
+					this.stop_timers()
+					return
 				}
 			}
 		}
-		glog.Infoln("Stop: scheduler for Service=", service)
 	}()
 	return nil
 }
 
+// Cancels the rollout and the synchronizations scheduled for later
+func (this *Scheduler) stop_timers() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.cancel_rollout()
+	if this.restart_timer != nil {
+		this.restart_timer.Stop()
+	}
+	if this.job_timer != nil {
+		this.job_timer.Stop()
+	}
+}
+
 func count_failed_containers(local HostContainerStates, service ServiceKey, image string) int {
 	all := local.Instances(service, image)
 	count := 0
@@ -143,21 +215,72 @@ func (this *Scheduler) IsValid() bool {
 	if this.RunOnce != nil {
 		implementations += 1
 	}
+	if this.Cron != nil {
+		if !this.Cron.IsValid() {
+			return false
+		}
+		implementations += 1
+	}
+	if this.UpdateStrategy != nil && (this.Constraint == nil || !this.UpdateStrategy.IsValid()) {
+		// rolling updates replace the instances the constraint schedules
+		return false
+	}
+	if this.RestartPolicy != nil && !this.RestartPolicy.IsValid() {
+		return false
+	}
+	for _, probe := range []*Probe{this.ReadinessProbe, this.LivenessProbe} {
+		if probe != nil && !probe.IsValid() {
+			return false
+		}
+	}
 	return implementations == 1 || (this.Register != nil)
 }
 
+// Returns true if any probe of the containers of the scheduler is checked through the docker api
+func (this *Scheduler) probes_need_engine() bool {
+	probes := []*Probe{this.ReadinessProbe, this.LivenessProbe}
+	if this.Register != nil {
+		probes = append(probes, this.Register.ReadinessProbe, this.Register.LivenessProbe)
+	}
+	for _, probe := range probes {
+		if probe.needs_engine() {
+			return true
+		}
+	}
+	return false
+}
+
 func (this *Scheduler) RegisterOnly() bool {
-	return (this.Constraint == nil && this.RunOnce == nil) && this.Register != nil
+	return (this.Constraint == nil && this.RunOnce == nil && this.Cron == nil) && this.Register != nil
 }
 
 func (this *Scheduler) Synchronize(domain string, service ServiceKey,
 	local HostContainerStates, global GlobalServiceState, control SchedulerExecutor) error {
 
+	this.synchronizing.Lock()
+	defer this.synchronizing.Unlock()
+
+	start := time.Now()
+	err := this.synchronize(domain, service, local, global, control)
+	if !this.planning {
+		observe_synchronize(domain, service, start, err)
+	}
+	return err
+}
+
+func (this *Scheduler) synchronize(domain string, service ServiceKey,
+	local HostContainerStates, global GlobalServiceState, control SchedulerExecutor) error {
+
 	if this.RegisterOnly() {
 		glog.Infoln("Domain=", domain, "Service=", service, "is register only")
 		return nil
 	}
 
+	if this.Cron != nil {
+		// runs on its schedule only
+		return nil
+	}
+
 	glog.Infoln("Domain=", domain, "Service=", service, "synchronize...")
 
 	key, _, image, err := global.Image()
@@ -176,11 +299,43 @@ func (this *Scheduler) Synchronize(domain string, service ServiceKey,
 		return ErrCannotDetermineContainerImage
 	}
 
-	failed := count_failed_containers(local, service, image)
-	if failed >= this.MaxAttempts {
-		glog.Warningln("Service=", service, "Max attempts exceeded for Image=", image)
-		ExceptionEvent(ErrMaxAttemptsExceeded, image, "Container failures exceeded max attempts, Image=", image)
-		return ErrMaxAttemptsExceeded
+	if this.RunOnce != nil {
+		return this.schedule_run_once(domain, service, local, global, control)
+	}
+
+	resync := func() {
+		if err := this.Synchronize(domain, service, local, global, control); err != nil {
+			glog.Warningln("Error while synchronzing Service=", service, "Err=", err)
+		}
+	}
+
+	if this.WaitForJob != "" && this.hold_for_job(domain, service, resync) {
+		glog.Infoln("Service=", service, "Holding off rollout until Job=", this.WaitForJob, "succeeds")
+		return nil
+	}
+
+	if this.RestartPolicy != nil {
+		if this.hold_restarts(domain, service, image, local, resync) {
+			glog.Infoln("Service=", service, "Holding off restarts for Image=", image, "State=", this.RestartState())
+			return nil
+		}
+	} else {
+		failed := count_failed_containers(local, service, image)
+		if failed >= this.MaxAttempts {
+			glog.Warningln("Service=", service, "Max attempts exceeded for Image=", image)
+			ExceptionEvent(ErrMaxAttemptsExceeded, image, "Container failures exceeded max attempts, Image=", image)
+			return ErrMaxAttemptsExceeded
+		}
+	}
+
+	if this.UpdateStrategy != nil && this.Constraint != nil {
+		if updating, actions := this.rolling_update(domain, service, image, local, global, resync); updating {
+			this.decided(domain, service, actions)
+			if control != nil {
+				control <- actions
+			}
+			return nil
+		}
 	}
 
 	localInstances := local.Instances(service, image)
@@ -207,20 +362,104 @@ func (this *Scheduler) Synchronize(domain string, service ServiceKey,
 		if err != nil {
 			return err
 		}
+		if count > 0 && this.Placement != nil {
+			eligible, reason := this.Placement.Eligible(this.host, this.attributes, local, global)
+			switch {
+			case !eligible:
+				glog.Infoln("Service=", service, "Host=", this.host, "not eligible:", reason)
+				count = 0
+			case this.Placement.SpreadBy != "":
+				// one at a time so the others can catch up
+				count = 1
+			}
+		}
 		for i := 0; i < count; i++ {
 			actions = append(actions, this.StartOne(domain, service, global, local))
 		}
+		if count < 0 {
+			actions = append(actions, this.ScaleDown(domain, service, localInstances, -count)...)
+		}
+		if max := this.Constraint.MaxInstancesGlobal; count == 0 && max != nil && globalRunning > *max {
+			actions = append(actions, this.scale_down_global(domain, service, global, localInstances, *max)...)
+		}
 	default:
 		// Without specifying any constraints, we just naively start more instances...
 		//actions = []Task{this.StartOne(domain, service, global, local)}
 	}
 
+	this.decided(domain, service, actions)
 	if control != nil {
 		control <- actions
 	}
 	return nil
 }
 
+// Returns the actions to stop count of the instances -- those not yet ready are removed first, then the
+// most recently started are stopped.
+func (this *Scheduler) ScaleDown(domain string, service ServiceKey, instances []*Fsm, count int) []Task {
+	candidates := []*Fsm{}
+	for _, instance := range instances {
+		switch instance.Current().State {
+		case Running, Starting:
+			candidates = append(candidates, instance)
+		}
+	}
+	sort.Sort(scale_down_order(candidates))
+
+	actions := []Task{}
+	for i := 0; i < count && i < len(candidates); i++ {
+		containerId := candidates[i].CustomData.(string)
+		glog.Infoln("Domain=", domain, "Service=", service, "Scale down Id=", containerId,
+			"State=", candidates[i].Current().State)
+		if candidates[i].Current().State == Starting {
+			actions = append(actions, this.RemoveOne(domain, service, containerId))
+		} else {
+			actions = append(actions, this.StopOne(domain, service, containerId))
+		}
+	}
+	return actions
+}
+
+// Stops the local instances among the surplus of all instances over the global max, without going below the
+// local min.
+func (this *Scheduler) scale_down_global(domain string, service ServiceKey, global GlobalServiceState,
+	instances []*Fsm, max int) []Task {
+
+	surplus, err := global.Surplus(max)
+	if err != nil {
+		glog.Warningln("Cannot determine surplus of Service=", service, "Err=", err)
+		return NoActions()
+	}
+	_, _, _, localMin, _ := this.Constraint.check()
+
+	running, stop := []*Fsm{}, []*Fsm{}
+	for _, instance := range instances {
+		switch instance.Current().State {
+		case Running, Starting:
+			running = append(running, instance)
+			for _, id := range surplus {
+				if id == instance.CustomData.(string) {
+					stop = append(stop, instance)
+				}
+			}
+		}
+	}
+	return this.ScaleDown(domain, service, stop, min(len(stop), len(running)-localMin))
+}
+
+// Instances not yet running first, then by most recent start
+type scale_down_order []*Fsm
+
+func (s scale_down_order) Len() int      { return len(s) }
+func (s scale_down_order) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s scale_down_order) Less(i, j int) bool {
+	a, b := s[i].Current(), s[j].Current()
+	if a.State != b.State {
+		return a.State == Starting
+	}
+	return a.Started.After(b.Started)
+}
+
 func (this *Scheduler) StartOne(domain string, service ServiceKey,
 	global GlobalServiceState, local HostContainerStates) Task {
 
@@ -228,7 +467,28 @@ func (this *Scheduler) StartOne(domain string, service ServiceKey,
 	sa.domain = domain
 	sa.service = service
 	sa.assignName = AssignContainerNameFromRegistry(global, local, domain, service)
+	sa.matchName = MatchContainerNameFromRegistry(global, local, domain, service)
+	sa.local = local
 	sa.assignImage = AssignContainerImageFromRegistry(global, local, domain, service)
+	if this.Constraint != nil && this.Constraint.MaxInstancesGlobal != nil {
+		sa.globalMax = *this.Constraint.MaxInstancesGlobal
+	}
+
+	return sa
+}
+
+func (this *Scheduler) StopOne(domain string, service ServiceKey, containerId string) Task {
+	sa := this.Task
+	sa.domain = domain
+	sa.service = service
+	sa.stopAction = Stop
+	sa.stopContainers = []string{containerId}
+
+	return sa
+}
 
+func (this *Scheduler) RemoveOne(domain string, service ServiceKey, containerId string) Task {
+	sa := this.StopOne(domain, service, containerId)
+	sa.stopAction = Remove
 	return sa
 }
@@ -4,6 +4,7 @@ import (
 	. "gopkg.in/check.v1"
 	"math"
 	"testing"
+	"time"
 )
 
 func TestScheduler(t *testing.T) { TestingT(t) }
@@ -45,3 +46,107 @@ func (suite *TestSuiteScheduler) TestConstraint(c *C) {
 	c.Assert(lmin, Equals, 0)
 
 }
+
+func (suite *TestSuiteScheduler) TestSchedulerRunStop(c *C) {
+	scheduler := &Scheduler{Register: &MatchContainerRule{}}
+
+	states, stop, done := make(chan HostContainerStates), make(chan bool, 1), make(chan bool)
+	err := scheduler.Run("test.com", "infradash", nil, states, stop, done, nil)
+	c.Assert(err, Equals, nil)
+
+	// register only: nothing to synchronize
+	states <- NewContainerTracker("test.com")
+
+	stop <- true
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		c.Fatal("scheduler did not stop")
+	}
+}
+
+func (suite *TestSuiteScheduler) TestScheduleExecutorRunStop(c *C) {
+	executor := NewScheduleExecutor(nil, nil)
+	c.Assert(executor.Run(), Equals, nil)
+
+	executor.Inbox <- NoActions()
+
+	executor.Stop <- true
+	select {
+	case <-executor.Done:
+	case <-time.After(time.Second):
+		c.Fatal("executor did not stop")
+	}
+}
+
+func (suite *TestSuiteScheduler) TestConstraintSchedule(c *C) {
+	ss := Constraint{MinInstancesPerHost: ref(2), MaxInstancesPerHost: ref(3), MaxInstancesGlobal: ref(5)}
+
+	count, err := ss.Schedule(0, 0)
+	c.Assert(err, Equals, nil)
+	c.Assert(count, Equals, 2)
+
+	count, _ = ss.Schedule(0, 4)
+	c.Assert(count, Equals, 1)
+
+	count, _ = ss.Schedule(2, 2)
+	c.Assert(count, Equals, 1)
+
+	count, _ = ss.Schedule(3, 3)
+	c.Assert(count, Equals, 0)
+
+	// lowered max
+	ss.MaxInstancesPerHost = ref(2)
+	count, _ = ss.Schedule(4, 4)
+	c.Assert(count, Equals, -2)
+
+	ss = Constraint{MinInstancesGlobal: ref(3), MaxInstancesPerHost: ref(2)}
+	count, _ = ss.Schedule(0, 0)
+	c.Assert(count, Equals, 2)
+
+	ss = Constraint{MinInstancesGlobal: ref(3), MaxInstancesGlobal: ref(2)}
+	_, err = ss.Schedule(0, 0)
+	c.Assert(err, Equals, ErrBadSchedulerConfig)
+}
+
+func (suite *TestSuiteScheduler) TestScaleDown(c *C) {
+	scheduler := &Scheduler{}
+
+	image := "infradash/infradash:develop-1.2"
+	ct := NewContainerTracker("test")
+	ct.Running("infradash", tracked_container("120aaaaaaaaaaaaa", image))
+	time.Sleep(time.Millisecond)
+	ct.Running("infradash", tracked_container("121aaaaaaaaaaaaa", image))
+	ct.Starting("infradash", tracked_container("122aaaaaaaaaaaaa", image))
+
+	actions := scheduler.ScaleDown("test.com", "infradash", ct.Instances("infradash", image), 2)
+	c.Assert(len(actions), Equals, 2)
+	c.Assert(actions[0].stopAction, Equals, Remove)
+	c.Assert(actions[0].stopContainers, DeepEquals, []string{"122aaaaaaaaaaaaa"})
+	c.Assert(actions[1].stopAction, Equals, Stop)
+	c.Assert(actions[1].stopContainers, DeepEquals, []string{"121aaaaaaaaaaaaa"})
+}
+
+type test_global struct {
+	image     string
+	hosts     map[string]HostAttributes
+	instances map[string]int
+}
+
+func (this *test_global) Image() (string, string, string, error) {
+	return "/test.com/infradash/develop", "develop", this.image, nil
+}
+
+func (this *test_global) Instances() (int, error) {
+	count := 0
+	for _, c := range this.instances {
+		count += c
+	}
+	return count, nil
+}
+
+func (this *test_global) Surplus(max int) ([]string, error) { return []string{}, nil }
+
+func (this *test_global) Hosts() (map[string]HostAttributes, error) { return this.hosts, nil }
+
+func (this *test_global) InstancesByHost() (map[string]int, error) { return this.instances, nil }
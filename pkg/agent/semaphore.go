@@ -0,0 +1,183 @@
+package agent
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	. "github.com/infradash/dash/pkg/dash"
+	"github.com/qorio/maestro/pkg/zk"
+	"sort"
+)
+
+// Counting semaphore in zk -- a holder owns one of Max ephemeral slot nodes under Path.  Since creating a
+// node is atomic, at most Max holders exist across all agents.  Slots are ephemeral so they are released
+// when the agent holding them goes away.  The semaphore of a service is shared by all its versions, so instances
+// of the old and new versions together stay within the max during a release.
+type Semaphore struct {
+	Path string
+	Max  int
+}
+
+const (
+	semaphore_pending = "pending"
+)
+
+func GlobalSemaphore(domain string, service ServiceKey, max int) (*Semaphore, error) {
+	key, _, err := RegistryKeyValue(KSemaphore, map[string]interface{}{
+		"Domain":  domain,
+		"Service": service,
+		"Max":     max,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Semaphore{Path: key, Max: max}, nil
+}
+
+func (this *Semaphore) slot(i int) string {
+	return fmt.Sprintf("%s/slot-%d", this.Path, i)
+}
+
+// Returns the slots currently held
+func (this *Semaphore) Held(zkc zk.ZK) ([]*zk.Node, error) {
+	parent, err := zkc.Get(this.Path)
+	switch {
+	case err == zk.ErrNotExist:
+		return []*zk.Node{}, nil
+	case err != nil:
+		return nil, err
+	}
+	return parent.Children()
+}
+
+// Returns how many of the slots can be held: instances registered without holding a slot, such as those
+// started before the semaphore was in use, take the place of slots.  Instances of other versions count
+// through the slots they hold.
+func (this *Semaphore) free(held []*zk.Node, registered []string) int {
+	holders := map[string]bool{}
+	for _, n := range held {
+		holders[n.GetValueString()] = true
+	}
+	unheld := map[string]bool{}
+	for _, containerId := range registered {
+		if !holders[containerId] {
+			unheld[containerId] = true
+		}
+	}
+	return this.Max - len(unheld)
+}
+
+// Acquires a slot.  Registered are the ids of the containers of instances known to be running.  Returns the
+// path of the slot or ErrGlobalMaxInstances.
+func (this *Semaphore) Acquire(zkc zk.ZK, registered []string) (string, error) {
+	held, err := this.Held(zkc)
+	if err != nil {
+		return "", err
+	}
+	// Only the first free slots are tried, so agents that see the same instances contend for the same slots
+	free := this.free(held, registered)
+	if len(held) >= free {
+		return "", ErrGlobalMaxInstances
+	}
+	for i := 0; i < free; i++ {
+		_, err := zkc.CreateEphemeral(this.slot(i), []byte(semaphore_pending))
+		switch err {
+		case nil:
+			glog.Infoln("Acquired slot", this.slot(i))
+			return this.slot(i), nil
+		case zk.ErrNodeExists:
+			continue
+		default:
+			return "", err
+		}
+	}
+	return "", ErrGlobalMaxInstances
+}
+
+// Records the container holding the slot
+func (this *Semaphore) Hold(zkc zk.ZK, slot, containerId string) error {
+	n, err := zkc.Get(slot)
+	if err != nil {
+		return err
+	}
+	return n.Set([]byte(containerId))
+}
+
+func (this *Semaphore) Release(zkc zk.ZK, slot string) error {
+	glog.Infoln("Releasing slot", slot)
+	err := zkc.Delete(slot)
+	if err == zk.ErrNotExist {
+		return nil
+	}
+	return err
+}
+
+// Returns the containers beyond max, after max was lowered, of all the instances registered or holding slots.
+// Instances holding the first slots are kept and those without a slot go first, so all agents agree.
+func (this *Semaphore) Surplus(zkc zk.ZK, max int, registered []string) ([]string, error) {
+	held, err := this.Held(zkc)
+	if err != nil {
+		return nil, err
+	}
+	return this.surplus(held, max, registered), nil
+}
+
+func (this *Semaphore) surplus(held []*zk.Node, max int, registered []string) []string {
+	// Pending slots are instances starting, not yet known by container id
+	instances := semaphore_instances{}
+	slots := map[string]bool{}
+	for _, n := range held {
+		i := -1
+		fmt.Sscanf(n.GetBasename(), "slot-%d", &i)
+		instances = append(instances, semaphore_instance{slot: i, containerId: n.GetValueString()})
+		slots[n.GetValueString()] = true
+	}
+	for _, containerId := range registered {
+		if !slots[containerId] {
+			instances = append(instances, semaphore_instance{slot: -1, containerId: containerId})
+			slots[containerId] = true
+		}
+	}
+	sort.Sort(instances)
+
+	surplus := []string{}
+	for i, instance := range instances {
+		if i >= max && instance.containerId != semaphore_pending {
+			surplus = append(surplus, instance.containerId)
+		}
+	}
+	return surplus
+}
+
+type semaphore_instance struct {
+	slot        int // -1 without a slot
+	containerId string
+}
+
+// Kept first: by slot, then those without a slot by container id
+type semaphore_instances []semaphore_instance
+
+func (s semaphore_instances) Len() int      { return len(s) }
+func (s semaphore_instances) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s semaphore_instances) Less(i, j int) bool {
+	if (s[i].slot < 0) != (s[j].slot < 0) {
+		return s[i].slot >= 0
+	}
+	if s[i].slot != s[j].slot {
+		return s[i].slot < s[j].slot
+	}
+	return s[i].containerId < s[j].containerId
+}
+
+// Releases the slot held by the container, if any
+func (this *Semaphore) ReleaseContainer(zkc zk.ZK, containerId string) error {
+	held, err := this.Held(zkc)
+	if err != nil {
+		return err
+	}
+	for _, n := range held {
+		if n.GetValueString() == containerId {
+			return this.Release(zkc, n.GetPath())
+		}
+	}
+	return nil
+}
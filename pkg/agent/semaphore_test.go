@@ -0,0 +1,77 @@
+package agent
+
+import (
+	"github.com/qorio/maestro/pkg/zk"
+	. "gopkg.in/check.v1"
+)
+
+func (suite *TestSuiteScheduler) TestGlobalSemaphore(c *C) {
+	scheduler := &Scheduler{Constraint: &Constraint{MaxInstancesGlobal: ref(1)}}
+	task := scheduler.StartOne("test.com", "infradash", nil, nil)
+	c.Assert(task.globalMax, Equals, 1)
+
+	semaphore, err := GlobalSemaphore("test.com", "infradash", task.globalMax)
+	c.Assert(err, Equals, nil)
+	c.Assert(semaphore.Path, Equals, "/test.com/infradash/semaphore")
+	c.Assert(semaphore.slot(0), Equals, "/test.com/infradash/semaphore/slot-0")
+
+	// the versions of a service share the slots: an instance of the old version holding the only slot
+	// keeps the new version from starting until it is gone
+	versions := &test_slots_zk{slots: map[string]bool{}}
+	old, err := GlobalSemaphore("test.com", "infradash", 1)
+	c.Assert(err, Equals, nil)
+	old_slot, err := old.Acquire(versions, []string{})
+	c.Assert(err, Equals, nil)
+	next, err := GlobalSemaphore("test.com", "infradash", 1)
+	c.Assert(err, Equals, nil)
+	c.Assert(next.Path, Equals, old.Path)
+	_, err = next.Acquire(versions, []string{})
+	c.Assert(err, Equals, ErrGlobalMaxInstances)
+	delete(versions.slots, old_slot)
+	_, err = next.Acquire(versions, []string{})
+	c.Assert(err, Equals, nil)
+
+	// instances registered without a slot take the place of slots
+	semaphore.Max = 3
+	held := []*zk.Node{
+		{Path: semaphore.slot(0), Value: []byte("c1")},
+		{Path: semaphore.slot(1), Value: []byte(semaphore_pending)},
+	}
+	c.Assert(semaphore.free(held, []string{"c1", "c2", "c2"}), Equals, 2)
+	c.Assert(semaphore.free(held, nil), Equals, 3)
+
+	// agents that see the same instances contend for the same slots
+	zkc := &test_slots_zk{slots: map[string]bool{}}
+	slot, err := semaphore.Acquire(zkc, []string{"c1", "c2"})
+	c.Assert(err, Equals, nil)
+	c.Assert(slot, Equals, semaphore.slot(0))
+	_, err = semaphore.Acquire(zkc, []string{"c1", "c2"})
+	c.Assert(err, Equals, ErrGlobalMaxInstances)
+	_, err = semaphore.Acquire(zkc, []string{"c1", "c2", "c3"})
+	c.Assert(err, Equals, ErrGlobalMaxInstances)
+
+	// every instance counts toward the surplus; those without a slot go first
+	held = append(held, &zk.Node{Path: semaphore.slot(4), Value: []byte("c4")})
+	c.Assert(semaphore.surplus(held, 3, []string{"c1", "c4"}), DeepEquals, []string{})
+	c.Assert(semaphore.surplus(held, 3, []string{"c1", "c4", "c3", "c2"}), DeepEquals, []string{"c2", "c3"})
+	c.Assert(semaphore.surplus(held, 1, []string{"c1", "c4"}), DeepEquals, []string{"c4"})
+}
+
+// Creates the slots of a semaphore without listing them, like agents racing to acquire
+
+type test_slots_zk struct {
+	zk.ZK
+	slots map[string]bool
+}
+
+func (this *test_slots_zk) Get(path string) (*zk.Node, error) {
+	return nil, zk.ErrNotExist
+}
+
+func (this *test_slots_zk) CreateEphemeral(path string, value []byte) (*zk.Node, error) {
+	if this.slots[path] {
+		return nil, zk.ErrNodeExists
+	}
+	this.slots[path] = true
+	return &zk.Node{Path: path, Value: value}, nil
+}
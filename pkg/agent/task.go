@@ -3,11 +3,13 @@ package agent
 import (
 	"encoding/json"
 	"fmt"
+	_docker "github.com/fsouza/go-dockerclient"
 	"github.com/golang/glog"
 	. "github.com/infradash/dash/pkg/dash"
 	"github.com/qorio/maestro/pkg/docker"
 	"github.com/qorio/maestro/pkg/zk"
 	"strings"
+	"time"
 )
 
 var (
@@ -39,21 +41,11 @@ func (this *Task) Image() (string, string, string, error) {
 // 3. The docker image eg. infradash/infradash:release_1-123
 func (this *Task) image(zkc zk.ZK) (string, string, string, error) {
 	if this.ImagePath == "" {
-
-		defaultReleaseWatchPath, _, err := RegistryKeyValue(KReleaseWatch, map[string]interface{}{
-			"Domain":  this.domain,
-			"Service": this.service,
-		})
-		if err != nil {
-			return "", "", "", err
-		}
-
-		releaseNode, err := zkc.Get(defaultReleaseWatchPath)
+		path, err := this.release_path(zkc)
 		if err != nil {
 			return "", "", "", err
 		}
-
-		this.ImagePath = releaseNode.GetValueString()
+		this.ImagePath = path
 		glog.Infoln("ImagePath defaults to", this.ImagePath, "for job", *this)
 	}
 
@@ -62,9 +54,35 @@ func (this *Task) image(zkc zk.ZK) (string, string, string, error) {
 	if err != nil {
 		return "", "", "", err
 	}
-	image := docker_info.GetValueString()
-	version := image[strings.LastIndex(image, ":")+1:]
-	return fmt.Sprintf("/%s/%s/%s", this.domain, this.service, version), version, image, nil
+	if docker_info.GetValueString() == "" {
+		return fmt.Sprintf("/%s/%s/", this.domain, this.service), "", "", nil
+	}
+	ref, err := this.registries.resolve(docker_info.GetValueString())
+	if err != nil {
+		return "", "", "", err
+	}
+	version := ref.Version()
+	return fmt.Sprintf("/%s/%s/%s", this.domain, this.service, version), version, ref.String(), nil
+}
+
+// Returns the path of the znode with the image of the release, the ImagePath unless it defaults to the value of
+// the release watch of the service.
+func (this *Task) release_path(zkc zk.ZK) (string, error) {
+	if this.ImagePath != "" {
+		return this.ImagePath, nil
+	}
+	defaultReleaseWatchPath, _, err := RegistryKeyValue(KReleaseWatch, map[string]interface{}{
+		"Domain":  this.domain,
+		"Service": this.service,
+	})
+	if err != nil {
+		return "", err
+	}
+	releaseNode, err := zkc.Get(defaultReleaseWatchPath)
+	if err != nil {
+		return "", err
+	}
+	return releaseNode.GetValueString(), nil
 }
 
 // implements GlobalServiceState
@@ -98,11 +116,132 @@ func (this *Task) Instances() (int, error) {
 	}
 }
 
+// Returns the ids of the containers registered for the current image
+func (this *Task) registered() ([]string, error) {
+	_, version, image, err := this.Image()
+	if err != nil {
+		return nil, err
+	}
+	key, _, err := RegistryKeyValue(KImage, map[string]interface{}{
+		"Domain":  this.domain,
+		"Service": this.service,
+		"Version": version,
+		"Image":   image,
+	})
+	if err != nil {
+		return nil, err
+	}
+	n, err := this.zk.Get(key)
+	switch err {
+	case nil:
+	case zk.ErrNotExist:
+		return []string{}, nil
+	default:
+		return nil, err
+	}
+	children, err := n.Children()
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, child := range children {
+		// Named {container id}:{port}
+		ids = append(ids, strings.Split(child.GetBasename(), ":")[0])
+	}
+	return ids, nil
+}
+
+func (this ContainerActionType) String() string {
+	return containerActionTypeNames[this]
+}
+
+func (this ContainerActionType) MarshalJSON() ([]byte, error) {
+	return json.Marshal(strings.ToLower(this.String()))
+}
+
+func (this *ContainerActionType) UnmarshalJSON(s []byte) error {
+	name := ""
+	if err := json.Unmarshal(s, &name); err != nil {
+		return err
+	}
+	for t, n := range containerActionTypeNames {
+		if strings.EqualFold(name, n) {
+			*this = t
+			return nil
+		}
+	}
+	return ErrBadContainerActionType
+}
+
+// Stops the containers, and removes them if the action is Remove
+func (this *Task) stop(dockerc *docker.Docker) error {
+	for _, containerId := range this.stopContainers {
+		glog.Infoln(this.stopAction, "(", this.service, ") Id=", containerId)
+		if this.stopping != nil {
+			this.stopping(containerId)
+		}
+		err := dockerc.StopContainer(nil, containerId, 10*time.Second)
+		if _, notRunning := err.(*_docker.ContainerNotRunning); notRunning {
+			err = nil
+		}
+		if err != nil {
+			ExceptionEvent(err, containerId, "Error stopping container: Id=", containerId)
+			return err
+		}
+		if this.stopAction == Remove {
+			if err := dockerc.RemoveContainer(nil, containerId, false, true); err != nil {
+				ExceptionEvent(err, containerId, "Error removing container: Id=", containerId)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// implements GlobalServiceState
+func (this *Task) Surplus(max int) ([]string, error) {
+	semaphore, err := GlobalSemaphore(this.domain, this.service, max)
+	if err != nil {
+		return nil, err
+	}
+	registered, err := this.registered()
+	if err != nil {
+		return nil, err
+	}
+	return semaphore.Surplus(this.zk, max, registered)
+}
+
 // Defer assignment of container image and container name to external sources.  This for example allow
 // us to implement a pull base
-func (this *Task) Execute(zkc zk.ZK, dockerc *docker.Docker) error {
+func (this *Task) Execute(zkc zk.ZK, dockerc *docker.Docker) (err error) {
+
+	switch this.stopAction {
+	case Stop, Remove:
+		return this.stop(dockerc)
+	}
+
+	// Claim the run of a job, once for the task, so no other agent runs it
+	starting := false
+	if this.runPath != "" && zkc != nil {
+		run, err := this.claim_run(zkc)
+		if err != nil {
+			glog.Infoln("Not starting job: Path=", this.runPath, "Err=", err)
+			return err
+		}
+		defer func() {
+			this.end_claim(zkc, run, starting, err)
+		}()
+	}
 
 	for i, action := range this.Actions {
+		switch action.Type {
+		case Stop, Remove:
+			if err := this.stop_matching(i, action, dockerc); err != nil {
+				return err
+			}
+			continue
+		}
+
 		opts := action.ContainerControl
 
 		// inject metadata via labels
@@ -121,14 +260,14 @@ func (this *Task) Execute(zkc zk.ZK, dockerc *docker.Docker) error {
 				return err
 			}
 			pull = img
-			opts.Image = img.Repository + ":" + img.Tag
+			opts.Image = image_name(img)
 		} else if opts.Image != "" {
-			k := strings.LastIndex(opts.Image, ":")
-			repository, tag := opts.Image[0:k], opts.Image[k+1:]
-			pull = &docker.Image{
-				Repository: repository,
-				Tag:        tag,
+			ref, err := this.registries.resolve(opts.Image)
+			if err != nil {
+				return err
 			}
+			pull = image_to_pull(ref)
+			opts.Image = image_name(pull)
 		}
 
 		if pull == nil {
@@ -136,17 +275,42 @@ func (this *Task) Execute(zkc zk.ZK, dockerc *docker.Docker) error {
 		}
 
 		// Pull Image -- blocking call
-		login := this.AuthIdentity
-		if this.DockerAuthInfoPath != "" {
-			if l, err := fetchAuthIdentity(zkc, this.DockerAuthInfoPath); err == nil {
-				login = l
-			} else {
+		login, err := this.login(zkc)
+		if err != nil {
+			return err
+		}
+
+		// Refuse to overcommit the host
+		if this.admit != nil {
+			if err := this.admit(&opts); err != nil {
 				return err
 			}
 		}
 
-		if login == nil {
-			return ErrNoImageRegistryAuth
+		// Hold a slot of the global semaphore so the max holds across agents
+		var semaphore *Semaphore
+		var slot string
+		if this.globalMax > 0 && zkc != nil {
+			s, err := GlobalSemaphore(this.domain, this.service, this.globalMax)
+			if err != nil {
+				return err
+			}
+			registered, err := this.registered()
+			if err != nil {
+				glog.Warningln("Cannot list registered instances: Image=", opts.Image, "Err=", err)
+			}
+			slot, err = s.Acquire(zkc, registered)
+			if err != nil {
+				glog.Infoln("Not starting container: Image=", opts.Image, "Max=", this.globalMax, "Err=", err)
+				return err
+			}
+			semaphore = s
+		}
+
+		failed := func(err error) {
+			if semaphore != nil {
+				semaphore.Release(zkc, slot)
+			}
 		}
 
 		// Get the name of the container
@@ -162,13 +326,15 @@ func (this *Task) Execute(zkc zk.ZK, dockerc *docker.Docker) error {
 		glog.Infoln("  StartContainer: Image=", opts.Image, "ContainerName=", opts.ContainerName)
 		glog.Infoln("  StartContainer: ContainerControl=", *opts.Config, "HostConfig=", *opts.HostConfig)
 
-		stopped, err := dockerc.PullImage(login, pull)
-		if err == nil {
-			// Block until completion
-			glog.Infoln("Starting download of", *pull, "with auth", login)
-			download_err := <-stopped
-			glog.Infoln("Download of image", pull.Repository+":"+pull.Tag, "completed with err=", download_err)
+		// Joins the pre-pull of the release if it's still downloading
+		starting = true
+		if this.pull != nil {
+			err = this.pull(login, pull)
 		} else {
+			err = pull_image(dockerc, login, pull)
+		}
+		if err != nil {
+			failed(err)
 			return err
 		}
 
@@ -180,10 +346,144 @@ func (this *Task) Execute(zkc zk.ZK, dockerc *docker.Docker) error {
 			// the case where dockerd cannot fork new processes (due to resource limits)
 			// or because of container name conflicts.
 			ExceptionEvent(err, opts, "Error starting container: Image=", opts.Image)
+			failed(err)
 			return err
 		}
+		if semaphore != nil {
+			if err := semaphore.Hold(zkc, slot, container.Id); err != nil {
+				glog.Warningln("Cannot record container", container.Id, "in slot", slot, "Err=", err)
+			}
+		}
+		if this.runPath != "" && zkc != nil {
+			if err := record_container(zkc, this.runPath, container.Id); err != nil {
+				glog.Warningln("Cannot record container", container.Id, "of run", this.runPath, "Err=", err)
+			}
+		}
 		glog.Infoln("Started container", container.Id[0:12], "from", container.Image, ":", *container)
 
 	}
 	return nil
 }
+
+func (this *Task) login(zkc zk.ZK) (*docker.AuthIdentity, error) {
+	login := this.AuthIdentity
+	if this.DockerAuthInfoPath != "" {
+		l, err := fetchAuthIdentity(zkc, this.DockerAuthInfoPath)
+		if err != nil {
+			return nil, err
+		}
+		login = l
+	}
+	if login == nil {
+		return nil, ErrNoImageRegistryAuth
+	}
+	return login, nil
+}
+
+func pull_image(dockerc *docker.Docker, login *docker.AuthIdentity, image *docker.Image) error {
+	start := time.Now()
+	stopped, err := dockerc.PullImage(login, image)
+	if err != nil {
+		metric_pull.Observe(time.Since(start).Seconds(), ResultLabel(err))
+		return err
+	}
+	glog.Infoln("Starting download of", *image, "with auth", login)
+	return await_pull(image, start, stopped)
+}
+
+// Blocks until the download completes and returns its error
+func await_pull(image *docker.Image, start time.Time, stopped <-chan error) error {
+	download_err := <-stopped
+	glog.Infoln("Download of image", image.Repository+":"+image.Tag, "completed with err=", download_err)
+	metric_pull.Observe(time.Since(start).Seconds(), ResultLabel(download_err))
+	return download_err
+}
+
+// Stops or removes the containers of the host matching the action
+func (this *Task) stop_matching(step int, action ContainerAction, dockerc *docker.Docker) error {
+	name, image, err := this.match_target(step, action)
+	if err != nil {
+		return err
+	}
+
+	all, err := dockerc.FindContainers(nil)
+	if err != nil {
+		return err
+	}
+	matched := match_containers(this.service_containers(all), name, image)
+	glog.Infoln(action.Type, "(", this.service, ") Name=", name, "Image=", image, "Matched=", len(matched))
+
+	task := *this
+	task.stopAction = action.Type
+	task.stopContainers = []string{}
+	for _, c := range matched {
+		task.stopContainers = append(task.stopContainers, c.Id)
+	}
+	return task.stop(dockerc)
+}
+
+// Returns the container name, from the name template, and the image that a stop or remove action matches
+func (this *Task) match_target(step int, action ContainerAction) (name, image string, err error) {
+	if action.ContainerNameTemplate != nil {
+		name = *action.ContainerNameTemplate
+		if this.matchName != nil {
+			opts := action.ContainerControl
+			if name = this.matchName(step, name, &opts); name == "" {
+				return "", "", ErrBadMatchTemplate
+			}
+		}
+	}
+	if action.Config != nil {
+		image = action.Config.Image
+	}
+	if name == "" && image == "" {
+		return "", "", ErrNoContainerToMatch
+	}
+	return
+}
+
+// Returns the containers tracked for the service of the task, so stop and remove actions leave the containers
+// of other services alone.
+func (this *Task) service_containers(all []*docker.Container) []*docker.Container {
+	tracked := map[string]bool{}
+	if this.local != nil {
+		this.local.VisitVersions(func(s ServiceKey, cg *ContainerGroup) {
+			if s != this.service {
+				return
+			}
+			for _, instance := range cg.Instances() {
+				tracked[instance.CustomData.(string)] = true
+			}
+		})
+	}
+	containers := []*docker.Container{}
+	for _, c := range all {
+		if tracked[c.Id] {
+			containers = append(containers, c)
+		}
+	}
+	return containers
+}
+
+// Returns the containers with the name and the image, when given.  An image without a tag matches all the
+// tags of the repository.
+func match_containers(containers []*docker.Container, name, image string) []*docker.Container {
+	repository := ""
+	if ref, err := ParseImageReference(image); err == nil && ref.Tag == "" && ref.Digest == "" {
+		repository = ref.Name()
+	}
+	matched := []*docker.Container{}
+	for _, c := range containers {
+		if name != "" && strings.TrimPrefix(c.Name, "/") != name {
+			continue
+		}
+		if image != "" && c.Image != image {
+			ref, err := ParseImageReference(c.Image)
+			if repository == "" || err != nil || ref.Name() != repository {
+				continue
+			}
+		}
+		matched = append(matched, c)
+	}
+	return matched
+}
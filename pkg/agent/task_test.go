@@ -0,0 +1,82 @@
+package agent
+
+import (
+	"encoding/json"
+	"github.com/qorio/maestro/pkg/docker"
+	. "gopkg.in/check.v1"
+)
+
+func (suite *TestSuiteScheduler) TestContainerActionTypes(c *C) {
+	actions := []ContainerAction{}
+	err := json.Unmarshal([]byte(`[
+{"type":"stop", "container_name_template":"proxy"},
+{"type":"Remove", "image":"infradash/proxy"},
+{"image":"infradash/proxy:2"}
+]`), &actions)
+	c.Assert(err, Equals, nil)
+	c.Assert(actions[0].Type, Equals, Stop)
+	c.Assert(actions[1].Type, Equals, Remove)
+	c.Assert(actions[2].Type, Equals, Start)
+
+	buff, err := json.Marshal(actions[1])
+	c.Assert(err, Equals, nil)
+	c.Assert(string(buff), Matches, `.*"type":"remove".*`)
+
+	c.Assert(json.Unmarshal([]byte(`[{"type":"restart"}]`), &actions), Equals, ErrBadContainerActionType)
+
+	containers := []*docker.Container{
+		{Id: "1", Name: "proxy", Image: "infradash/proxy:1"},
+		{Id: "2", Name: "proxy-2", Image: "infradash/proxy:2"},
+		{Id: "3", Name: "db", Image: "registry:5000/infradash/db"},
+	}
+	ids := func(matched []*docker.Container) []string {
+		list := []string{}
+		for _, m := range matched {
+			list = append(list, m.Id)
+		}
+		return list
+	}
+	c.Assert(ids(match_containers(containers, "proxy", "")), DeepEquals, []string{"1"})
+	c.Assert(ids(match_containers(containers, "", "infradash/proxy")), DeepEquals, []string{"1", "2"})
+	c.Assert(ids(match_containers(containers, "", "infradash/proxy:2")), DeepEquals, []string{"2"})
+	c.Assert(ids(match_containers(containers, "proxy", "infradash/proxy:2")), DeepEquals, []string{})
+	c.Assert(ids(match_containers(containers, "", "registry:5000/infradash/db")), DeepEquals, []string{"3"})
+	c.Assert(ids(match_containers(containers, "", "registry:5000/infradash")), DeepEquals, []string{})
+	c.Assert(ids(match_containers(containers, "", "registry:5000/infradash/db:1")), DeepEquals, []string{})
+}
+
+func (suite *TestSuiteScheduler) TestStopMatching(c *C) {
+	ct := NewContainerTracker("test.com")
+	ct.Running("proxy", tracked_container("140aaaaaaaaaaaaa", "infradash/proxy:1"))
+	ct.Running("db", tracked_container("142aaaaaaaaaaaaa", "infradash/proxy:1"))
+
+	global := &test_global{image: "infradash/proxy:1"}
+	scheduler := &Scheduler{}
+	task := scheduler.StartOne("test.com", "proxy", global, ct)
+
+	// Only the containers of the service are matched
+	all := []*docker.Container{
+		{Id: "140aaaaaaaaaaaaa", Name: "proxy-1", Image: "infradash/proxy:1"},
+		{Id: "141aaaaaaaaaaaaa", Name: "proxy-2", Image: "infradash/proxy:1"},
+		{Id: "142aaaaaaaaaaaaa", Name: "db", Image: "infradash/proxy:1"},
+	}
+	matched := match_containers(task.service_containers(all), "", "infradash/proxy")
+	c.Assert(len(matched), Equals, 1)
+	c.Assert(matched[0].Id, Equals, "140aaaaaaaaaaaaa")
+
+	// Names resolve against the current release, without numbering containers
+	template := "proxy-{{.Tag}}"
+	name, image, err := task.match_target(0, ContainerAction{Type: Stop, ContainerNameTemplate: &template})
+	c.Assert(err, Equals, nil)
+	c.Assert(name, Equals, "proxy-1")
+	c.Assert(image, Equals, "")
+
+	sequence := image_counter["infradash/proxy:1"]
+	template = "proxy-{{.Sequence}}"
+	_, _, err = task.match_target(0, ContainerAction{Type: Stop, ContainerNameTemplate: &template})
+	c.Assert(err, Equals, ErrBadMatchTemplate)
+	c.Assert(image_counter["infradash/proxy:1"], Equals, sequence)
+
+	_, _, err = task.match_target(0, ContainerAction{Type: Remove})
+	c.Assert(err, Equals, ErrNoContainerToMatch)
+}
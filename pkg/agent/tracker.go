@@ -6,13 +6,19 @@ import (
 	"github.com/golang/glog"
 	. "github.com/infradash/dash/pkg/dash"
 	"github.com/qorio/maestro/pkg/docker"
+	"sort"
 	"sync"
+	"time"
 )
 
 type container_event struct {
 	service   ServiceKey
 	state     ContainerState
 	container *docker.Container
+	err       error
+
+	// If set, the event applies only if the container is still in this state
+	from *FsmState
 }
 
 type ContainerTracker struct {
@@ -22,6 +28,16 @@ type ContainerTracker struct {
 	minStartTimeHeap map[ServiceKey]*MinStartTimeHeap
 	statesListener   map[ServiceKey][]chan<- HostContainerStates
 
+	// Deadlines of the states of each service, and what to do when a container is stuck
+	deadlines map[ServiceKey]map[ContainerState]time.Duration
+	expired   func(ServiceKey, *docker.Container, ContainerState)
+
+	// Called on each change of state, from and to
+	transitioned func(ServiceKey, *docker.Container, *FsmState, *FsmState)
+
+	// Counts the changes of states, for saving snapshots
+	changes uint64
+
 	lock sync.Mutex
 }
 
@@ -31,6 +47,7 @@ func NewContainerTracker(domain string) *ContainerTracker {
 		minVersionHeap:   make(map[ServiceKey]*MinVersionHeap),
 		minStartTimeHeap: make(map[ServiceKey]*MinStartTimeHeap),
 		statesListener:   make(map[ServiceKey][]chan<- HostContainerStates),
+		deadlines:        make(map[ServiceKey]map[ContainerState]time.Duration),
 	}
 	return c
 }
@@ -40,11 +57,15 @@ func (this *ContainerTracker) Reset() {
 	this.lock.Lock()
 	this.minVersionHeap = make(map[ServiceKey]*MinVersionHeap)
 	this.minStartTimeHeap = make(map[ServiceKey]*MinStartTimeHeap)
+	this.changes += 1
 }
 
 type HostContainerStatesChanged <-chan HostContainerStates
 
 func (this *ContainerTracker) AddStatesListener(service ServiceKey) HostContainerStatesChanged {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
 	if _, has := this.statesListener[service]; !has {
 		this.statesListener[service] = []chan<- HostContainerStates{}
 	}
@@ -53,6 +74,13 @@ func (this *ContainerTracker) AddStatesListener(service ServiceKey) HostContaine
 	return channel
 }
 
+func (this *ContainerTracker) RemoveStatesListeners(service ServiceKey) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	delete(this.statesListener, service)
+}
+
 func (this *ContainerTracker) GetFsm(service ServiceKey, c *docker.Container) *Fsm {
 	if ch, has := this.minVersionHeap[service]; has {
 		return ch.GetFsm(c)
@@ -65,6 +93,21 @@ func (this *ContainerTracker) GetFsm(service ServiceKey, c *docker.Container) *F
 	}
 }
 
+// Returns the state of the container, if tracked
+func (this *ContainerTracker) State(service ServiceKey, c *docker.Container) (ContainerState, bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if ch, has := this.minVersionHeap[service]; has {
+		for _, cg := range *ch {
+			if fsm, has := cg.FsmById[c.Id]; has {
+				return fsm.Current().State.(ContainerState), true
+			}
+		}
+	}
+	return Created, false
+}
+
 func (this *ContainerTracker) RemoveFsm(service ServiceKey, c *docker.Container) {
 	if ch, has := this.minVersionHeap[service]; has {
 		ch.RemoveFsm(c)
@@ -112,6 +155,74 @@ func (this *ContainerTracker) VisitStartTimes(visit func(service ServiceKey, c *
 	}
 }
 
+// Returns the services that have containers tracked
+func (this *ContainerTracker) Services() []ServiceKey {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	services := []ServiceKey{}
+	for s := range this.minVersionHeap {
+		services = append(services, s)
+	}
+	return services
+}
+
+// Returns a snapshot of the containers of a service, ordered from the oldest version to the newest.
+func (this *ContainerTracker) Containers(service ServiceKey) []ContainerSummary {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	list := []ContainerSummary{}
+	ch, has := this.minVersionHeap[service]
+	if !has {
+		return list
+	}
+
+	started := map[string]time.Time{}
+	if sh, has := this.minStartTimeHeap[service]; has {
+		sh.Visit(func(c *docker.Container) {
+			if c.DockerData != nil {
+				started[c.Id] = c.DockerData.State.StartedAt
+			}
+		})
+	}
+
+	sorted := make(MinVersionHeap, len(*ch))
+	copy(sorted, *ch)
+	sort.Sort(sorted)
+
+	for group, cg := range sorted {
+		_, version, build, _ := ParseVersion(cg.Image)
+		for id, fsm := range cg.FsmById {
+			summary := ContainerSummary{
+				Id:           id,
+				Image:        cg.Image,
+				VersionGroup: group,
+				Version:      version,
+				Build:        build,
+				State:        fsm.Current().State.String(),
+				History:      []ContainerTransition{},
+			}
+			if t, has := started[id]; has {
+				summary.StartedAt = &t
+			}
+			for _, s := range fsm.History {
+				transition := ContainerTransition{
+					State:   s.State.String(),
+					Started: s.Started,
+					Message: s.Message,
+				}
+				if s.Error != nil {
+					transition.Error = s.Error.Error()
+				}
+				summary.History = append(summary.History, transition)
+			}
+			list = append(list, summary)
+		}
+	}
+	return list
+}
+
 /// Returns the number of versions of a service
 func (this *ContainerTracker) CountVersions(service ServiceKey) int {
 	if ch, has := this.minVersionHeap[service]; !has {
@@ -174,6 +285,23 @@ func (this *ContainerTracker) Stopping(service ServiceKey, c *docker.Container)
 	this.process(&container_event{service: service, state: Stopping, container: c})
 }
 
+// Marks a tracked container, known by its id only, as stopping
+func (this *ContainerTracker) StoppingById(service ServiceKey, id string) {
+	var c *docker.Container
+	this.lock.Lock()
+	if ch, has := this.minVersionHeap[service]; has {
+		ch.Visit(func(cg *ContainerGroup) {
+			if _, has := cg.FsmById[id]; has {
+				c = &docker.Container{Id: id, Image: cg.Image}
+			}
+		})
+	}
+	this.lock.Unlock()
+	if c != nil {
+		this.Stopping(service, c)
+	}
+}
+
 func (this *ContainerTracker) Stopped(service ServiceKey, c *docker.Container) {
 	this.process(&container_event{service: service, state: Stopped, container: c})
 }
@@ -182,11 +310,39 @@ func (this *ContainerTracker) Died(service ServiceKey, c *docker.Container) {
 	this.process(&container_event{service: service, state: Failed, container: c})
 }
 
+// Marks a container that is running but failed its liveness probe as failed
+func (this *ContainerTracker) Unhealthy(service ServiceKey, c *docker.Container, err error) {
+	this.process(&container_event{service: service, state: Failed, container: c, err: err})
+}
+
 func (this *ContainerTracker) Removed(service ServiceKey, c *docker.Container) {
 	this.process(&container_event{service: service, state: Removed, container: c})
 }
 
-func (this *ContainerTracker) process(event *container_event) {
+// Called on each change of state of a container, outside of the tracker's lock
+func (this *ContainerTracker) OnTransition(transitioned func(ServiceKey, *docker.Container, *FsmState, *FsmState)) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.transitioned = transitioned
+}
+
+// Returns true if the container changed state
+func (this *ContainerTracker) process(event *container_event) bool {
+	from, to := this.transition(event)
+	if to == nil {
+		return false
+	}
+	this.lock.Lock()
+	transitioned := this.transitioned
+	this.lock.Unlock()
+	if transitioned != nil {
+		transitioned(event.service, event.container, from, to)
+	}
+	return true
+}
+
+// Returns the states from and to, or nil if the container didn't change state
+func (this *ContainerTracker) transition(event *container_event) (*FsmState, *FsmState) {
 	this.lock.Lock()
 	defer this.lock.Unlock()
 
@@ -195,14 +351,22 @@ func (this *ContainerTracker) process(event *container_event) {
 	fsm := this.GetFsm(event.service, event.container)
 	if fsm == nil {
 		glog.Warningln("Error processing event", *event)
-		return
+		return nil, nil
+	}
+	if event.from != nil && fsm.Current() != event.from {
+		return nil, nil
 	}
 
-	current := fsm.Current().State
-	next, err := fsm.Next(event.state, fmt.Sprint("Observe container state=", event.state), nil)
+	from := fsm.Current()
+	current := from.State
+	next, err := fsm.Next(event.state, fmt.Sprint("Observe container state=", event.state), event.err)
 	if err != nil {
 		glog.Warningln("Error processing event", *event, "Err=", err, "Current=", current, "Next=", event.state)
-		return
+		return nil, nil
+	}
+	this.changes += 1
+	if deadline, has := this.deadlines[event.service][event.state]; has {
+		this.watch_deadline(event.service, event.container, fsm, next, deadline)
 	}
 
 	glog.Infoln("Service=", event.service, "Id=", event.container.Id[0:12], "Image=", event.container.Image,
@@ -215,8 +379,10 @@ func (this *ContainerTracker) process(event *container_event) {
 		glog.Infoln("Removed: Service=", event.service, "Container=", event.container.Id)
 
 	case Failed, Stopped:
-		glog.Infoln("Stopped Service=", event.service, "Container=", event.container.Id,
-			"On=", event.container.DockerData.State.FinishedAt)
+		if event.container.DockerData != nil {
+			glog.Infoln("Stopped Service=", event.service, "Container=", event.container.Id,
+				"On=", event.container.DockerData.State.FinishedAt)
+		}
 	}
 
 	switch {
@@ -241,4 +407,5 @@ func (this *ContainerTracker) process(event *container_event) {
 			}
 		}
 	}
+	return from, next
 }
@@ -0,0 +1,212 @@
+package agent
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/golang/glog"
+	. "github.com/infradash/dash/pkg/dash"
+	"github.com/qorio/maestro/pkg/docker"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Tracker state -- the tracker is in memory, so the histories of the containers, which count their failures
+// against MaxAttempts and the restart policy, would be lost when the agent restarts.  When the agent has a state
+// directory, each domain saves a snapshot of its tracker there as it changes and rehydrates the tracker from it
+// before discovering containers on start.  Containers docker no longer has are not restored.
+
+type TrackedState struct {
+	State   ContainerState `json:"state"`
+	Started time.Time      `json:"started"`
+	Message string         `json:"message,omitempty"`
+	Error   string         `json:"error,omitempty"`
+}
+
+type TrackedContainer struct {
+	Id      string         `json:"id"`
+	Image   string         `json:"image"`
+	History []TrackedState `json:"history"`
+}
+
+type TrackerSnapshot struct {
+	Domain   string                            `json:"domain"`
+	Saved    time.Time                         `json:"saved"`
+	Services map[ServiceKey][]TrackedContainer `json:"services"`
+}
+
+// Returns the number of changes to the tracker so far
+func (this *ContainerTracker) Changes() uint64 {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.changes
+}
+
+func (this *ContainerTracker) Snapshot() *TrackerSnapshot {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	snapshot := &TrackerSnapshot{
+		Domain:   this.Domain,
+		Saved:    time.Now(),
+		Services: map[ServiceKey][]TrackedContainer{},
+	}
+	this.VisitVersions(func(service ServiceKey, cg *ContainerGroup) {
+		for id, fsm := range cg.FsmById {
+			tracked := TrackedContainer{Id: id, Image: cg.Image, History: []TrackedState{}}
+			for _, s := range fsm.History {
+				state := TrackedState{State: s.State.(ContainerState), Started: s.Started, Message: s.Message}
+				if s.Error != nil {
+					state.Error = s.Error.Error()
+				}
+				tracked.History = append(tracked.History, state)
+			}
+			snapshot.Services[service] = append(snapshot.Services[service], tracked)
+		}
+	})
+	return snapshot
+}
+
+// Rebuilds the states of the containers in the snapshot that are kept.  Returns the number of containers restored.
+func (this *ContainerTracker) Restore(snapshot *TrackerSnapshot, keep func(id string) bool) int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	restored := 0
+	for service, containers := range snapshot.Services {
+		for _, tracked := range containers {
+			if len(tracked.History) == 0 || !keep(tracked.Id) {
+				continue
+			}
+			c := &docker.Container{Id: tracked.Id, Image: tracked.Image}
+			this.RemoveFsm(service, c)
+			if err := restore_history(this.GetFsm(service, c), tracked.History); err != nil {
+				glog.Warningln("Cannot restore Service=", service, "Id=", tracked.Id, "Err=", err)
+				this.RemoveFsm(service, c)
+				continue
+			}
+			restored += 1
+		}
+	}
+	this.changes += 1
+	return restored
+}
+
+// Replays the transitions on a new fsm, so the states restored are the states allowed
+func restore_history(fsm *Fsm, history []TrackedState) error {
+	if !fsm.Current().State.Equals(history[0].State) {
+		return ErrInvalidState
+	}
+	for i, s := range history {
+		if i > 0 {
+			var observed error
+			if s.Error != "" {
+				observed = errors.New(s.Error)
+			}
+			if _, err := fsm.Next(s.State, s.Message, observed); err != nil {
+				return err
+			}
+		}
+		fsm.Current().Started = s.Started
+		fsm.Current().Message = s.Message
+	}
+	return nil
+}
+
+func (this *Domain) state_file() string {
+	if this.agent == nil || this.agent.StateDir == "" {
+		return ""
+	}
+	return filepath.Join(this.agent.StateDir, this.Domain+".json")
+}
+
+// Rehydrates the tracker from the saved snapshot of the domain, if any
+func (this *Domain) restore_tracker() error {
+	path := this.state_file()
+	if path == "" {
+		return nil
+	}
+	snapshot, err := load_tracker_snapshot(path)
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	}
+	containers, err := this.docker.FindContainers(nil)
+	if err != nil {
+		return err
+	}
+	known := map[string]bool{}
+	for _, c := range containers {
+		known[c.Id] = true
+	}
+	restored := this.tracker.Restore(snapshot, func(id string) bool { return known[id] })
+	glog.Infoln("Domain=", this.Domain, "Restored", restored, "containers from", path, "Saved=", snapshot.Saved)
+	return nil
+}
+
+// Saves the tracker every interval if it changed, and once more when the domain stops
+func (this *Domain) StartTrackerSnapshots(interval time.Duration) {
+	path := this.state_file()
+	if path == "" || interval <= 0 {
+		return
+	}
+	this.running.Add(1)
+	go func() {
+		defer this.running.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		saved := uint64(0)
+		save := func() {
+			changes := this.tracker.Changes()
+			if changes == saved {
+				return
+			}
+			if err := save_tracker_snapshot(path, this.tracker.Snapshot()); err != nil {
+				glog.Warningln("Domain=", this.Domain, "Cannot save tracker to", path, "Err=", err)
+				return
+			}
+			saved = changes
+		}
+		for {
+			select {
+			case <-ticker.C:
+				save()
+			case <-this.stopping:
+				save()
+				return
+			}
+		}
+	}()
+}
+
+func load_tracker_snapshot(path string) (*TrackerSnapshot, error) {
+	buff, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := new(TrackerSnapshot)
+	if err := json.Unmarshal(buff, snapshot); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// Writes the snapshot to a temporary file first so a crash never leaves a partial snapshot
+func save_tracker_snapshot(path string, snapshot *TrackerSnapshot) error {
+	buff, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buff, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -2,10 +2,15 @@ package agent
 
 import (
 	"container/heap"
+	"encoding/json"
+	_docker "github.com/fsouza/go-dockerclient"
 	"github.com/infradash/dash/pkg/dash"
+	. "github.com/infradash/dash/pkg/dash"
 	"github.com/qorio/maestro/pkg/docker"
 	. "gopkg.in/check.v1"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestTracker(t *testing.T) { TestingT(t) }
@@ -142,3 +147,154 @@ func (suite *TestSuiteTracker) TestContainerTracker(c *C) {
 	instances = ct.Instances("sidekiq", "infradash/infradash:develop-1.4")
 	c.Assert(len(instances), Equals, 1)
 }
+
+func tracked_container(id, image string) *docker.Container {
+	return &docker.Container{Id: id, Image: image, DockerData: &_docker.Container{}}
+}
+
+func (suite *TestSuiteTracker) TestContainerTrackerSnapshot(c *C) {
+
+	ct := NewContainerTracker("test")
+
+	ct.Starting("infradash", tracked_container("120aaaaaaaaaaaaa", "infradash/infradash:develop-1.2"))
+	ct.Running("infradash", tracked_container("120aaaaaaaaaaaaa", "infradash/infradash:develop-1.2"))
+	ct.Running("infradash", tracked_container("110aaaaaaaaaaaaa", "infradash/infradash:develop-1.1"))
+	ct.Died("infradash", tracked_container("110aaaaaaaaaaaaa", "infradash/infradash:develop-1.1"))
+
+	c.Assert(ct.Services(), DeepEquals, []ServiceKey{"infradash"})
+	c.Assert(len(ct.Containers("unknown")), Equals, 0)
+
+	containers := ct.Containers("infradash")
+	c.Assert(len(containers), Equals, 2)
+
+	c.Assert(containers[0].Id, Equals, "110aaaaaaaaaaaaa")
+	c.Assert(containers[0].VersionGroup, Equals, 0)
+	c.Assert(containers[0].Version, Equals, "develop")
+	c.Assert(containers[0].Build, Equals, "1.1")
+	c.Assert(containers[0].State, Equals, Failed.String())
+	c.Assert(len(containers[0].History), Equals, 3)
+
+	c.Assert(containers[1].Id, Equals, "120aaaaaaaaaaaaa")
+	c.Assert(containers[1].VersionGroup, Equals, 1)
+	c.Assert(containers[1].State, Equals, Running.String())
+	c.Assert(containers[1].History[0].State, Equals, Created.String())
+	c.Assert(containers[1].History[1].State, Equals, Starting.String())
+	c.Assert(containers[1].History[2].State, Equals, Running.String())
+}
+
+func (suite *TestSuiteTracker) TestContainerTrackerRestore(c *C) {
+
+	ct := NewContainerTracker("test")
+	image := "infradash/infradash:develop-1.2"
+	ct.Starting("infradash", tracked_container("120aaaaaaaaaaaaa", image))
+	ct.Running("infradash", tracked_container("120aaaaaaaaaaaaa", image))
+	ct.Died("infradash", tracked_container("120aaaaaaaaaaaaa", image))
+	ct.Running("infradash", tracked_container("121aaaaaaaaaaaaa", image))
+	ct.Running("infradash", tracked_container("122aaaaaaaaaaaaa", image))
+	c.Assert(ct.Changes(), Equals, uint64(5))
+
+	// Through the state file
+	path := filepath.Join(c.MkDir(), "state", "test.json")
+	c.Assert(save_tracker_snapshot(path, ct.Snapshot()), Equals, nil)
+	snapshot, err := load_tracker_snapshot(path)
+	c.Assert(err, Equals, nil)
+	c.Assert(snapshot.Domain, Equals, "test")
+	c.Assert(len(snapshot.Services["infradash"]), Equals, 3)
+
+	restored := NewContainerTracker("test")
+	n := restored.Restore(snapshot, func(id string) bool { return id != "122aaaaaaaaaaaaa" })
+	c.Assert(n, Equals, 2)
+
+	states := map[string]ContainerSummary{}
+	for _, summary := range restored.Containers("infradash") {
+		states[summary.Id] = summary
+	}
+	c.Assert(len(states), Equals, 2)
+	c.Assert(states["120aaaaaaaaaaaaa"].State, Equals, "container:failed")
+	c.Assert(states["121aaaaaaaaaaaaa"].State, Equals, "container:running")
+	c.Assert(len(states["120aaaaaaaaaaaaa"].History), Equals, 4)
+	for _, summary := range ct.Containers("infradash") {
+		if summary.Id == "120aaaaaaaaaaaaa" {
+			c.Assert(states[summary.Id].History[3].Started.Equal(summary.History[3].Started), Equals, true)
+		}
+	}
+	c.Assert(count_failed_containers(restored, "infradash", image), Equals, 1)
+
+	// Rediscovered: the failed container stays failed, and the running one died while the agent was down
+	stopped := tracked_container("121aaaaaaaaaaaaa", image)
+	stopped.DockerData.State.ExitCode = 137
+	track_discovered(restored, "infradash", tracked_container("120aaaaaaaaaaaaa", image))
+	track_discovered(restored, "infradash", stopped)
+	state, has := restored.State("infradash", stopped)
+	c.Assert(has, Equals, true)
+	c.Assert(state, Equals, Failed)
+	state, _ = restored.State("infradash", tracked_container("120aaaaaaaaaaaaa", image))
+	c.Assert(state, Equals, Failed)
+
+	// Transitions not allowed are not restored
+	snapshot.Services["infradash"][0].History = []TrackedState{{State: Created}, {State: Removed}, {State: Running}}
+	c.Assert(NewContainerTracker("test").Restore(snapshot, func(string) bool { return true }), Equals, 2)
+
+	var s ContainerState
+	c.Assert(json.Unmarshal([]byte(`"container:stopping"`), &s), Equals, nil)
+	c.Assert(s, Equals, Stopping)
+	c.Assert(json.Unmarshal([]byte(`"container:unknown"`), &s), Equals, ErrUnknownState)
+}
+
+func (suite *TestSuiteTracker) TestContainerTrackerDeadlines(c *C) {
+
+	ct := NewContainerTracker("test")
+	expired := make(chan ContainerState, 4)
+	ct.OnExpired(func(service ServiceKey, container *docker.Container, state ContainerState) {
+		expired <- state
+	})
+	ct.SetDeadlines("infradash", (&StateDeadlines{}).states())
+	c.Assert(ct.deadlines["infradash"][Starting], Equals, 2*time.Minute)
+	c.Assert(ct.deadlines["infradash"][Stopping], Equals, 30*time.Second)
+	ct.SetDeadlines("infradash", map[ContainerState]time.Duration{
+		Starting: 50 * time.Millisecond,
+		Stopping: 50 * time.Millisecond,
+	})
+
+	image := "infradash/infradash:develop-1.2"
+	stuck := tracked_container("120aaaaaaaaaaaaa", image)
+	ready := tracked_container("121aaaaaaaaaaaaa", image)
+	ct.Starting("infradash", stuck)
+	ct.Starting("infradash", ready)
+	ct.Running("infradash", ready)
+
+	select {
+	case state := <-expired:
+		c.Assert(state, Equals, Starting)
+	case <-time.After(2 * time.Second):
+		c.Fatal("Deadline of starting not expired")
+	}
+	state, _ := ct.State("infradash", stuck)
+	c.Assert(state, Equals, Failed)
+	state, _ = ct.State("infradash", ready)
+	c.Assert(state, Equals, Running)
+	c.Assert(len(ct.Instances("infradash", image)), Equals, 2)
+	c.Assert(count_failed_containers(ct, "infradash", image), Equals, 1)
+
+	// Stopped by the agent, known by id
+	ct.StoppingById("infradash", "121aaaaaaaaaaaaa")
+	state, _ = ct.State("infradash", ready)
+	c.Assert(state, Equals, Stopping)
+	select {
+	case state := <-expired:
+		c.Assert(state, Equals, Stopping)
+	case <-time.After(2 * time.Second):
+		c.Fatal("Deadline of stopping not expired")
+	}
+	state, _ = ct.State("infradash", ready)
+	c.Assert(state, Equals, Failed)
+
+	// No deadline once cleared
+	ct.SetDeadlines("infradash", nil)
+	ct.Starting("infradash", tracked_container("122aaaaaaaaaaaaa", image))
+	select {
+	case <-expired:
+		c.Fatal("Deadline expired after cleared")
+	case <-time.After(200 * time.Millisecond):
+	}
+}
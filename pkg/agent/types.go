@@ -35,6 +35,39 @@ type Health struct {
 	UptimeSeconds float64 `json:uptime_seconds,omitempty`
 }
 
+type DomainSummary struct {
+	Domain   string       `json:"domain"`
+	Identity string       `json:"id,omitempty"`
+	Services []ServiceKey `json:"services"`
+	Drift    Drift        `json:"drift"`
+}
+
+type ServiceSummary struct {
+	Service    ServiceKey     `json:"service"`
+	Scheduled  bool           `json:"scheduled"`
+	Versions   int            `json:"versions"`
+	Containers map[string]int `json:"containers"` // counts by container state
+	State      string         `json:"state,omitempty"`
+}
+
+type ContainerSummary struct {
+	Id           string                `json:"id"`
+	Image        string                `json:"image"`
+	VersionGroup int                   `json:"version_group"` // 0 = oldest version tracked
+	Version      string                `json:"version,omitempty"`
+	Build        string                `json:"build,omitempty"`
+	State        string                `json:"state"`
+	StartedAt    *time.Time            `json:"started_at,omitempty"`
+	History      []ContainerTransition `json:"history"`
+}
+
+type ContainerTransition struct {
+	State   string    `json:"state"`
+	Started time.Time `json:"started"`
+	Message string    `json:"message,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
 type MatchContainerRule struct {
 	QualifyByTags
 	docker.Image
@@ -42,6 +75,10 @@ type MatchContainerRule struct {
 	MatchFirst         []ContainerMatchRulesUnion `json:"match_first,omitempty"`
 	MatchAll           []ContainerMatchRulesUnion `json:"mathc_all,omitempty"`
 
+	// Containers are registered only once ready, and deregistered when no longer live
+	ReadinessProbe *Probe `json:"readiness_probe,omitempty"`
+	LivenessProbe  *Probe `json:"liveness_probe,omitempty"`
+
 	registerOnly bool
 }
 
@@ -60,6 +97,12 @@ type DomainConfig struct {
 	Services map[ServiceKey]*Scheduler `json:"services,omitempty"`
 
 	Vacuums map[ServiceKey]*VacuumConfig `json:"vacuums,omitempty"`
+
+	// Registries and mirrors the images of the domain are pulled from
+	Registries *ImageRegistries `json:"registries,omitempty"`
+
+	// Where the events of the domain are sent besides the status topic
+	EventSinks []*EventSinkConfig `json:"event_sinks,omitempty"`
 }
 
 func (d *DomainConfig) JSON() string {
@@ -77,8 +120,54 @@ type Scheduler struct {
 
 	Constraint *Constraint      `json:"constraint,omitempty"`
 	RunOnce    *RunOnceSchedule `json:"run_once,omitemtpy"`
+	Cron       *CronSchedule    `json:"cron,omitempty"`
+
+	// Probes for the containers of the service, unless given in the register rule
+	ReadinessProbe *Probe `json:"readiness_probe,omitempty"`
+	LivenessProbe  *Probe `json:"liveness_probe,omitempty"`
+
+	// How instances of older versions are replaced when the release changes
+	UpdateStrategy *UpdateStrategy `json:"update_strategy,omitempty"`
+
+	// Which hosts can run the service
+	Placement *Placement `json:"placement,omitempty"`
+
+	// How failed instances are restarted.  If not set, MaxAttempts bounds the failures of an image.
+	RestartPolicy *RestartPolicy `json:"restart_policy,omitempty"`
+
+	// Containers stuck starting or stopping past the deadline are marked failed and killed
+	Deadlines *StateDeadlines `json:"deadlines,omitempty"`
+
+	// Run once job of the domain that must succeed for its current trigger before instances are started
+	WaitForJob ServiceKey `json:"wait_for_job,omitempty"`
+
+	lock    sync.Mutex
+	rollout *rollout
 
-	lock sync.Mutex
+	// Held while synchronizing, so the resyncs of timers don't run with the scheduler's own
+	synchronizing sync.Mutex
+
+	restart_state RestartState
+	restart_timer *time.Timer
+
+	// Failures of the instances, kept for the restart policy after the instances are removed
+	restart_failures map[*Fsm]instance_failures
+
+	// Outcome of the job waited for, and the timer to check it again
+	job       func() (*JobOutcome, error)
+	job_timer *time.Timer
+
+	// Containers of the host, for the runs on a cron schedule
+	local HostContainerStates
+
+	// Path of the last cron run not skipped, for single host runs
+	cron_last string
+
+	// Publishes changes of the service state
+	status func(Event)
+
+	// Planning only: no metrics are observed and nothing is written to the registry
+	planning bool
 }
 
 type Trigger string
@@ -110,14 +199,50 @@ type Task struct {
 
 	assignName  AssignContainerName
 	assignImage AssignContainerImage
+	matchName   AssignContainerName
+
+	// The containers the agent tracks on the host; stop and remove actions only match those of the service
+	local HostContainerStates
+
+	// Containers to stop instead of starting new ones, and to remove too if the action is Remove
+	stopContainers []string
+	stopAction     ContainerActionType
+
+	// When positive, each container started must hold a slot of the global semaphore
+	globalMax int
+
+	// The host running the agent and its attributes
+	host       string
+	attributes HostAttributes
+
+	// Checks the host has the resources for the container before it's started
+	admit func(*docker.ContainerControl) error
+
+	// Pulls the image, joining a pull of the same image in progress
+	pull func(*docker.AuthIdentity, *docker.Image) error
+
+	// Marks a container the task stops as stopping
+	stopping func(id string)
+
+	// Registries of the domain
+	registries *ImageRegistries
+
+	// For run once jobs, the value of the trigger and the path of the outcome of the run
+	run     string
+	runPath string
 
 	// TODO - Add fields here to support implementation of barriers, leader election and global locks required
 	// to implement semantics like 'only 1 per cluster'
 }
 
 type ContainerAction struct {
+	// Start (default), stop or remove.  Stop and remove apply to the containers of the service on the host
+	// matching the name template or the image of the action, or both if both are given.
+	Type ContainerActionType `json:"type,omitempty"`
+
 	// Template for naming the container. Variables:  Group, Sequence, Domain, Service, Image
-	// If not provided, docker naming will be used.
+	// If not provided, docker naming will be used.  Stop and remove actions resolve the template against the
+	// current release, without Sequence.
 	ContainerNameTemplate *string `json:"container_name_template,omitempty" dash:"template"`
 
 	docker.ContainerControl
@@ -132,5 +257,7 @@ type Constraint struct {
 }
 
 type RunOnceSchedule struct {
+	// Registry path whose value identifies the run, e.g. a schema version.  The job runs once per value.
+	// Defaults to the release of the service.
 	Trigger string `json:"trigger"`
 }
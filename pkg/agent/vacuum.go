@@ -4,6 +4,7 @@ import (
 	"github.com/golang/glog"
 	. "github.com/infradash/dash/pkg/dash"
 	"github.com/qorio/maestro/pkg/docker"
+	"sort"
 	"time"
 )
 
@@ -15,17 +16,36 @@ type VacuumByVersions struct {
 	VersionsToKeep int `json:"versions_to_keep"`
 }
 
+// Removes stopped or failed containers by the time they started.  For services whose tags don't sort as
+// versions, like batch containers.  Images are left to the disk vacuum of the host.
 type VacuumByStartTime struct {
+	// Most recently started containers to keep, whatever their age
+	KeepMostRecent int `json:"keep_most_recent,omitempty"`
+
+	// Containers started longer ago than this are removed.  Zero removes all but the most recent.
+	MaxAgeSeconds uint32 `json:"max_age_seconds,omitempty"`
+
+	// Containers are kept at least this long after they stopped
+	MinStoppedAgeSeconds uint32 `json:"min_stopped_age_seconds,omitempty"`
 }
 
 type VacuumConfig struct {
 	QualifyByTags
 
 	RemoveImage        bool   `json:"remove_image,omitempty"`
-	ExportContainer    bool   `json:"export_container,omitempty"`
-	ExportDestination  string `json:"exoprt_destination,omitempty"`
 	RunIntervalSeconds uint32 `json:"run_interval_seconds,omitempty"`
 
+	// Export containers to a file:// directory or http(s):// url before removing them
+	ExportContainer   bool   `json:"export_container,omitempty"`
+	ExportDestination string `json:"export_destination,omitempty"`
+	ExportLogLines    int    `json:"export_log_lines,omitempty"`
+
+	// Exports of the service to keep in a directory
+	ExportRetention int `json:"export_retention,omitempty"`
+
+	// Deprecated: the misspelled key of ExportDestination
+	LegacyExportDestination string `json:"exoprt_destination,omitempty"`
+
 	// Option when by version
 	ByVersion *VacuumByVersions `json:"by_version,omitempty"`
 
@@ -40,23 +60,39 @@ type Vacuum struct {
 	Service ServiceKey
 	Config  VacuumConfig
 	Stop    VacuumStop
+	Done    <-chan bool // closed when the vacuum has stopped
 
 	stop   chan bool
+	done   chan bool
 	local  HostContainerStates
 	ticker *time.Ticker
 	docker *docker.Docker
+	engine *docker_engine
+
+	// Running containers are left to the scheduler's rolling update
+	keepRunning bool
+
+	// Containers exported but not yet removed, and the retries of the failed exports, by container id
+	exported       map[string]bool
+	export_retries map[string]export_retry
+
+	publish func(Event)
 }
 
 func NewVacuum(domain string, service ServiceKey, config VacuumConfig,
 	local HostContainerStates, docker *docker.Docker) *Vacuum {
 
-	stop := make(chan bool)
+	stop, done := make(chan bool, 1), make(chan bool)
 
 	if config.RunIntervalSeconds == 0 {
 		config.RunIntervalSeconds = 1
 	}
 	config.runInterval = time.Duration(config.RunIntervalSeconds) * time.Second
 
+	if config.ExportDestination == "" {
+		config.ExportDestination = config.LegacyExportDestination
+	}
+
 	ticker := time.NewTicker(config.runInterval)
 
 	vac := &Vacuum{
@@ -64,10 +100,15 @@ func NewVacuum(domain string, service ServiceKey, config VacuumConfig,
 		Service: service,
 		Config:  config,
 		Stop:    stop,
+		Done:    done,
 		stop:    stop,
+		done:    done,
 		local:   local,
 		ticker:  ticker,
 		docker:  docker,
+
+		exported:       make(map[string]bool),
+		export_retries: make(map[string]export_retry),
 	}
 
 	return vac
@@ -77,11 +118,21 @@ func (this *Vacuum) Validate() error {
 	if this.Config.ByVersion != nil && this.Config.ByVersion.VersionsToKeep < 0 {
 		return ErrBadVacuumConfig
 	}
+	if this.Config.ByStartTime != nil && this.Config.ByStartTime.KeepMostRecent < 0 {
+		return ErrBadVacuumConfig
+	}
+	if this.Config.ExportContainer && !valid_export_destination(this.Config.ExportDestination) {
+		return ErrBadExportDestination
+	}
+	if this.Config.ExportLogLines < 0 || this.Config.ExportRetention < 0 {
+		return ErrBadVacuumConfig
+	}
 	return nil
 }
 
 func (this *Vacuum) Run() error {
 	go func() {
+		defer close(this.done)
 
 		for {
 			select {
@@ -89,6 +140,7 @@ func (this *Vacuum) Run() error {
 				if stop {
 					glog.Infoln("Stopping Vacuum:", "Domain=", this.Domain, "Service=", this.Service)
 					this.ticker.Stop()
+					return
 				}
 			case <-this.ticker.C:
 				err := this.do_vacuum()
@@ -102,46 +154,174 @@ func (this *Vacuum) Run() error {
 	return nil
 }
 
-func (this *Vacuum) do_vacuum() error {
+// A step of the vacuum on a container or its image
+type VacuumStep struct {
+	Id     string `json:"id"`
+	Image  string `json:"image,omitempty"`
+	State  string `json:"state"`
+	Action string `json:"action"`
+}
+
+const (
+	vacuum_stop         = "stop"
+	vacuum_remove       = "remove"
+	vacuum_remove_image = "remove_image"
+)
+
+// Returns the steps the vacuum would take given the current states of the containers
+func (this *Vacuum) Plan() []VacuumStep {
+	steps := []VacuumStep{}
 
 	switch {
 	case this.Config.ByStartTime != nil:
 
-		// TODO
+		containers := []*docker.Container{}
+		this.local.VisitStartTimes(func(service ServiceKey, c *docker.Container) {
+			if service == this.Service {
+				containers = append(containers, c)
+			}
+		})
+		instances := map[string]*Fsm{}
+		this.local.VisitVersions(func(service ServiceKey, cg *ContainerGroup) {
+			if service != this.Service {
+				return
+			}
+			for id, fsm := range cg.FsmById {
+				instances[id] = fsm
+			}
+		})
+
+		for _, containerId := range this.Config.ByStartTime.Select(containers, instances, time.Now()) {
+			steps = append(steps, VacuumStep{
+				Id:     containerId,
+				State:  instances[containerId].Current().State.String(),
+				Action: vacuum_remove,
+			})
+		}
 
 	case this.Config.ByVersion != nil:
 
 		versions := this.local.CountVersions(this.Service)
 		if versions <= this.Config.ByVersion.VersionsToKeep {
-			return nil
+			return steps
 		}
 
 		image, instances := this.local.OldestVersion(this.Service)
 		for _, instance := range instances {
 
 			state := instance.Current().State
-			containerId := instance.CustomData.(string)
-			glog.Infoln("Domain=", this.Domain, "Service=", this.Service,
-				"Id=", containerId[0:12], "State=", state.String(), "Image=", image, "to be vacuummed.")
+			step := VacuumStep{Id: instance.CustomData.(string), Image: image, State: state.String()}
 
 			switch state {
 			case Running:
-				glog.Infoln("StopContainer", "Id=", containerId)
-				err := this.docker.StopContainer(nil, containerId, 10*time.Second)
-				glog.Infoln("StopContainer", "Id=", containerId, "Err=", err)
+				if this.keepRunning {
+					continue
+				}
+				step.Action = vacuum_stop
 			case Removed:
-				if this.Config.RemoveImage {
-					glog.Infoln("Container removed.  Now removing image:", image)
-					err := this.docker.RemoveImage(image, true, true)
-					glog.Infoln("RemoveImage: err=", err)
+				if !this.Config.RemoveImage {
+					continue
 				}
+				step.Action = vacuum_remove_image
 			case Stopped, Failed:
-				glog.Infoln("RemoveContainer", "Id=", containerId)
-				err := this.docker.RemoveContainer(nil, containerId, false, false)
-				glog.Infoln("RemoveContainer", "Id=", containerId, "Err=", err)
+				step.Action = vacuum_remove
+			default:
+				continue
 			}
+			steps = append(steps, step)
 		}
 	default:
 	}
+	return steps
+}
+
+func (this *Vacuum) do_vacuum() error {
+
+	plan, now := this.Plan(), time.Now()
+	remove := map[string]bool{}
+	for _, step := range plan {
+		if step.Action == vacuum_remove {
+			remove[step.Id] = true
+		}
+	}
+	this.forget_exports(remove)
+
+	for _, step := range plan {
+		containerId := step.Id
+		glog.Infoln("Domain=", this.Domain, "Service=", this.Service,
+			"Id=", containerId[0:12], "State=", step.State, "Image=", step.Image, "to be vacuummed.")
+
+		switch step.Action {
+		case vacuum_stop:
+			glog.Infoln("StopContainer", "Id=", containerId)
+			err := this.docker.StopContainer(nil, containerId, 10*time.Second)
+			glog.Infoln("StopContainer", "Id=", containerId, "Err=", err)
+			this.vacuumed(step, err)
+		case vacuum_remove_image:
+			glog.Infoln("Container removed.  Now removing image:", step.Image)
+			err := this.docker.RemoveImage(step.Image, true, true)
+			glog.Infoln("RemoveImage: err=", err)
+			this.vacuumed(step, err)
+			if err == nil {
+				metric_vacuum_removed.Inc(this.Domain, string(this.Service), "image")
+			}
+		case vacuum_remove:
+			switch err := this.export(containerId, now); err {
+			case nil:
+			case ErrExportRetryLater:
+				continue
+			default:
+				ExceptionEvent(err, containerId, "Export failed. Keeping container", containerId)
+				continue
+			}
+			glog.Infoln("RemoveContainer", "Id=", containerId)
+			err := this.docker.RemoveContainer(nil, containerId, false, false)
+			glog.Infoln("RemoveContainer", "Id=", containerId, "Err=", err)
+			this.vacuumed(step, err)
+			if err == nil {
+				delete(this.exported, containerId)
+				metric_vacuum_removed.Inc(this.Domain, string(this.Service), "container")
+			}
+		}
+	}
 	return nil
 }
+
+// Returns the ids of the stopped or failed containers to remove, given the containers of the service and
+// their state machines by container id.
+func (this *VacuumByStartTime) Select(containers []*docker.Container, instances map[string]*Fsm,
+	now time.Time) []string {
+
+	started := []*docker.Container{}
+	for _, c := range containers {
+		if c.DockerData != nil {
+			started = append(started, c)
+		}
+	}
+	sort.Sort(sort.Reverse(MinStartTimeHeap(started)))
+
+	maxAge := time.Duration(this.MaxAgeSeconds) * time.Second
+	minStoppedAge := time.Duration(this.MinStoppedAgeSeconds) * time.Second
+
+	remove := []string{}
+	for i, c := range started {
+		if i < this.KeepMostRecent {
+			continue
+		}
+		fsm, has := instances[c.Id]
+		if !has {
+			continue
+		}
+		switch current := fsm.Current(); {
+		case current.State != Stopped && current.State != Failed:
+			continue
+		case now.Sub(current.Started) < minStoppedAge:
+			continue
+		}
+		if maxAge > 0 && now.Sub(c.DockerData.State.StartedAt) < maxAge {
+			continue
+		}
+		remove = append(remove, c.Id)
+	}
+	return remove
+}
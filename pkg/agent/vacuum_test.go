@@ -0,0 +1,45 @@
+package agent
+
+import (
+	_docker "github.com/fsouza/go-dockerclient"
+	. "github.com/infradash/dash/pkg/dash"
+	"github.com/qorio/maestro/pkg/docker"
+	. "gopkg.in/check.v1"
+	"time"
+)
+
+func (suite *TestSuiteScheduler) TestVacuumByStartTime(c *C) {
+	now := time.Now()
+	at := func(hours int) time.Time { return now.Add(time.Duration(hours) * time.Hour) }
+
+	containers := []*docker.Container{}
+	instances := map[string]*Fsm{}
+	add := func(id string, fsm *Fsm) {
+		started := fsm.History[0].Started
+		containers = append(containers, &docker.Container{
+			Id:         id,
+			DockerData: &_docker.Container{State: _docker.State{StartedAt: started}},
+		})
+		instances[id] = fsm
+	}
+	running := ContainerFsm.Instance(Starting)
+	running.Next(Running, "", nil)
+	running.History[0].Started = at(-1)
+
+	add("running", running)
+	add("failed-recent", failed_instance(at(-2), at(-2)))
+	add("failed-old", failed_instance(at(-30), at(-29)))
+	add("failed-older", failed_instance(at(-50), at(-49)))
+	add("failed-just-stopped", failed_instance(at(-40), now.Add(-time.Minute)))
+
+	policy := &VacuumByStartTime{KeepMostRecent: 2, MaxAgeSeconds: 24 * 3600, MinStoppedAgeSeconds: 600}
+	c.Assert(policy.Select(containers, instances, now), DeepEquals, []string{"failed-old", "failed-older"})
+
+	// Only the most recent are kept when there is no max age
+	policy = &VacuumByStartTime{KeepMostRecent: 1}
+	c.Assert(policy.Select(containers, instances, now), DeepEquals,
+		[]string{"failed-recent", "failed-old", "failed-just-stopped", "failed-older"})
+
+	policy = &VacuumByStartTime{KeepMostRecent: 5}
+	c.Assert(policy.Select(containers, instances, now), DeepEquals, []string{})
+}
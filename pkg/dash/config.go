@@ -1,11 +1,17 @@
 package dash
 
 import (
+	"crypto/sha1"
+	"crypto/tls"
 	"encoding/json"
+	"fmt"
 	"github.com/golang/glog"
 	"github.com/qorio/maestro/pkg/template"
 	"github.com/qorio/maestro/pkg/zk"
+	"io/ioutil"
+	"net/http"
 	"net/url"
+	"strings"
 	gotemplate "text/template"
 	"time"
 )
@@ -70,3 +76,132 @@ func (this *ConfigLoader) applyTemplate(body string, funcs ...gotemplate.FuncMap
 	}
 	return template.ApplyTemplate(body, this.Context, funcs...)
 }
+
+// Watches the config source for changes and calls changed whenever the content differs from what
+// was last seen.  zk:// sources are watched in the registry.  All other sources are polled at the given
+// interval; for http(s) sources the poll is a conditional GET using the ETag returned by the server.
+// Send true to the returned channel to stop watching.
+func (this *ConfigLoader) Watch(auth string, zc zk.ZK, interval time.Duration, changed func()) (chan<- bool, error) {
+	if this.ConfigUrl == "" {
+		return nil, ErrNoPath
+	}
+
+	if strings.Index(this.ConfigUrl, "zk://") == 0 {
+		if zc == nil {
+			return nil, ErrNoZkConnection
+		}
+		path := this.ConfigUrl[len("zk://"):]
+		glog.Infoln("Watching config at", path)
+		return zc.KeepWatch(path, func(e zk.Event) bool {
+			glog.Infoln("Config changed:", e)
+			changed()
+			return true
+		})
+	}
+
+	if interval <= 0 {
+		return nil, ErrBadPollInterval
+	}
+
+	headers := map[string]string{
+		"Authorization": "Bearer " + auth,
+	}
+	poll := &config_poll{url: this.ConfigUrl, headers: headers, zk: zc}
+	poll.check() // seed with what's there now
+
+	stop := make(chan bool, 1)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		glog.Infoln("Polling config at", this.ConfigUrl, "Interval=", interval)
+		for {
+			select {
+			case <-ticker.C:
+				updated, err := poll.check()
+				if err != nil {
+					glog.Warningln("Error polling config at", this.ConfigUrl, "Err=", err)
+					continue
+				}
+				if updated {
+					glog.Infoln("Config changed at", this.ConfigUrl)
+					changed()
+				}
+			case <-stop:
+				glog.Infoln("Stopped polling config at", this.ConfigUrl)
+				return
+			}
+		}
+	}()
+	return stop, nil
+}
+
+type config_poll struct {
+	url     string
+	headers map[string]string
+	zk      zk.ZK
+
+	etag string
+	hash [sha1.Size]byte
+}
+
+// Fetches the config and returns true if the content has changed since the last check.
+func (this *config_poll) check() (bool, error) {
+	var body string
+	if strings.Index(this.url, "http://") == 0 || strings.Index(this.url, "https://") == 0 {
+		content, etag, modified, err := fetch_if_modified(this.url, this.headers, this.etag)
+		if err != nil || !modified {
+			return false, err
+		}
+		this.etag = etag
+		body = content
+	} else {
+		content, _, err := template.FetchUrl(this.url, this.headers, this.zk)
+		if err != nil {
+			return false, err
+		}
+		body = content
+	}
+
+	hash := sha1.Sum([]byte(body))
+	if hash == this.hash {
+		return false, nil
+	}
+	this.hash = hash
+	return true, nil
+}
+
+func fetch_if_modified(url string, headers map[string]string, etag string) (body, newEtag string, modified bool, err error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return
+	}
+	for h, v := range headers {
+		req.Header.Add(h, v)
+	}
+	if etag != "" {
+		req.Header.Add("If-None-Match", etag)
+	}
+
+	// don't check certificate for https, same as when the config is first loaded
+	client := &http.Client{
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return "", etag, false, nil
+	case http.StatusOK:
+		content, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return "", etag, false, err
+		}
+		return string(content), resp.Header.Get("ETag"), true, nil
+	default:
+		return "", etag, false, fmt.Errorf("config-fetch-status-%d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,78 @@
+package dash
+
+import (
+	. "gopkg.in/check.v1"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConfig(t *testing.T) { TestingT(t) }
+
+type TestSuiteConfig struct {
+}
+
+var _ = Suite(&TestSuiteConfig{})
+
+func (suite *TestSuiteConfig) SetUpSuite(c *C) {
+}
+
+func (suite *TestSuiteConfig) TearDownSuite(c *C) {
+}
+
+func (suite *TestSuiteConfig) TestWatchPollWithEtag(c *C) {
+	var lock sync.Mutex
+	content, etag := `[{"domain":"test.com"}]`, "v1"
+	fetches, notModified := 0, 0
+
+	server := httptest.NewServer(http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		fetches += 1
+		if req.Header.Get("If-None-Match") == etag {
+			notModified += 1
+			resp.WriteHeader(http.StatusNotModified)
+			return
+		}
+		resp.Header().Set("ETag", etag)
+		resp.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	changed := make(chan bool, 10)
+	loader := &ConfigLoader{ConfigUrl: server.URL}
+	stop, err := loader.Watch("token", nil, 10*time.Millisecond, func() {
+		changed <- true
+	})
+	c.Assert(err, Equals, nil)
+
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(len(changed), Equals, 0)
+
+	lock.Lock()
+	c.Assert(notModified > 0, Equals, true)
+	content, etag = `[{"domain":"test2.com"}]`, "v2"
+	lock.Unlock()
+
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		c.Fatal("no change observed")
+	}
+
+	stop <- true
+	time.Sleep(50 * time.Millisecond)
+	c.Assert(len(changed), Equals, 0)
+}
+
+func (suite *TestSuiteConfig) TestWatchNeedsInterval(c *C) {
+	loader := &ConfigLoader{ConfigUrl: "http://localhost/config"}
+	_, err := loader.Watch("token", nil, 0, func() {})
+	c.Assert(err, Equals, ErrBadPollInterval)
+
+	loader = &ConfigLoader{ConfigUrl: "zk:///config"}
+	_, err = loader.Watch("token", nil, time.Second, func() {})
+	c.Assert(err, Equals, ErrNoZkConnection)
+}
@@ -7,4 +7,7 @@ import (
 var (
 	ErrNotSupportedProtocol = errors.New("bad-url-protocol")
 	ErrNoPath               = errors.New("no-path")
+	ErrBadPollInterval      = errors.New("bad-poll-interval")
+	ErrNoZkConnection       = errors.New("no-zk-connection")
+	ErrBadImageReference    = errors.New("bad-image-reference")
 )
@@ -0,0 +1,89 @@
+package dash
+
+import (
+	"strings"
+)
+
+// Image reference -- [registry/]repository[:tag][@digest], e.g. registry.example.com:5000/infradash/dash:1.2-34
+// or infradash/dash@sha256:<hex>.  The first component of the name is the registry if it has a dot or a port,
+// or is localhost; otherwise the image is on the docker hub.
+type ImageReference struct {
+	Registry   string `json:"registry,omitempty"`
+	Repository string `json:"repository"`
+	Tag        string `json:"tag,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+}
+
+func ParseImageReference(image string) (*ImageReference, error) {
+	ref := &ImageReference{}
+	name := strings.TrimSpace(image)
+	if i := strings.Index(name, "@"); i >= 0 {
+		name, ref.Digest = name[:i], name[i+1:]
+		if !strings.Contains(ref.Digest, ":") || strings.HasSuffix(ref.Digest, ":") {
+			return nil, ErrBadImageReference
+		}
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, ref.Tag = name[:i], name[i+1:]
+		if ref.Tag == "" {
+			return nil, ErrBadImageReference
+		}
+	}
+	if i := strings.Index(name, "/"); i > 0 {
+		host := name[:i]
+		if strings.ContainsAny(host, ".:") || host == "localhost" {
+			ref.Registry, name = host, name[i+1:]
+		}
+	}
+	if name == "" || strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") ||
+		strings.Contains(name, "//") || strings.ContainsAny(name, " :@") {
+		return nil, ErrBadImageReference
+	}
+	ref.Repository = name
+	return ref, nil
+}
+
+// Returns the name of the image, with the registry
+func (this *ImageReference) Name() string {
+	if this.Registry == "" {
+		return this.Repository
+	}
+	return this.Registry + "/" + this.Repository
+}
+
+func (this *ImageReference) String() string {
+	s := this.Name()
+	if this.Tag != "" {
+		s += ":" + this.Tag
+	}
+	if this.Digest != "" {
+		s += "@" + this.Digest
+	}
+	return s
+}
+
+// Returns the tag, or the digest for images pinned by digest alone
+func (this *ImageReference) Version() string {
+	if this.Tag != "" {
+		return this.Tag
+	}
+	return this.Digest
+}
+
+// Returns true if the image is the one referenced.  A reference without a registry refers to the image in any
+// registry, like the default registry of a domain, and a reference without a tag or digest to the latest tag.
+func (this *ImageReference) Refers(image *ImageReference) bool {
+	if this.Repository != image.Repository || (this.Registry != "" && this.Registry != image.Registry) {
+		return false
+	}
+	if this.Digest != "" {
+		return this.Digest == image.Digest
+	}
+	latest := func(tag string) string {
+		if tag == "" {
+			return "latest"
+		}
+		return tag
+	}
+	return latest(this.Tag) == latest(image.Tag)
+}
@@ -0,0 +1,243 @@
+package dash
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics -- counters, gauges and histograms, by the values of their labels, written in the Prometheus text
+// format.  Gauges of state that is cheaper to read than to keep up to date are set by collectors, which are
+// called before each write.
+
+type MetricType string
+
+const (
+	MetricCounter   MetricType = "counter"
+	MetricGauge     MetricType = "gauge"
+	MetricHistogram MetricType = "histogram"
+)
+
+// Buckets in seconds for latencies
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+type Metric struct {
+	Name    string
+	Help    string
+	Type    MetricType
+	Labels  []string
+	Buckets []float64
+
+	lock   sync.Mutex
+	series map[string]*metric_series
+}
+
+type metric_series struct {
+	labels []string
+	value  float64 // or the sum of a histogram
+	count  uint64
+	counts []uint64 // by bucket
+}
+
+type Metrics struct {
+	lock       sync.Mutex
+	metrics    []*Metric
+	collectors []func()
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{metrics: []*Metric{}, collectors: []func(){}}
+}
+
+func (this *Metrics) add(m *Metric) *Metric {
+	m.series = map[string]*metric_series{}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.metrics = append(this.metrics, m)
+	return m
+}
+
+func (this *Metrics) Counter(name, help string, labels ...string) *Metric {
+	return this.add(&Metric{Name: name, Help: help, Type: MetricCounter, Labels: labels})
+}
+
+func (this *Metrics) Gauge(name, help string, labels ...string) *Metric {
+	return this.add(&Metric{Name: name, Help: help, Type: MetricGauge, Labels: labels})
+}
+
+func (this *Metrics) Histogram(name, help string, buckets []float64, labels ...string) *Metric {
+	sorted := append([]float64{}, buckets...)
+	sort.Float64s(sorted)
+	return this.add(&Metric{Name: name, Help: help, Type: MetricHistogram, Labels: labels, Buckets: sorted})
+}
+
+// Adds a function called before the metrics are written
+func (this *Metrics) Collect(collector func()) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.collectors = append(this.collectors, collector)
+}
+
+func (this *Metric) get(values []string) *metric_series {
+	key := strings.Join(values, "\xff")
+	s, has := this.series[key]
+	if !has {
+		labels := make([]string, len(this.Labels))
+		copy(labels, values)
+		s = &metric_series{labels: labels, counts: make([]uint64, len(this.Buckets))}
+		this.series[key] = s
+	}
+	return s
+}
+
+// Adds to a counter or a gauge
+func (this *Metric) Add(v float64, values ...string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.get(values).value += v
+}
+
+func (this *Metric) Inc(values ...string) {
+	this.Add(1, values...)
+}
+
+// Sets a gauge
+func (this *Metric) Set(v float64, values ...string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.get(values).value = v
+}
+
+// Records an observation of a histogram
+func (this *Metric) Observe(v float64, values ...string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	s := this.get(values)
+	s.value += v
+	s.count += 1
+	for i, le := range this.Buckets {
+		if v <= le {
+			s.counts[i] += 1
+		}
+	}
+}
+
+// Clears all the series, for gauges set again by a collector
+func (this *Metric) Reset() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.series = map[string]*metric_series{}
+}
+
+// Returns the value of a counter or a gauge, or the count of a histogram
+func (this *Metric) Value(values ...string) float64 {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	s, has := this.series[strings.Join(values, "\xff")]
+	if !has {
+		return 0
+	}
+	if this.Type == MetricHistogram {
+		return float64(s.count)
+	}
+	return s.value
+}
+
+// Returns the value of a result label for the outcome
+func ResultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "ok"
+}
+
+func (this *Metrics) Write(w io.Writer) error {
+	this.lock.Lock()
+	collectors := append([]func(){}, this.collectors...)
+	metrics := append([]*Metric{}, this.metrics...)
+	this.lock.Unlock()
+
+	for _, collect := range collectors {
+		collect()
+	}
+	var buff bytes.Buffer
+	for _, m := range metrics {
+		m.write(&buff)
+	}
+	_, err := w.Write(buff.Bytes())
+	return err
+}
+
+func (this *Metrics) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	this.Write(resp)
+}
+
+func (this *Metric) write(w io.Writer) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", this.Name, escape_help(this.Help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", this.Name, this.Type)
+
+	keys := []string{}
+	for k := range this.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := this.series[k]
+		labels := this.format_labels(s.labels)
+		if this.Type != MetricHistogram {
+			fmt.Fprintf(w, "%s%s %s\n", this.Name, with_labels(labels), format_value(s.value))
+			continue
+		}
+		for i, le := range this.Buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", this.Name, with_labels(append(labels, `le="`+format_value(le)+`"`)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", this.Name, with_labels(append(labels, `le="+Inf"`)), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", this.Name, with_labels(labels), format_value(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", this.Name, with_labels(labels), s.count)
+	}
+}
+
+func (this *Metric) format_labels(values []string) []string {
+	labels := []string{}
+	for i, name := range this.Labels {
+		labels = append(labels, name+`="`+escape_label(values[i])+`"`)
+	}
+	return labels
+}
+
+func with_labels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+func format_value(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escape_help(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(s)
+}
+
+func escape_label(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(s)
+}
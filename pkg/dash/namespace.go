@@ -34,6 +34,33 @@ const (
 	KContainer = `
 {{define "KEY"}}/{{.Domain}}/{{.Service}}/{{.Version}}/container/{{.Image}}/{{.ContainerId}}:{{.ContainerPort}}{{end}}
 {{define "VALUE"}}{{.Host}}:{{.HostPort}}{{end}}
+`
+
+	// Slots of the semaphore bounding the instances of a service, of all its versions, across all hosts.
+	// The value of a held slot is the id of the container holding it.
+	KSemaphore = `
+{{define "KEY"}}/{{.Domain}}/{{.Service}}/semaphore{{end}}
+{{define "VALUE"}}{{.Max}}{{end}}
+`
+
+	// Outcome of a run once job, one node per value of the job's trigger.  Created by the agent that
+	// claims the run and updated with the exit code of the container.
+	KRunOnce = `
+{{define "KEY"}}/{{.Domain}}/{{.Service}}/run_once/{{.Run}}{{end}}
+{{define "VALUE"}}{{.Outcome}}{{end}}
+`
+
+	// Runs of a service started on a cron schedule, one node per run
+	KCron = `
+{{define "KEY"}}/{{.Domain}}/{{.Service}}/cron/{{.Run}}{{end}}
+{{define "VALUE"}}{{.Outcome}}{{end}}
+`
+
+	// Pull of the image of a release by each host, ahead of starting its containers.  The nodes are
+	// ephemeral so only the hosts with a live agent are counted.
+	KPull = `
+{{define "KEY"}}/{{.Domain}}/{{.Service}}/{{.Version}}/pull/{{.Host}}{{end}}
+{{define "VALUE"}}{{.Status}}{{end}}
 `
 
 	// Live watch node and information nodes are separate.  This is so we can implement a 'touch'
@@ -55,6 +82,10 @@ func init() {
 	must_compile_template(KReleaseWatch)
 	must_compile_template(KImage)
 	must_compile_template(KContainer)
+	must_compile_template(KSemaphore)
+	must_compile_template(KRunOnce)
+	must_compile_template(KCron)
+	must_compile_template(KPull)
 	must_compile_template(KEnvRoot)
 	must_compile_template(KEnv)
 	must_compile_template(KLive)
@@ -96,35 +127,26 @@ func RegistryKeyValue(k string, object interface{}, funcs ...template.FuncMap) (
 
 func ParseDockerImage(dockerImage string) (repo, tag string, err error) {
 	// docker image name := repo:tag tag := version-build
-	i := strings.Index(dockerImage, ":")
-	if i > -1 {
-		repo = dockerImage[:i]
-		tag = dockerImage[i+1:]
-		return
-	} else {
+	ref, err := ParseImageReference(dockerImage)
+	if err != nil || ref.Version() == "" {
 		err = errors.New("bad image:" + dockerImage)
 		return
 	}
+	return ref.Name(), ref.Version(), nil
 }
 
 func ParseVersion(dockerImage string) (repo, version, build string, err error) {
 	// docker image name := repo:tag tag := version-build
-	i := strings.Index(dockerImage, ":")
-	if i > -1 {
-		repo = dockerImage[:i]
-		tag := dockerImage[i+1:]
-		j := strings.LastIndex(tag, "-")
-		if j > -1 {
-			version = tag[:j]
-			build = tag[j+1:]
-			return
-		} else {
-			version = tag
-			build = ""
-			return
-		}
+	ref, err := ParseImageReference(dockerImage)
+	if err != nil || ref.Version() == "" {
+		return "", "", "", errors.New("bad image name:" + dockerImage)
+	}
+	repo, version = ref.Name(), ref.Version()
+	if j := strings.LastIndex(ref.Tag, "-"); j > -1 {
+		version = ref.Tag[:j]
+		build = ref.Tag[j+1:]
 	}
-	return "", "", "", errors.New("bad image name:" + dockerImage)
+	return
 }
 
 func ParseLiveValue(value string) (container_path, environment_path string) {
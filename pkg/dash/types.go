@@ -106,6 +106,24 @@ type RegistryLiveEntry struct {
 	Live bool `json:"live"`
 }
 
+type PullState string
+
+const (
+	PullPulling PullState = "pulling"
+	PullCached  PullState = "cached"
+	PullFailed  PullState = "failed"
+)
+
+// State of the pull of the image of a release on a host
+type PullStatus struct {
+	Image    string     `json:"image"`
+	Host     string     `json:"host"`
+	State    PullState  `json:"state"`
+	Started  time.Time  `json:"started"`
+	Finished *time.Time `json:"finished,omitempty"`
+	Error    string     `json:"error,omitempty"`
+}
+
 type RegistryContainerEntry struct {
 	Identity
 	RegistryReleaseEntry
@@ -1,7 +1,10 @@
 package dash
 
 import (
+	"bytes"
+	"errors"
 	. "gopkg.in/check.v1"
+	"strings"
 	"testing"
 )
 
@@ -56,3 +59,97 @@ func (suite *TestSuiteUtil) TestUtil(c *C) {
 	c.Assert(t3.Line2, Equals, "23-10")
 	c.Assert(t3.Line3, Equals, t1.Line3)
 }
+
+func (suite *TestSuiteUtil) TestImageReference(c *C) {
+	ref, err := ParseImageReference("registry.example.com:5000/infradash/dash")
+	c.Assert(err, Equals, nil)
+	c.Assert(*ref, DeepEquals, ImageReference{Registry: "registry.example.com:5000", Repository: "infradash/dash"})
+
+	ref, err = ParseImageReference("localhost:5000/dash:1.2-34")
+	c.Assert(err, Equals, nil)
+	c.Assert(*ref, DeepEquals, ImageReference{Registry: "localhost:5000", Repository: "dash", Tag: "1.2-34"})
+	c.Assert(ref.String(), Equals, "localhost:5000/dash:1.2-34")
+
+	ref, err = ParseImageReference("infradash/dash:1.2@sha256:abc")
+	c.Assert(err, Equals, nil)
+	c.Assert(*ref, DeepEquals, ImageReference{Repository: "infradash/dash", Tag: "1.2", Digest: "sha256:abc"})
+	c.Assert(ref.Version(), Equals, "1.2")
+
+	ref, err = ParseImageReference("infradash/dash@sha256:abc")
+	c.Assert(err, Equals, nil)
+	c.Assert(ref.Version(), Equals, "sha256:abc")
+
+	for _, bad := range []string{"", "dash:", "dash@abc", "/dash", "registry:5000/", "a//b"} {
+		_, err = ParseImageReference(bad)
+		c.Assert(err, Equals, ErrBadImageReference, Commentf("image %s", bad))
+	}
+
+	// References without a registry or tag, as given to the registry tool, and images as pulled by agents
+	pulled, _ := ParseImageReference("registry.example.com:5000/infradash/dash:latest")
+	for image, refers := range map[string]bool{
+		"infradash/dash":                           true,
+		"infradash/dash:latest":                    true,
+		"registry.example.com:5000/infradash/dash": true,
+		"localhost:5000/infradash/dash":            false,
+		"infradash/dash:1.2":                       false,
+		"infradash/dash@sha256:abc":                false,
+	} {
+		ref, _ := ParseImageReference(image)
+		c.Assert(ref.Refers(pulled), Equals, refers, Commentf("image %s", image))
+	}
+
+	repo, tag, err := ParseDockerImage("registry:5000/infradash/dash:1.2-34")
+	c.Assert(err, Equals, nil)
+	c.Assert(repo, Equals, "registry:5000/infradash/dash")
+	c.Assert(tag, Equals, "1.2-34")
+	_, _, err = ParseDockerImage("registry:5000/infradash/dash")
+	c.Assert(err, Not(Equals), nil)
+
+	repo, version, build, err := ParseVersion("registry:5000/infradash/dash:1.2-34")
+	c.Assert(err, Equals, nil)
+	c.Assert([]string{repo, version, build}, DeepEquals, []string{"registry:5000/infradash/dash", "1.2", "34"})
+}
+
+func (suite *TestSuiteUtil) TestMetrics(c *C) {
+	m := NewMetrics()
+	counter := m.Counter("test_runs_total", "Runs.", "result")
+	gauge := m.Gauge("test_up", "Up.")
+	histogram := m.Histogram("test_seconds", "Latency\nin seconds.", []float64{1, 0.1}, "path")
+
+	counter.Inc(ResultLabel(nil))
+	counter.Inc(ResultLabel(errors.New("x")))
+	counter.Add(2, "ok")
+	histogram.Observe(0.05, `a"b`)
+	histogram.Observe(0.5, `a"b`)
+	histogram.Observe(5, `a"b`)
+	m.Collect(func() { gauge.Set(1) })
+
+	c.Assert(counter.Value("ok"), Equals, 3.)
+	c.Assert(counter.Value("unknown"), Equals, 0.)
+	c.Assert(histogram.Value(`a"b`), Equals, 3.)
+
+	var buff bytes.Buffer
+	c.Assert(m.Write(&buff), Equals, nil)
+	c.Assert(buff.String(), Equals, strings.Join([]string{
+		"# HELP test_runs_total Runs.",
+		"# TYPE test_runs_total counter",
+		`test_runs_total{result="error"} 1`,
+		`test_runs_total{result="ok"} 3`,
+		"# HELP test_up Up.",
+		"# TYPE test_up gauge",
+		"test_up 1",
+		`# HELP test_seconds Latency\nin seconds.`,
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{path="a\"b",le="0.1"} 1`,
+		`test_seconds_bucket{path="a\"b",le="1"} 2`,
+		`test_seconds_bucket{path="a\"b",le="+Inf"} 3`,
+		`test_seconds_sum{path="a\"b"} 5.55`,
+		`test_seconds_count{path="a\"b"} 3`,
+		"",
+	}, "\n"))
+
+	gauge.Reset()
+	buff.Reset()
+	m.Write(&buff)
+	c.Assert(strings.Contains(buff.String(), "test_up 1"), Equals, true) // set again by the collector
+}
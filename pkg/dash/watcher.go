@@ -70,6 +70,21 @@ func (this *ZkWatcher) StopWatch(key string) {
 	if stop, has := this.watches[key]; has {
 		glog.Infoln("Stopping current watch at", key)
 		stop <- true
+		delete(this.watches, key)
+		delete(this.rules, key)
+	}
+}
+
+// Stops all the watches
+func (this *ZkWatcher) StopAll() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	for key, stop := range this.watches {
+		glog.Infoln("Stopping watch at", key)
+		stop <- true
+		delete(this.watches, key)
+		delete(this.rules, key)
 	}
 }
 
@@ -9,6 +9,7 @@ const (
 	ApiGetInfo api.ServiceMethod = iota
 	ApiProcessList
 	ApiQuitQuitQuit
+	ApiMetrics
 )
 
 var Methods = api.ServiceMethods{
@@ -41,6 +42,15 @@ Exits the process
 			"wait": "5s",
 		},
 	},
+	ApiMetrics: api.MethodSpec{
+		Doc: `
+Metrics in the Prometheus text format: runs and restarts of the child process, config reloads,
+lines of tailed files shipped and uptime.
+`,
+		UrlRoute:     "/metrics",
+		HttpMethod:   "GET",
+		ContentTypes: []string{"text/plain"},
+	},
 }
 
 var Types = struct {
@@ -300,7 +300,10 @@ func (this *Executor) Exec() {
 	}
 
 	// Keep looping if
-	for runs != 0 {
+	for run := 0; runs != 0; run++ {
+		if run > 0 {
+			metric_child_restarts.Inc()
+		}
 
 		glog.Infoln(runs, "Starting Task", "Id=", target.Id, "ExecOnly=", target.ExecOnly)
 		if target.Cmd != nil {
@@ -372,6 +375,7 @@ func (this *Executor) Wait() error {
 func (this *Executor) exec_wait(done chan error, timeout <-chan time.Time) {
 	select {
 	case result := <-done:
+		metric_child_runs.Inc(ResultLabel(result))
 		switch result {
 		case task.ErrTimeout:
 			panic(result)
@@ -383,6 +387,7 @@ func (this *Executor) exec_wait(done chan error, timeout <-chan time.Time) {
 			}
 		}
 	case <-timeout:
+		metric_child_runs.Inc("timeout")
 		panic("timeout")
 	}
 }
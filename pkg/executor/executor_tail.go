@@ -55,6 +55,7 @@ func (this *Executor) TailFile(path string, outstream io.Writer) error {
 			select {
 			case line := <-output:
 				fmt.Fprintf(outstream, "%s", line)
+				metric_tail_lines.Inc(path)
 				glog.V(100).Infoln(path, "=>", fmt.Sprintf("%s", line))
 			case term := <-stop:
 				if term {
@@ -2,6 +2,7 @@ package executor
 
 import (
 	"github.com/golang/glog"
+	. "github.com/infradash/dash/pkg/dash"
 	"github.com/qorio/maestro/pkg/template"
 	"github.com/qorio/maestro/pkg/zk"
 	"io/ioutil"
@@ -40,6 +41,12 @@ func (this *Executor) HandleConfigReload(cf *ConfigFile) error {
 }
 
 func (this *Executor) Reload(cf *ConfigFile) error {
+	err := this.reload(cf)
+	metric_config_reloads.Inc(cf.Path, ResultLabel(err))
+	return err
+}
+
+func (this *Executor) reload(cf *ConfigFile) error {
 	pre_process(cf)
 	configBuff, err := template.ExecuteUrl(this.zk, cf.Url, this.AuthToken, this)
 	if err != nil {
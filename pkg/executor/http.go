@@ -28,7 +28,9 @@ func NewApiEndPoint(executor *Executor) (ep *EndPoint, err error) {
 		rest.SetHandler(Methods[ApiGetInfo], ep.GetInfo),
 		rest.SetHandler(Methods[ApiProcessList], ep.ProcessList),
 		rest.SetHandler(Methods[ApiQuitQuitQuit], ep.QuitQuitQuit),
+		rest.SetHandler(Methods[ApiMetrics], ep.Metrics),
 	)
+	metrics.Collect(executor.collect_metrics)
 	return ep, nil
 }
 
@@ -104,3 +106,7 @@ func (this *EndPoint) QuitQuitQuit(resp http.ResponseWriter, req *http.Request)
 		os.Exit(0)
 	}()
 }
+
+func (this *EndPoint) Metrics(resp http.ResponseWriter, req *http.Request) {
+	metrics.ServeHTTP(resp, req)
+}
@@ -0,0 +1,29 @@
+package executor
+
+import (
+	. "github.com/infradash/dash/pkg/dash"
+	"time"
+)
+
+// Metrics -- exported at /metrics in the Prometheus text format when running as a daemon.
+
+var (
+	metrics = NewMetrics()
+
+	metric_child_runs = metrics.Counter("dash_executor_child_runs_total",
+		"Runs of the child process by outcome.", "result")
+	metric_child_restarts = metrics.Counter("dash_executor_child_restarts_total",
+		"Runs of the child process after the first.")
+	metric_config_reloads = metrics.Counter("dash_executor_config_reloads_total",
+		"Reloads of config files by outcome.", "path", "result")
+	metric_tail_lines = metrics.Counter("dash_executor_tail_lines_total",
+		"Lines of tailed files shipped.", "path")
+	metric_uptime = metrics.Gauge("dash_executor_uptime_seconds",
+		"Seconds since the executor started.")
+)
+
+func (this *Executor) collect_metrics() {
+	if this.StartTimeUnix > 0 {
+		metric_uptime.Set(time.Since(time.Unix(this.StartTimeUnix, 0)).Seconds())
+	}
+}
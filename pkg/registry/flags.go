@@ -14,6 +14,7 @@ func (this *Registry) BindFlags() {
 	flag.StringVar(&this.ReadValuePath, "readpath", "", "The path to read value from")
 	flag.IntVar(&this.SetliveMinThreshold, "setlive_min_instances", 1, "Minimal available instances before setlive.")
 	flag.DurationVar(&this.SetliveWait, "setlive_wait", time.Duration(1*time.Minute), "Wait internval to check available instances.")
+	flag.IntVar(&this.SetliveMinCached, "setlive_min_cached", 0, "Minimal hosts with the image pulled before setlive. 0 to not wait.")
 	flag.DurationVar(&this.SetliveMaxWait, "setlive_maxwait", time.Duration(5*time.Minute), "Setlive: max wait before giving up.")
 
 	flag.StringVar(&this.WriteValue, "writevalue", "", "The value to write")
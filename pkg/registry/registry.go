@@ -1,6 +1,7 @@
 package registry
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/golang/glog"
@@ -39,6 +40,7 @@ type Registry struct {
 	SetliveMinThreshold int           `json:"setlive_min_instances"`
 	SetliveWait         time.Duration `json:"setlive_wait"`
 	SetliveMaxWait      time.Duration `json:"setlive_max_wait"`
+	SetliveMinCached    int           `json:"setlive_min_cached"`
 
 	Commit bool
 
@@ -54,6 +56,13 @@ func (this *Registry) check_input() error {
 		return nil
 	}
 
+	// Images can be released by tag or by digest, e.g. repo@sha256:...
+	if this.Release && this.Image != "" {
+		if _, err := ParseImageReference(this.Image); err != nil {
+			return err
+		}
+	}
+
 	if this.SchedulerImagePath == "" && this.SchedulerTriggerPath == "" {
 		switch {
 		case this.Domain == "":
@@ -108,6 +117,50 @@ func (this *Registry) Finish() {
 	}
 }
 
+// Counts the hosts that have pulled the image of the release
+func (this *Registry) count_cached() int {
+	key, _, err := RegistryKeyValue(KPull, map[string]interface{}{
+		"Domain":  this.Domain,
+		"Service": this.Service,
+		"Version": this.Version,
+		"Host":    "",
+	})
+	if err != nil {
+		return 0
+	}
+	parent, err := this.zk.Get(strings.TrimRight(key, "/"))
+	if err != nil {
+		glog.Infoln("No pulls under", key, "Err=", err)
+		return 0
+	}
+	hosts, err := parent.Children()
+	if err != nil {
+		return 0
+	}
+	// Agents record the image as pulled: in the default registry of the domain and tagged latest if untagged
+	var image *ImageReference
+	if this.Image != "" {
+		if image, err = ParseImageReference(this.Image); err != nil {
+			glog.Warningln("Bad image", this.Image, "Err=", err)
+			return 0
+		}
+	}
+	count := 0
+	for _, host := range hosts {
+		status := new(PullStatus)
+		if json.Unmarshal(host.GetValue(), status) != nil || status.State != PullCached {
+			continue
+		}
+		if image == nil {
+			count++
+		} else if pulled, err := ParseImageReference(status.Image); err == nil && image.Refers(pulled) {
+			count++
+		}
+	}
+	glog.Infoln("Image", this.Image, "pulled by", count, "hosts")
+	return count
+}
+
 func (this *Registry) Run() error {
 
 	defer this.Finish()
@@ -243,6 +296,15 @@ func (this *Registry) Run() error {
 							return errors.New(fmt.Sprintf("Setlive: Timeout waiting for instances in %s", containers_path))
 						}
 
+					case this.SetliveMinCached > 0 && this.count_cached() < this.SetliveMinCached:
+						glog.Infoln("Hosts with image", this.Image, "less than threshold", this.SetliveMinCached, "Check later")
+
+						time.Sleep(this.SetliveWait)
+						waited += this.SetliveWait
+						if waited >= this.SetliveMaxWait {
+							return errors.New(fmt.Sprintf("Setlive: Timeout waiting for hosts to pull %s", this.Image))
+						}
+
 					default:
 						glog.Infoln("Found", cp.Stats.NumChildren, "instances. Continue")
 						poll = false